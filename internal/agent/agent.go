@@ -4,13 +4,23 @@ import (
 	"crypto/tls"
 	"fmt"
 	"logstore/internal/authz"
+	logclient "logstore/internal/client"
 	"logstore/internal/discovery"
+	"logstore/internal/group"
 	"logstore/internal/log/proto"
 	"logstore/internal/logcomponents"
+	"logstore/internal/mux"
 	"logstore/internal/server"
+	"logstore/internal/transaction"
 	"net"
+	"os"
+	"path"
+	"strconv"
 	"sync"
+	"time"
 
+	"github.com/hashicorp/raft"
+	"go.opencensus.io/stats/view"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
@@ -21,14 +31,22 @@ Agent struct is used for node coordination/operation
 */
 type Agent struct {
 	Config
-	log        *logcomponents.Log
-	server     *grpc.Server
-	membership *discovery.Membership
-	replica    *logcomponents.Replica
+	mux         *mux.Mux
+	log         *logcomponents.Log
+	distributed *logcomponents.DistributedLog //set in Raft mode
+	topics      *logcomponents.Topics
+	offsets     *group.Offsets
+	coordinator *group.Coordinator
+	decisions   *transaction.Decisions
+	txns        *transaction.Coordinator
+	server      *grpc.Server
+	membership  *discovery.Membership
+	replica     *logcomponents.Replica //set unless in Raft mode
 
 	shutdown     bool
 	shutdowns    chan struct{}
 	shutdownLock sync.Mutex
+	background   sync.WaitGroup //goroutines to drain before closing the log
 }
 
 func New(config Config) (*Agent, error) {
@@ -38,7 +56,14 @@ func New(config Config) (*Agent, error) {
 	}
 	setup := []func() error{
 		a.setupLogger,
+		a.setupMux,
+		a.setupOffsets,
 		a.setupLog,
+		a.setupTopics,
+		a.setupGroups,
+		a.setupTransactions,
+		a.setupRetention,
+		a.setupCompaction,
 		a.setupServer,
 		a.setupMembership,
 	}
@@ -48,6 +73,7 @@ func New(config Config) (*Agent, error) {
 			return nil, err
 		}
 	}
+	go a.serve()
 	return a, nil
 }
 
@@ -60,16 +86,355 @@ func (a *Agent) setupLogger() error {
 	return nil
 }
 
+/*
+setupMux listens on the RPC address. Protocols sharing the port each
+get a route; gRPC takes the connections matching none.
+*/
+func (a *Agent) setupMux() error {
+	rpcAddr, err := a.RPCAddr()
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", rpcAddr)
+	if err != nil {
+		return err
+	}
+	a.mux = mux.New(ln)
+	return nil
+}
+
+//logConfig configures the log and every topic partition alike
+func (a *Agent) logConfig() logcomponents.Config {
+	logConfig := logcomponents.Config{}
+	logConfig.Durability = a.Config.Durability
+	logConfig.Retention = a.Config.Retention
+	logConfig.Compaction = a.Config.Compaction
+	return logConfig
+}
+
 func (a *Agent) setupLog() error {
+	logConfig := a.logConfig()
+
+	//Raft keeps its own state beside the log, so the log gets a directory
+	dir := a.Config.DataDir
+	if a.Config.Raft {
+		dir = path.Join(dir, "log")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
 	var err error
 	a.log, err = logcomponents.NewLog(
+		dir,
+		logConfig,
+	)
+	if err != nil || !a.Config.Raft {
+		return err
+	}
+	return a.setupRaft(logConfig)
+}
+
+/*
+setupRaft wraps the log in a DistributedLog with its transport on the
+multiplexed RPC port. A bootstrapping node waits to elect itself.
+*/
+func (a *Agent) setupRaft(logConfig logcomponents.Config) error {
+	route := mux.Route{
+		Prefix:          []byte{logcomponents.RaftRPC},
+		ServerTLSConfig: a.Config.ServerTLSConfig,
+		PeerTLSConfig:   a.Config.PeerTLSConfig,
+	}
+	logConfig.Raft.StreamLayer = logcomponents.NewStreamLayer(
+		a.mux.Listen(route),
+		route,
+	)
+	logConfig.Raft.LocalID = raft.ServerID(a.Config.NodeName)
+	logConfig.Raft.Bootstrap = a.Config.Bootstrap
+	logConfig.Raft.Offsets = a.offsets
+
+	var err error
+	a.distributed, err = logcomponents.NewDistributedLog(
+		a.log,
+		path.Join(a.Config.DataDir, "raft"),
+		logConfig,
+	)
+	if err != nil {
+		return err
+	}
+	a.offsets.Replicate = a.distributed.CommitOffset
+	if a.Config.Bootstrap {
+		return a.distributed.WaitForLeader(3 * time.Second)
+	}
+	return nil
+}
+
+/*
+setupTopics opens the topics kept in DataDir, each in a directory of
+its own beside those of the log, Raft and replication. Raft replicates
+only the default topic, so in Raft mode there are no others.
+*/
+func (a *Agent) setupTopics() error {
+	if a.Config.Raft {
+		return nil
+	}
+	var err error
+	a.topics, err = logcomponents.NewTopics(
 		a.Config.DataDir,
-		logcomponents.Config{},
+		a.logConfig(),
+		"log", "raft", "replication", "snapshot", "groups", "transactions",
 	)
+	return err
+}
 
+/*
+setupOffsets opens the offsets consumer groups have committed, kept in
+a compacted log of their own. In Raft mode they're replicated with the
+log, so they're open before Raft starts applying entries to them.
+*/
+func (a *Agent) setupOffsets() error {
+	var err error
+	a.offsets, err = group.NewOffsets(
+		path.Join(a.Config.DataDir, "groups"),
+		a.logConfig(),
+	)
 	return err
 }
 
+/*
+setupGroups starts the coordinator of consumer groups, and the tickers
+expiring members whose sessions lapse and compacting the offsets. Only
+the offsets are replicated in Raft mode: members join the new leader
+again after a failover, resuming from what their group committed.
+*/
+func (a *Agent) setupGroups() error {
+	var topics group.Topics
+	if a.topics != nil {
+		topics = a.topics
+	}
+	a.coordinator = group.NewCoordinator(topics, a.offsets)
+
+	logger := zap.L().Named("group")
+	a.every(time.Second, func(now time.Time) {
+		if expired := a.coordinator.Expire(now); expired > 0 {
+			logger.Info("expired members", zap.Int("members", expired))
+		}
+	})
+	a.every(a.Config.CompactionInterval, func(now time.Time) {
+		if _, err := a.offsets.Compact(now); err != nil {
+			logger.Error("failed to compact offsets", zap.Error(err))
+		}
+	})
+	return nil
+}
+
+/*
+setupTransactions opens the decisions transactions left unfinished,
+kept in a compacted log of their own, and takes back the transactions
+open when the agent last stopped. Then it starts the tickers expiring
+transactions and compacting the decisions. In Raft mode only the leader
+can end the default topic's transactions, so it takes over those open
+in the replicated log whenever it becomes the leader.
+*/
+func (a *Agent) setupTransactions() error {
+	var err error
+	a.decisions, err = transaction.NewDecisions(
+		path.Join(a.Config.DataDir, "transactions"),
+		a.logConfig(),
+	)
+	if err != nil {
+		return err
+	}
+	a.txns = transaction.NewCoordinator(a.partition, a.decisions)
+
+	logger := zap.L().Named("transaction")
+	open := make(map[string][]*proto.TopicPartition)
+	if a.topics != nil {
+		open = a.topics.OpenTransactions()
+	}
+	if a.distributed == nil {
+		for _, id := range a.log.OpenTransactions() {
+			open[id] = append(open[id], &proto.TopicPartition{})
+		}
+	}
+	if err = a.txns.Restore(open); err != nil {
+		logger.Error("failed to finish transactions", zap.Error(err))
+	}
+	if a.distributed != nil {
+		a.takeOverTransactions(logger)
+	}
+	a.every(time.Second, func(now time.Time) {
+		aborted, err := a.txns.Expire(now)
+		if err != nil {
+			logger.Error("failed to finish transactions", zap.Error(err))
+		}
+		if aborted > 0 {
+			logger.Info("aborted transactions", zap.Int("transactions", aborted))
+		}
+	})
+	a.every(a.Config.CompactionInterval, func(now time.Time) {
+		if _, err := a.decisions.Compact(now); err != nil {
+			logger.Error("failed to compact decisions", zap.Error(err))
+		}
+	})
+	return nil
+}
+
+/*
+takeOverTransactions hands the transactions open in the replicated log
+to the coordinator whenever the agent becomes the Raft leader, for it to
+end them or let them expire. It stops when the agent shuts down.
+*/
+func (a *Agent) takeOverTransactions(logger *zap.Logger) {
+	leaderCh := a.distributed.LeaderCh()
+	a.background.Add(1)
+	go func() {
+		defer a.background.Done()
+		for {
+			select {
+			case <-a.shutdowns:
+				return
+			case leader := <-leaderCh:
+				if !leader {
+					continue
+				}
+				ids, err := a.distributed.OpenTransactions()
+				if err != nil {
+					logger.Error("failed to take over transactions", zap.Error(err))
+					continue
+				}
+				open := make(map[string][]*proto.TopicPartition)
+				for _, id := range ids {
+					open[id] = []*proto.TopicPartition{{}}
+				}
+				a.txns.TakeOver(open)
+			}
+		}
+	}()
+}
+
+//partition resolves a topic's partition for transactions to append to
+func (a *Agent) partition(topic string, partition uint32) (transaction.Log, error) {
+	if topic == "" {
+		if partition != 0 {
+			return nil, proto.ErrPartitionNotFound{Partition: partition}
+		}
+		if a.distributed != nil {
+			return a.distributed, nil
+		}
+		return a.log, nil
+	}
+	if a.topics == nil {
+		return nil, proto.ErrTopicNotFound{Topic: topic}
+	}
+	log, err := a.topics.Partition(topic, partition)
+	if err != nil {
+		return nil, err
+	}
+	return log, nil
+}
+
+/*
+topicManager serves the agent's topics to the server, their partitions
+as CommitLogs
+*/
+type topicManager struct {
+	*logcomponents.Topics
+}
+
+func (t topicManager) Partition(topic string, partition uint32) (
+	server.CommitLog,
+	error,
+) {
+	log, err := t.Topics.Partition(topic, partition)
+	if err != nil {
+		return nil, err
+	}
+	return log, nil
+}
+
+/*
+setupRetention starts the ticker enforcing the retention policy on the
+log and topics. It stops when the agent shuts down.
+*/
+func (a *Agent) setupRetention() error {
+	r := a.Config.Retention
+	if r.MaxAge == 0 && r.MaxBytes == 0 {
+		return nil
+	}
+	logger := zap.L().Named("retention")
+	a.every(a.Config.RetentionInterval, func(now time.Time) {
+		removed, err := a.log.EnforceRetention(now)
+		if err != nil {
+			logger.Error("failed to enforce retention", zap.Error(err))
+		} else if removed > 0 {
+			logger.Info("removed segments", zap.Int("segments", removed))
+		}
+		if a.topics == nil {
+			return
+		}
+		removed, err = a.topics.EnforceRetention(now)
+		if err != nil {
+			logger.Error("failed to enforce topic retention", zap.Error(err))
+		} else if removed > 0 {
+			logger.Info("removed topic segments", zap.Int("segments", removed))
+		}
+	})
+	return nil
+}
+
+/*
+setupCompaction starts the ticker compacting the log and topics when
+compaction is enabled. It stops when the agent shuts down.
+*/
+func (a *Agent) setupCompaction() error {
+	if !a.Config.Compaction.Enabled {
+		return nil
+	}
+	logger := zap.L().Named("compaction")
+	a.every(a.Config.CompactionInterval, func(now time.Time) {
+		removed, err := a.log.Compact(now)
+		if err != nil {
+			logger.Error("failed to compact", zap.Error(err))
+		} else if removed > 0 {
+			logger.Info("removed records", zap.Int("records", removed))
+		}
+		if a.topics == nil {
+			return
+		}
+		removed, err = a.topics.Compact(now)
+		if err != nil {
+			logger.Error("failed to compact topics", zap.Error(err))
+		} else if removed > 0 {
+			logger.Info("removed topic records", zap.Int("records", removed))
+		}
+	})
+	return nil
+}
+
+/*
+every runs fn on a background ticker, a minute apart by default, until
+the agent shuts down. Shutdown waits for fn to return before closing the log.
+*/
+func (a *Agent) every(interval time.Duration, fn func(time.Time)) {
+	if interval == 0 {
+		interval = time.Minute
+	}
+	a.background.Add(1)
+	go func() {
+		defer a.background.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.shutdowns:
+				return
+			case now := <-ticker.C:
+				fn(now)
+			}
+		}
+	}()
+}
+
 func (a *Agent) setupServer() error {
 	authorizer := authz.New(
 		a.Config.ACLModelFile,
@@ -77,8 +442,23 @@ func (a *Agent) setupServer() error {
 	)
 
 	serverConfig := &server.Config{
-		CommitLog:  a.log,
-		Authorizer: authorizer,
+		CommitLog:              a.log,
+		Authorizer:             authorizer,
+		GetServerer:            a,
+		ReplicationReporter:    a,
+		Snapshotter:            a.log,
+		Partitioner:            &logclient.HashPartitioner{},
+		GroupCoordinator:       a.coordinator,
+		TransactionCoordinator: a.txns,
+		//Replicas report their progress to the Acks, Raft's followers to Raft
+		Acknowledger: logcomponents.NewAcks(),
+	}
+	if a.topics != nil {
+		serverConfig.TopicManager = topicManager{a.topics}
+	}
+	if a.distributed != nil {
+		serverConfig.CommitLog = a.distributed
+		serverConfig.Acknowledger = a.distributed
 	}
 
 	var opts []grpc.ServerOption
@@ -92,16 +472,10 @@ func (a *Agent) setupServer() error {
 	if err != nil {
 		return err
 	}
-	rpcAddr, err := a.RPCAddr()
-	if err != nil {
-		return err
-	}
-	listener, err := net.Listen("tcp", rpcAddr)
-	if err != nil {
-		return err
-	}
+	//gRPC does its own TLS handshake, authorization needs the client's certificate
+	grpcLn := a.mux.Fallback()
 	go func() {
-		if err := a.server.Serve(listener); err != nil {
+		if err := a.server.Serve(grpcLn); err != nil {
 			_ = a.Shutdown()
 		}
 	}()
@@ -113,26 +487,38 @@ func (a *Agent) setupMembership() error {
 	if err != nil {
 		return err
 	}
-	var opts []grpc.DialOption
-	if a.Config.PeerTLSConfig != nil {
-		dialOpt := grpc.WithTransportCredentials(
-			credentials.NewTLS(a.Config.PeerTLSConfig),
-		)
-		opts = append(opts, dialOpt)
-	}
+	//Raft replicates on its own, membership only changes its voters
+	var handler discovery.Handler = a.distributed
+	if a.distributed == nil {
+		var opts []grpc.DialOption
+		if a.Config.PeerTLSConfig != nil {
+			dialOpt := grpc.WithTransportCredentials(
+				credentials.NewTLS(a.Config.PeerTLSConfig),
+			)
+			opts = append(opts, dialOpt)
+		}
 
-	conn, err := grpc.Dial(rpcAddr, opts...)
-	if err != nil {
-		return err
-	}
-	client := proto.NewLogClient(conn)
-	a.replica = &logcomponents.Replica{
-		DialOptions: opts,
-		LocalServer: client,
+		conn, err := grpc.Dial(rpcAddr, opts...)
+		if err != nil {
+			return err
+		}
+		client := proto.NewLogClient(conn)
+		a.replica = &logcomponents.Replica{
+			DialOptions: opts,
+			LocalServer: client,
+			NodeName:    a.Config.NodeName,
+			ProgressDir: path.Join(a.Config.DataDir, "replication"),
+			Log:         a.log,
+			SnapshotDir: path.Join(a.Config.DataDir, "snapshot"),
+		}
+		handler = a.replica
+		if err := view.Register(logcomponents.ReplicaViews...); err != nil {
+			return err
+		}
 	}
 
 	a.membership, err = discovery.New(
-		a.replica,
+		handler,
 		discovery.Config{
 			NodeName: a.Config.NodeName,
 			BindAddr: a.Config.BindAddr,
@@ -142,9 +528,106 @@ func (a *Agent) setupMembership() error {
 			StartJoinAddrs: a.Config.StartJoinAddrs,
 		},
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	a.setupHighOffset()
+	return nil
+}
+
+/*
+setupHighOffset gossips the log's highest offset as a tag whenever it
+has moved, for GetServers to report from any member.
+*/
+func (a *Agent) setupHighOffset() {
+	interval := a.Config.HighOffsetInterval
+	if interval == 0 {
+		interval = time.Second
+	}
+	logger := zap.L().Named("membership")
+	var gossiped string
+	a.every(interval, func(time.Time) {
+		high, err := a.log.HighestOffset()
+		if err != nil {
+			logger.Error("failed to read high offset", zap.Error(err))
+			return
+		}
+		tag := strconv.FormatUint(high, 10)
+		if tag == gossiped {
+			return
+		}
+		if err = a.membership.SetTag(highOffsetTag, tag); err != nil {
+			logger.Error("failed to gossip high offset", zap.Error(err))
+			return
+		}
+		gossiped = tag
+	})
+}
+
+//Replication describes the replica's progress pulling from each peer, nothing in Raft mode
+func (a *Agent) Replication() []*proto.ReplicationStatus {
+	if a.replica == nil {
+		return nil
+	}
+	return a.replica.Replication()
+}
+
+//highOffsetTag is the membership tag holding a member's gossiped high offset
+const highOffsetTag = "high_offset"
+
+/*
+GetServers lists every member gossip knows of, including those that
+have left or failed. Members' high offsets are as they last gossiped
+them, this agent's own is read from its log.
+*/
+func (a *Agent) GetServers() ([]*proto.Server, error) {
+	var leader string
+	if a.distributed != nil {
+		leader = a.distributed.Leader()
+	}
+	var servers []*proto.Server
+	for _, member := range a.membership.Members() {
+		server := &proto.Server{
+			Id:      member.Name,
+			RpcAddr: member.Tags["rpc_addr"],
+			Role:    proto.Server_REPLICA,
+			Status:  member.Status.String(),
+		}
+		if a.distributed != nil {
+			server.Role = proto.Server_FOLLOWER
+			if server.RpcAddr == leader {
+				server.Role = proto.Server_LEADER
+			}
+		}
+		if member.Name == a.Config.NodeName {
+			high, err := a.log.HighestOffset()
+			if err != nil {
+				return nil, err
+			}
+			server.HighOffset = high
+		} else if tag, ok := member.Tags[highOffsetTag]; ok {
+			high, err := strconv.ParseUint(tag, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			server.HighOffset = high
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
 }
 
+func (a *Agent) serve() error {
+	if err := a.mux.Serve(); err != nil {
+		_ = a.Shutdown()
+		return err
+	}
+	return nil
+}
+
+//shutdownGrace is how long Shutdown lets RPCs in flight finish
+const shutdownGrace = time.Second
+
 func (a *Agent) Shutdown() error {
 	a.shutdownLock.Lock()
 	defer a.shutdownLock.Unlock()
@@ -154,15 +637,36 @@ func (a *Agent) Shutdown() error {
 	a.shutdown = true
 	close(a.shutdowns)
 	graceful := func() error {
-		a.server.GracefulStop()
+		//Streams following the log's tail never finish, they're cut off
+		stopped := make(chan struct{})
+		go func() {
+			a.server.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(shutdownGrace):
+			a.server.Stop()
+		}
+		return nil
+	}
+	drain := func() error {
+		a.background.Wait()
 		return nil
 	}
-	shutdown := []func() error{
-		a.membership.Leave,
-		a.replica.Close,
-		graceful,
-		a.log.Close,
+	shutdown := []func() error{a.membership.Leave}
+	if a.replica != nil {
+		shutdown = append(shutdown, a.replica.Close)
+	}
+	shutdown = append(shutdown, graceful, a.mux.Close, drain)
+	if a.distributed != nil {
+		shutdown = append(shutdown, a.distributed.Close)
+	}
+	shutdown = append(shutdown, a.log.Close)
+	if a.topics != nil {
+		shutdown = append(shutdown, a.topics.Close)
 	}
+	shutdown = append(shutdown, a.offsets.Close, a.decisions.Close)
 	for _, fn := range shutdown {
 		if err := fn(); err != nil {
 			return err
@@ -181,6 +685,19 @@ type Config struct {
 	StartJoinAddrs  []string
 	ACLModelFile    string
 	ACLPolicyFile   string
+	Durability      logcomponents.Durability
+	Retention       logcomponents.Retention
+	//RetentionInterval is how often retention is enforced, a minute by default
+	RetentionInterval time.Duration
+	Compaction        logcomponents.Compaction
+	//CompactionInterval is how often the log is compacted, a minute by default
+	CompactionInterval time.Duration
+	//Raft replicates the log through Raft instead of every node pulling from every other
+	Raft bool
+	//Bootstrap starts a new Raft cluster with this node as its first voter
+	Bootstrap bool
+	//HighOffsetInterval is how often the log's high offset is gossiped, a second by default
+	HighOffsetInterval time.Duration
 }
 
 func (c Config) RPCAddr() (string, error) {
@@ -5,8 +5,11 @@ import (
 	"crypto/tls"
 	"fmt"
 	"io/ioutil"
+	logclient "logstore/internal/client"
 	"logstore/internal/config"
+	"logstore/internal/loadbalance"
 	"logstore/internal/log/proto"
+	"logstore/internal/logcomponents"
 	"logstore/internal/portutil"
 	"os"
 	"testing"
@@ -14,10 +17,513 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 )
 
 func TestAgent(t *testing.T) {
+	agents, peerTLSConfig := setupAgents(t, 3, func(_ int, c *Config) {
+		c.Durability = logcomponents.Durability{
+			Mode: logcomponents.DurabilityFlush,
+		}
+		c.Retention = logcomponents.Retention{
+			MaxAge: time.Hour,
+		}
+		c.RetentionInterval = 100 * time.Millisecond
+	})
+	time.Sleep(3 * time.Second)
+
+	leader := client(t, agents[0], peerTLSConfig)
+	appendResponse, err := leader.Append(
+		context.Background(),
+		&proto.AppendRequest{
+			Record: &proto.Record{
+				Value: []byte("record"),
+			},
+		},
+	)
+	assert.NoError(t, err)
+
+	readResponse, err := leader.Read(
+		context.Background(),
+		&proto.ReadRequest{
+			Offset: appendResponse.Offset,
+		},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, readResponse.Record.Value, []byte("record"))
+
+	time.Sleep(3 * time.Second)
+
+	follower := client(t, agents[1], peerTLSConfig)
+	readResponse, err = follower.Read(
+		context.Background(),
+		&proto.ReadRequest{
+			Offset: appendResponse.Offset,
+		},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, readResponse.Record.Value, []byte("record"))
+
+	//Records appended anywhere reach every node exactly once
+	const n = 3
+	for _, agent := range agents[1:] {
+		c := client(t, agent, peerTLSConfig)
+		for i := 0; i < n; i++ {
+			_, err := c.Append(
+				context.Background(),
+				&proto.AppendRequest{
+					Record: &proto.Record{
+						Value: []byte(fmt.Sprintf("%s-%d", agent.NodeName, i)),
+					},
+				},
+			)
+			assert.NoError(t, err)
+		}
+	}
+	total := uint64(1 + n*(len(agents)-1))
+	length := func(agent *Agent) uint64 {
+		off, err := agent.log.HighestOffset()
+		assert.NoError(t, err)
+		return off + 1
+	}
+	for _, agent := range agents {
+		assert.Eventually(t, func() bool {
+			return length(agent) == total
+		}, 5*time.Second, 100*time.Millisecond)
+	}
+	//Stays converged rather than echoing between nodes
+	time.Sleep(time.Second)
+	for _, agent := range agents {
+		assert.Equal(t, total, length(agent))
+	}
+
+	//acks=all returns once the other agents have pulled the record
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	appendResponse, err = leader.Append(ctx, &proto.AppendRequest{
+		Record:   &proto.Record{Value: []byte("acked")},
+		Acks:     proto.AppendRequest_ALL,
+		Replicas: uint32(len(agents) - 1),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, total, appendResponse.Offset)
+	total++
+	for _, agent := range agents[1:] {
+		record, err := agent.log.Read(appendResponse.Offset)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("acked"), record.Value)
+	}
+
+	//and reports replicating each of them to the end
+	assert.Eventually(t, func() bool {
+		res, err := follower.GetReplication(
+			context.Background(),
+			&proto.GetReplicationRequest{},
+		)
+		if err != nil || len(res.Peers) != len(agents)-1 {
+			return false
+		}
+		for _, peer := range res.Peers {
+			if !peer.Connected || peer.LagRecords != 0 ||
+				peer.PeerNextOffset != total {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 100*time.Millisecond)
+
+	//Any agent lists the others, with the high offsets they gossip
+	assert.Eventually(t, func() bool {
+		res, err := follower.GetServers(
+			context.Background(),
+			&proto.GetServersRequest{},
+		)
+		if err != nil || len(res.Servers) != len(agents) {
+			return false
+		}
+		for _, server := range res.Servers {
+			if server.Role != proto.Server_REPLICA ||
+				server.Status != "alive" ||
+				server.HighOffset != total-1 {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 100*time.Millisecond)
+
+	//Topics sit beside the log in the agent's data directory, apart from it
+	_, err = leader.CreateTopic(context.Background(), &proto.CreateTopicRequest{
+		Name:       "replication",
+		Partitions: 1,
+	})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+	_, err = leader.CreateTopic(context.Background(), &proto.CreateTopicRequest{
+		Name:       "orders",
+		Partitions: 2,
+	})
+	assert.NoError(t, err)
+	//placed by key when the append leaves the partition to the agent
+	order := &proto.Record{Key: []byte("customer-1"), Value: []byte("order")}
+	appendResponse, err = leader.Append(context.Background(), &proto.AppendRequest{
+		Record: order,
+		Topic:  "orders",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), appendResponse.Offset)
+	assert.Equal(
+		t,
+		(&logclient.HashPartitioner{}).Partition(order, 2),
+		appendResponse.Partition,
+	)
+	readResponse, err = leader.Read(context.Background(), &proto.ReadRequest{
+		Topic:     "orders",
+		Partition: appendResponse.Partition,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("order"), readResponse.Record.Value)
+	assert.Equal(t, total, length(agents[0]))
+
+	//A balanced client finds a topic on the one agent it sends them all to
+	balanced := balancedClient(t, agents[2], peerTLSConfig)
+	assert.Eventually(t, func() bool {
+		_, err = balanced.CreateTopic(context.Background(), &proto.CreateTopicRequest{
+			Name:       "payments",
+			Partitions: 1,
+		})
+		return err == nil
+	}, 5*time.Second, 100*time.Millisecond)
+	partition := uint32(0)
+	for i := 0; i < 2*len(agents); i++ {
+		_, err = balanced.DescribeTopic(context.Background(), &proto.DescribeTopicRequest{
+			Name: "payments",
+		})
+		assert.NoError(t, err)
+		appendResponse, err = balanced.Append(context.Background(), &proto.AppendRequest{
+			Record:    &proto.Record{Value: []byte("payment")},
+			Topic:     "payments",
+			Partition: &partition,
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(i), appendResponse.Offset)
+		readResponse, err = balanced.Read(context.Background(), &proto.ReadRequest{
+			Topic:  "payments",
+			Offset: uint64(i),
+		})
+		assert.NoError(t, err)
+	}
+}
+
+func TestAgentRestart(t *testing.T) {
+	//The leader can't read from its follower, so records only flow one way
+	nobodyTLSConfig, err := config.SetupFromTLSConfig(
+		config.TLSConfig{
+			CertFile:      config.NobodyClientCertFile,
+			KeyFile:       config.NobodyClientKeyFile,
+			CAFile:        config.CAFile,
+			Server:        false,
+			ServerAddress: "127.0.0.1",
+		},
+	)
+	assert.NoError(t, err)
+
+	agents, rootTLSConfig := setupAgents(t, 2, func(i int, c *Config) {
+		if i == 0 {
+			c.PeerTLSConfig = nobodyTLSConfig
+		}
+	})
+	leader, follower := agents[0], agents[1]
+
+	leaderClient := client(t, leader, rootTLSConfig)
+	produce := func(value string) {
+		_, err := leaderClient.Append(
+			context.Background(),
+			&proto.AppendRequest{
+				Record: &proto.Record{Value: []byte(value)},
+			},
+		)
+		assert.NoError(t, err)
+	}
+	//replicated waits until the follower holds exactly want
+	replicated := func(follower *Agent, want []string) {
+		followerClient := client(t, follower, rootTLSConfig)
+		assert.Eventually(t, func() bool {
+			for off, value := range want {
+				res, err := followerClient.Read(
+					context.Background(),
+					&proto.ReadRequest{Offset: uint64(off)},
+				)
+				if err != nil || string(res.Record.Value) != value {
+					return false
+				}
+			}
+			return true
+		}, 5*time.Second, 100*time.Millisecond)
+		//Nothing was copied twice
+		_, err := followerClient.Read(
+			context.Background(),
+			&proto.ReadRequest{Offset: uint64(len(want))},
+		)
+		assert.Error(t, err)
+	}
+
+	produce("uno")
+	produce("dos")
+	replicated(follower, []string{"uno", "dos"})
+
+	//A consumer group reading the follower commits how far it got
+	ctx := context.Background()
+	consumer := client(t, follower, rootTLSConfig)
+	joined, err := consumer.JoinGroup(ctx, &proto.JoinGroupRequest{
+		Group:  "readers",
+		Topics: []string{""},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(joined.Assignment.Partitions))
+	_, err = consumer.CommitOffset(ctx, &proto.CommitOffsetRequest{
+		Group:      "readers",
+		Offset:     2,
+		Member:     joined.Assignment.Member,
+		Generation: joined.Assignment.Generation,
+	})
+	assert.NoError(t, err)
+
+	//A transaction left open on a topic of the follower
+	_, err = consumer.CreateTopic(ctx, &proto.CreateTopicRequest{
+		Name:       "orders",
+		Partitions: 1,
+	})
+	assert.NoError(t, err)
+	begun, err := consumer.BeginTransaction(ctx, &proto.BeginTransactionRequest{})
+	assert.NoError(t, err)
+	partition := uint32(0)
+	_, err = consumer.Append(ctx, &proto.AppendRequest{
+		Record:        &proto.Record{Value: []byte("order")},
+		Topic:         "orders",
+		Partition:     &partition,
+		TransactionId: begun.TransactionId,
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, follower.Shutdown())
+	follower, err = New(follower.Config)
+	assert.NoError(t, err)
+	defer follower.Shutdown()
+
+	//and resumes from there after the restart, joining the group again
+	consumer = client(t, follower, rootTLSConfig)
+	_, err = consumer.Heartbeat(ctx, &proto.HeartbeatRequest{
+		Group:  "readers",
+		Member: joined.Assignment.Member,
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	committed, err := consumer.FetchCommittedOffset(
+		ctx,
+		&proto.FetchCommittedOffsetRequest{Group: "readers"},
+	)
+	assert.NoError(t, err)
+	assert.True(t, committed.Found)
+	assert.Equal(t, uint64(2), committed.Offset)
+
+	//is taken back on restarting, for its producer to commit
+	orders := &proto.ReadRangeRequest{
+		Topic:     "orders",
+		Isolation: proto.Isolation_READ_COMMITTED,
+	}
+	page, err := consumer.ReadRange(ctx, orders)
+	assert.NoError(t, err)
+	assert.Empty(t, page.Records)
+	_, err = consumer.CommitTransaction(ctx, &proto.CommitTransactionRequest{
+		TransactionId: begun.TransactionId,
+	})
+	assert.NoError(t, err)
+	page, err = consumer.ReadRange(ctx, orders)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(page.Records))
+
+	produce("tres")
+	replicated(follower, []string{"uno", "dos", "tres"})
+	//Give a re-copy from offset 0 time to show up
+	time.Sleep(time.Second)
+	replicated(follower, []string{"uno", "dos", "tres"})
+}
+
+func TestAgentRaftFailover(t *testing.T) {
+	agents, peerTLSConfig := setupAgents(t, 3, func(i int, c *Config) {
+		c.Raft = true
+		c.Bootstrap = i == 0
+	})
+	time.Sleep(3 * time.Second)
+
+	produce := func(agent *Agent, value string) (uint64, error) {
+		res, err := client(t, agent, peerTLSConfig).Append(
+			context.Background(),
+			&proto.AppendRequest{
+				Record: &proto.Record{Value: []byte(value)},
+			},
+		)
+		if err != nil {
+			return 0, err
+		}
+		return res.Offset, nil
+	}
+	//replicated waits until every agent serves value at off
+	replicated := func(agents []*Agent, off uint64, value string) {
+		for _, agent := range agents {
+			c := client(t, agent, peerTLSConfig)
+			assert.Eventually(t, func() bool {
+				res, err := c.Read(
+					context.Background(),
+					&proto.ReadRequest{Offset: off},
+				)
+				return err == nil && string(res.Record.Value) == value
+			}, 5*time.Second, 100*time.Millisecond)
+		}
+	}
+
+	off, err := produce(agents[0], "uno")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), off)
+	replicated(agents, off, "uno")
+
+	//Every agent knows the leader
+	for _, agent := range agents {
+		res, err := client(t, agent, peerTLSConfig).GetServers(
+			context.Background(),
+			&proto.GetServersRequest{},
+		)
+		assert.NoError(t, err)
+		assert.Equal(t, len(agents), len(res.Servers))
+		roles := map[string]proto.Server_Role{}
+		for _, server := range res.Servers {
+			roles[server.Id] = server.Role
+		}
+		assert.Equal(t, map[string]proto.Server_Role{
+			"0": proto.Server_LEADER,
+			"1": proto.Server_FOLLOWER,
+			"2": proto.Server_FOLLOWER,
+		}, roles)
+	}
+
+	//A balanced client reads from followers and finds the leader itself
+	balanced := balancedClient(t, agents[0], peerTLSConfig)
+	assert.Eventually(t, func() bool {
+		res, err := balanced.Read(
+			context.Background(),
+			&proto.ReadRequest{Offset: 0},
+		)
+		return err == nil && string(res.Record.Value) == "uno"
+	}, 5*time.Second, 100*time.Millisecond)
+
+	//Followers can't take appends
+	_, err = produce(agents[1], "dos")
+	assert.Error(t, err)
+
+	//Raft doesn't replicate topics, so there are none
+	_, err = balanced.CreateTopic(context.Background(), &proto.CreateTopicRequest{
+		Name:       "orders",
+		Partitions: 1,
+	})
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+
+	//A transaction the leader began is left open
+	begun, err := client(t, agents[0], peerTLSConfig).BeginTransaction(
+		context.Background(),
+		&proto.BeginTransactionRequest{},
+	)
+	assert.NoError(t, err)
+	res, err := client(t, agents[0], peerTLSConfig).Append(
+		context.Background(),
+		&proto.AppendRequest{
+			Record:        &proto.Record{Value: []byte("open")},
+			TransactionId: begun.TransactionId,
+		},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), res.Offset)
+
+	//Offsets groups commit are replicated with the log
+	_, err = balanced.CommitOffset(context.Background(), &proto.CommitOffsetRequest{
+		Group:  "readers",
+		Offset: 1,
+	})
+	assert.NoError(t, err)
+
+	//Losing the leader elects one of the others, which keeps the log
+	assert.NoError(t, agents[0].Shutdown())
+	remaining := agents[1:]
+	assert.Eventually(t, func() bool {
+		for _, agent := range remaining {
+			if off, err = produce(agent, "dos"); err == nil {
+				return true
+			}
+		}
+		return false
+	}, 10*time.Second, 250*time.Millisecond)
+	assert.Equal(t, uint64(2), off)
+	replicated(remaining, 0, "uno")
+	replicated(remaining, 2, "dos")
+
+	//and follows the new leader, though the agent it was dialed with is gone
+	assert.Eventually(t, func() bool {
+		res, err := balanced.Append(
+			context.Background(),
+			&proto.AppendRequest{
+				Record: &proto.Record{Value: []byte("tres")},
+			},
+		)
+		if err == nil {
+			off = res.Offset
+		}
+		return err == nil
+	}, 10*time.Second, 250*time.Millisecond)
+	assert.Equal(t, uint64(3), off)
+	replicated(remaining, 3, "tres")
+
+	//and takes over the transaction, for its producer to commit
+	assert.Eventually(t, func() bool {
+		_, err := balanced.CommitTransaction(
+			context.Background(),
+			&proto.CommitTransactionRequest{TransactionId: begun.TransactionId},
+		)
+		return err == nil
+	}, 10*time.Second, 250*time.Millisecond)
+	replicated(remaining, 1, "open")
+
+	//and the offsets, for consumers to resume from
+	committed, err := balanced.FetchCommittedOffset(
+		context.Background(),
+		&proto.FetchCommittedOffsetRequest{Group: "readers"},
+	)
+	assert.NoError(t, err)
+	assert.True(t, committed.Found)
+	assert.Equal(t, uint64(1), committed.Offset)
+
+	//acks=all waits on each voter, and one of the two others is gone
+	for replicas, ok := range map[uint32]bool{1: true, 2: false} {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, err = balanced.Append(ctx, &proto.AppendRequest{
+			Record:   &proto.Record{Value: []byte("acked")},
+			Acks:     proto.AppendRequest_ALL,
+			Replicas: replicas,
+		})
+		cancel()
+		assert.Equal(t, ok, err == nil)
+	}
+}
+
+/*
+setupAgents starts n agents, each joining the first, on fresh ports and
+data directories. configure adjusts the config of the i-th agent before it
+starts. The agents are shut down and their data removed when the test
+ends. It returns them with the root client's TLS config.
+*/
+func setupAgents(
+	t *testing.T,
+	n int,
+	configure func(i int, c *Config),
+) ([]*Agent, *tls.Config) {
 	serverTLSConfig, err := config.SetupFromTLSConfig(
 		config.TLSConfig{
 			CertFile:      config.ServerCertFile,
@@ -41,81 +547,55 @@ func TestAgent(t *testing.T) {
 	assert.NoError(t, err)
 
 	var agents []*Agent
-	for i := 0; i < 3; i++ {
+	t.Cleanup(func() {
+		for _, agent := range agents {
+			assert.NoError(t, agent.Shutdown())
+			assert.NoError(t, os.RemoveAll(agent.Config.DataDir))
+		}
+	})
+	for i := 0; i < n; i++ {
 		ports := portutil.Get(2)
-		bindAddr := fmt.Sprintf("%s:%d", "127.0.01", ports[0])
-		rpcPort := ports[1]
-
 		dataDir, err := ioutil.TempDir("", "agent-test-log")
 		assert.NoError(t, err)
 
 		var startJoinAddrs []string
 		if i != 0 {
-			startJoinAddrs = append(
-				startJoinAddrs,
-				agents[0].Config.BindAddr,
-			)
+			startJoinAddrs = append(startJoinAddrs, agents[0].Config.BindAddr)
 		}
-
-		agent, err := New(
-			Config{
-				NodeName:        fmt.Sprintf("%d", i),
-				StartJoinAddrs:  startJoinAddrs,
-				BindAddr:        bindAddr,
-				RPCPort:         rpcPort,
-				DataDir:         dataDir,
-				ACLModelFile:    config.ACLModelFile,
-				ACLPolicyFile:   config.ACLPolicyFile,
-				ServerTLSConfig: serverTLSConfig,
-				PeerTLSConfig:   peerTLSConfig,
-			},
-		)
+		c := Config{
+			NodeName:        fmt.Sprintf("%d", i),
+			StartJoinAddrs:  startJoinAddrs,
+			BindAddr:        fmt.Sprintf("%s:%d", "127.0.0.1", ports[0]),
+			RPCPort:         ports[1],
+			DataDir:         dataDir,
+			ACLModelFile:    config.ACLModelFile,
+			ACLPolicyFile:   config.ACLPolicyFile,
+			ServerTLSConfig: serverTLSConfig,
+			PeerTLSConfig:   peerTLSConfig,
+		}
+		configure(i, &c)
+		agent, err := New(c)
 		assert.NoError(t, err)
 		agents = append(agents, agent)
 	}
-	defer func() {
-		for _, agent := range agents {
-			err := agent.Shutdown()
-			assert.NoError(t, err)
-			assert.NoError(
-				t,
-				os.RemoveAll(agent.Config.DataDir),
-			)
-		}
-	}()
-	time.Sleep(3 * time.Second)
-
-	leader := client(t, agents[0], peerTLSConfig)
-	appendResponse, err := leader.Append(
-		context.Background(),
-		&proto.AppendRequest{
-			Record: &proto.Record{
-				Value: []byte("record"),
-			},
-		},
-	)
-	assert.NoError(t, err)
+	return agents, peerTLSConfig
+}
 
-	readResponse, err := leader.Read(
-		context.Background(),
-		&proto.ReadRequest{
-			Offset: appendResponse.Offset,
-		},
-	)
+//balancedClient dials the cluster through agent with the logstore resolver
+func balancedClient(
+	t *testing.T,
+	agent *Agent,
+	tlsConfig *tls.Config,
+) proto.LogClient {
+	rpcAddr, err := agent.Config.RPCAddr()
 	assert.NoError(t, err)
-	assert.Equal(t, readResponse.Record.Value, []byte("record"))
-
-	time.Sleep(3 * time.Second)
-
-	follower := client(t, agents[1], peerTLSConfig)
-	readResponse, err = follower.Read(
-		context.Background(),
-		&proto.ReadRequest{
-			Offset: appendResponse.Offset,
-		},
+	conn, err := grpc.Dial(
+		fmt.Sprintf("%s:///%s", loadbalance.Name, rpcAddr),
+		grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+		grpc.WithUnaryInterceptor(loadbalance.UnaryInterceptor),
 	)
 	assert.NoError(t, err)
-	assert.Equal(t, readResponse.Record.Value, []byte("record"))
+	return proto.NewLogClient(conn)
 }
 
 func client(
@@ -0,0 +1,143 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"logstore/internal/config"
+	"logstore/internal/loadbalance"
+	"logstore/internal/log/proto"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+var errConsumerClosed = errors.New("client: consumer closed")
+
+//ConsumerConfig configures a Consumer
+type ConsumerConfig struct {
+	//Addr is the server's RPC address
+	Addr string
+	//TLSConfig secures the connection, left insecure when unset
+	TLSConfig *config.TLSConfig
+	//Topic and Partition are read, the default topic when Topic is empty
+	Topic     string
+	Partition uint32
+	//Offset is the first offset read
+	Offset uint64
+	//Isolation decides whether records of open and aborted transactions are read
+	Isolation proto.Isolation
+	//Backoff is the wait before the first reconnect, doubling for each after, 100ms by default
+	Backoff time.Duration
+}
+
+/*
+Consumer iterates over a partition's records in order, from Offset on,
+waiting for new ones as they're appended. A stream that breaks because
+its server went away is reopened after a backoff from just past the
+last record read, so none are skipped or read twice.
+*/
+type Consumer struct {
+	ConsumerConfig
+	conn   *grpc.ClientConn
+	client proto.LogClient
+	next   uint64 //just past the last record Next returned
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	records chan *proto.Record
+	err     error //why reading stopped, set before records is closed
+}
+
+//NewConsumer connects to the server and starts reading
+func NewConsumer(c ConsumerConfig) (*Consumer, error) {
+	if c.Backoff == 0 {
+		c.Backoff = defaultBackoff
+	}
+	conn, err := dial(c.Addr, c.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	consumer := &Consumer{
+		ConsumerConfig: c,
+		conn:           conn,
+		client:         proto.NewLogClient(conn),
+		next:           c.Offset,
+		ctx:            ctx,
+		cancel:         cancel,
+		records:        make(chan *proto.Record),
+	}
+	go consumer.read()
+	return consumer, nil
+}
+
+/*
+Next blocks until the next record is read and returns it, or until ctx
+is done or reading stopped for good, as when the consumer is closed or
+its topic deleted.
+*/
+func (c *Consumer) Next(ctx context.Context) (*proto.Record, error) {
+	select {
+	case record, ok := <-c.records:
+		if !ok {
+			return nil, c.err
+		}
+		c.next = record.Offset + 1
+		return record, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+//Position returns the offset Next reads from: just past the last record it returned
+func (c *Consumer) Position() uint64 {
+	return c.next
+}
+
+//Close stops reading and disconnects
+func (c *Consumer) Close() error {
+	c.cancel()
+	return c.conn.Close()
+}
+
+//read streams records to Next, reopening the stream whenever it breaks
+func (c *Consumer) read() {
+	defer close(c.records)
+	off := c.Offset
+	wait := c.Backoff
+	for {
+		ctx := loadbalance.WithTopic(c.ctx, c.Topic)
+		stream, err := c.client.ReadStream(ctx, &proto.ReadRequest{
+			Topic:     c.Topic,
+			Partition: c.Partition,
+			Offset:    off,
+			Isolation: c.Isolation,
+		})
+		for err == nil {
+			var res *proto.ReadResponse
+			if res, err = stream.Recv(); err != nil {
+				break
+			}
+			off, wait = res.Record.Offset+1, c.Backoff
+			select {
+			case c.records <- res.Record:
+			case <-c.ctx.Done():
+			}
+		}
+		if c.ctx.Err() != nil {
+			c.err = errConsumerClosed
+			return
+		}
+		//A server shutting down may end the stream rather than break it
+		if err != io.EOF && !retryable(err) {
+			c.err = err
+			return
+		}
+		select {
+		case <-time.After(wait):
+		case <-c.ctx.Done():
+		}
+		wait = backoff(wait)
+	}
+}
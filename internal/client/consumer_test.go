@@ -0,0 +1,81 @@
+package client_test
+
+import (
+	"context"
+	"fmt"
+	"logstore/internal/agent"
+	"logstore/internal/client"
+	"logstore/internal/log/proto"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsumer(t *testing.T) {
+	a, c, teardown := setupAgent(t)
+	defer teardown()
+	addr, err := c.RPCAddr()
+	assert.NoError(t, err)
+	logs := logClient(t, c)
+	produce := func(values ...string) {
+		for _, value := range values {
+			_, err := logs.Append(context.Background(), &proto.AppendRequest{
+				Record: &proto.Record{Value: []byte(value)},
+			})
+			assert.NoError(t, err)
+		}
+	}
+	produce("uno", "dos", "tres")
+
+	consumer, err := client.NewConsumer(client.ConsumerConfig{
+		Addr:      addr,
+		TLSConfig: rootTLSConfig,
+		Offset:    1,
+	})
+	assert.NoError(t, err)
+	consume := func(want ...string) {
+		for _, value := range want {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			record, err := consumer.Next(ctx)
+			cancel()
+			assert.NoError(t, err)
+			if record != nil {
+				assert.Equal(t, value, string(record.Value))
+			}
+		}
+	}
+	consume("dos", "tres")
+	assert.Equal(t, uint64(3), consumer.Position())
+
+	//Caught up, Next waits for the next record
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = consumer.Next(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	//The stream breaks with the agent and is reopened where it left off
+	assert.NoError(t, a.Shutdown())
+	a, err = agent.New(c)
+	assert.NoError(t, err)
+	defer a.Shutdown()
+	logs = logClient(t, c)
+	produce("cuatro", "cinco")
+	consume("cuatro", "cinco")
+	assert.Equal(t, uint64(5), consumer.Position())
+
+	assert.NoError(t, consumer.Close())
+	_, err = consumer.Next(context.Background())
+	assert.Error(t, err)
+
+	//Reading what can't be read stops the consumer
+	consumer, err = client.NewConsumer(client.ConsumerConfig{
+		Addr:      addr,
+		TLSConfig: rootTLSConfig,
+		Topic:     "clicks",
+	})
+	assert.NoError(t, err)
+	defer consumer.Close()
+	_, err = consumer.Next(context.Background())
+	assert.Equal(t, fmt.Sprint(proto.ErrTopicNotFound{Topic: "clicks"}), fmt.Sprint(err))
+}
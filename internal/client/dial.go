@@ -0,0 +1,55 @@
+package client
+
+import (
+	"logstore/internal/config"
+	"logstore/internal/loadbalance"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+//Waits between retries and reconnects, doubling each time up to maxBackoff
+const (
+	defaultBackoff = 100 * time.Millisecond
+	maxBackoff     = 5 * time.Second
+)
+
+/*
+dial connects to addr, over TLS when tlsConfig is set. Servers in Raft
+mode only take writes on their leader, and only one server has topics,
+so dial "logstore:///<addr>" to have RPCs routed there.
+*/
+func dial(addr string, tlsConfig *config.TLSConfig) (*grpc.ClientConn, error) {
+	creds := grpc.WithInsecure()
+	if tlsConfig != nil {
+		c, err := config.SetupFromTLSConfig(*tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		creds = grpc.WithTransportCredentials(credentials.NewTLS(c))
+	}
+	return grpc.Dial(
+		addr,
+		creds,
+		grpc.WithUnaryInterceptor(loadbalance.UnaryInterceptor),
+	)
+}
+
+/*
+retryable reports whether an RPC failed only because its server couldn't
+be reached or couldn't serve it for now, as a follower can't take writes
+*/
+func retryable(err error) bool {
+	return status.Code(err) == codes.Unavailable
+}
+
+//backoff returns the wait after wait, doubled up to maxBackoff
+func backoff(wait time.Duration) time.Duration {
+	if wait *= 2; wait > maxBackoff {
+		return maxBackoff
+	}
+	return wait
+}
@@ -0,0 +1,99 @@
+/*
+Package client helps programs produce to and consume from logstore
+servers.
+*/
+package client
+
+import (
+	"hash/fnv"
+	"logstore/internal/log/proto"
+	"sync/atomic"
+)
+
+/*
+Partitioner picks which of a topic's partitions a record is appended
+to. Records with the same key should always land in the same partition,
+so their order is kept.
+*/
+type Partitioner interface {
+	Partition(record *proto.Record, partitions uint32) uint32
+}
+
+/*
+HashPartitioner places keyed records by a hash of their key, the same
+for every client and across restarts as long as the partition count is
+unchanged. Keyless records are spread round-robin.
+*/
+type HashPartitioner struct {
+	Hash func(key []byte) uint32 //Murmur2 when unset
+
+	keyless RoundRobinPartitioner
+}
+
+func (p *HashPartitioner) Partition(record *proto.Record, partitions uint32) uint32 {
+	key := record.GetKey()
+	if len(key) == 0 {
+		return p.keyless.Partition(record, partitions)
+	}
+	hash := p.Hash
+	if hash == nil {
+		hash = Murmur2
+	}
+	//Drop the sign bit, like Kafka, so keys map to the same partitions it picks
+	return (hash(key) & 0x7fffffff) % partitions
+}
+
+//RoundRobinPartitioner ignores keys and takes each partition in turn
+type RoundRobinPartitioner struct {
+	next uint32
+}
+
+func (p *RoundRobinPartitioner) Partition(_ *proto.Record, partitions uint32) uint32 {
+	return (atomic.AddUint32(&p.next, 1) - 1) % partitions
+}
+
+/*
+Murmur2 is the 32 bit MurmurHash2 with Kafka's seed, as its producers
+hash keys.
+*/
+func Murmur2(data []byte) uint32 {
+	const (
+		seed = 0x9747b28c
+		m    = 0x5bd1e995
+		r    = 24
+	)
+	length := len(data)
+	h := uint32(seed) ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := uint32(data[i]) | uint32(data[i+1])<<8 |
+			uint32(data[i+2])<<16 | uint32(data[i+3])<<24
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	tail := data[length&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return h
+}
+
+//FNV1a is the 32 bit FNV-1a hash, an alternative Hash for HashPartitioner
+func FNV1a(data []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(data)
+	return h.Sum32()
+}
@@ -0,0 +1,60 @@
+package client
+
+import (
+	"fmt"
+	"logstore/internal/log/proto"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMurmur2(t *testing.T) {
+	//Kafka's own test vectors, as signed 32 bit ints
+	for key, expected := range map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	} {
+		assert.Equal(t, expected, int32(Murmur2([]byte(key))), key)
+	}
+}
+
+func TestHashPartitioner(t *testing.T) {
+	const partitions = 7
+	records := make([]*proto.Record, 100)
+	for i := range records {
+		records[i] = &proto.Record{Key: []byte(fmt.Sprintf("key-%d", i))}
+	}
+
+	//A restarted client, or any other, puts each key where the first did
+	for _, hash := range []func([]byte) uint32{nil, FNV1a} {
+		first, restarted := &HashPartitioner{Hash: hash}, &HashPartitioner{Hash: hash}
+		used := make(map[uint32]bool)
+		for _, record := range records {
+			p := first.Partition(record, partitions)
+			assert.True(t, p < partitions)
+			assert.Equal(t, p, first.Partition(record, partitions))
+			assert.Equal(t, p, restarted.Partition(record, partitions))
+			used[p] = true
+		}
+		assert.Equal(t, partitions, len(used))
+	}
+
+	//and the mapping is pinned, changing it moves every producer's keys
+	p := &HashPartitioner{}
+	for key, expected := range map[string]uint32{
+		"21":     3,
+		"foobar": 0,
+		"abc":    4,
+	} {
+		assert.Equal(t, expected, p.Partition(&proto.Record{Key: []byte(key)}, partitions))
+	}
+
+	//Keyless records take each partition in turn
+	for i := uint32(0); i < 2*partitions; i++ {
+		assert.Equal(t, i%partitions, p.Partition(&proto.Record{}, partitions))
+	}
+}
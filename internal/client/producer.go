@@ -0,0 +1,286 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"logstore/internal/config"
+	"logstore/internal/log/proto"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+var errProducerClosed = errors.New("client: producer closed")
+
+//Batching and retry defaults used when a ProducerConfig leaves them unset
+const (
+	defaultLinger     = 5 * time.Millisecond
+	defaultBatchSize  = 100
+	defaultMaxRetries = 5
+)
+
+//ProducerConfig configures a Producer
+type ProducerConfig struct {
+	//Addr is the server's RPC address
+	Addr string
+	//TLSConfig secures the connection, left insecure when unset
+	TLSConfig *config.TLSConfig
+	//Topic is produced to, the default topic when empty
+	Topic string
+	//Partitioner places records in the topic's partitions, HashPartitioner when unset
+	Partitioner Partitioner
+	//Linger is how long a record waits for its batch to fill, 5ms by default
+	Linger time.Duration
+	//BatchSize is the most records sent together, 100 by default
+	BatchSize int
+	//MaxRetries is how often a batch is resent, 5 by default and none when negative
+	MaxRetries int
+	//Backoff is the wait before the first retry, doubling for each after, 100ms by default
+	Backoff time.Duration
+}
+
+/*
+Producer appends records to a topic asynchronously. Records are
+gathered per partition into batches, sent once one holds BatchSize
+records or its first has waited Linger, one batch at a time so each
+partition keeps the order records were sent in. A batch whose server
+is unavailable is resent after a backoff, so a record may be appended
+more than once if its server failed after appending it.
+*/
+type Producer struct {
+	ProducerConfig
+	conn       *grpc.ClientConn
+	client     proto.LogClient
+	partitions uint32
+
+	mu      sync.RWMutex //held to Send, and to close records
+	closed  bool
+	records chan *pending
+	batches chan *batch
+	done    chan struct{} //closed once every batch is sent
+}
+
+//pending is a record sent and the future of its offset, or with flushed set a Flush
+type pending struct {
+	record  *proto.Record
+	future  *Future
+	flushed chan struct{}
+}
+
+/*
+batch is records bound for one partition, or with flushed set, where
+every record sent before a Flush has been
+*/
+type batch struct {
+	partition uint32
+	records   []*proto.Record
+	futures   []*Future
+	flushed   chan struct{}
+}
+
+//NewProducer connects to the server and learns how many partitions the topic has
+func NewProducer(c ProducerConfig) (*Producer, error) {
+	if c.Partitioner == nil {
+		c.Partitioner = &HashPartitioner{}
+	}
+	if c.Linger == 0 {
+		c.Linger = defaultLinger
+	}
+	if c.BatchSize == 0 {
+		c.BatchSize = defaultBatchSize
+	}
+	if c.MaxRetries == 0 {
+		c.MaxRetries = defaultMaxRetries
+	}
+	if c.Backoff == 0 {
+		c.Backoff = defaultBackoff
+	}
+	conn, err := dial(c.Addr, c.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	p := &Producer{
+		ProducerConfig: c,
+		conn:           conn,
+		client:         proto.NewLogClient(conn),
+		partitions:     1,
+		records:        make(chan *pending, c.BatchSize),
+		batches:        make(chan *batch, 16),
+		done:           make(chan struct{}),
+	}
+	if c.Topic != "" {
+		res, err := p.client.DescribeTopic(
+			context.Background(),
+			&proto.DescribeTopicRequest{Name: c.Topic},
+		)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		p.partitions = res.Topic.Partitions
+	}
+	go p.gather()
+	go p.send()
+	return p, nil
+}
+
+//Send queues record to be appended, returning the future of its offset
+func (p *Producer) Send(record *proto.Record) *Future {
+	f := &Future{done: make(chan struct{})}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		f.resolve(0, errProducerClosed)
+		return f
+	}
+	p.records <- &pending{record: record, future: f}
+	return f
+}
+
+//Flush sends the records waiting in batches and blocks until every record sent before is
+func (p *Producer) Flush() error {
+	flushed := make(chan struct{})
+	p.mu.RLock()
+	if p.closed {
+		p.mu.RUnlock()
+		return errProducerClosed
+	}
+	p.records <- &pending{flushed: flushed}
+	p.mu.RUnlock()
+	<-flushed
+	return nil
+}
+
+//Close sends the records waiting in batches, then disconnects
+func (p *Producer) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.records)
+	p.mu.Unlock()
+	<-p.done
+	return p.conn.Close()
+}
+
+//gather batches records as they're sent, handing full and lingering batches to send
+func (p *Producer) gather() {
+	defer close(p.batches)
+	open := make(map[uint32]*batch)
+	var linger *time.Timer
+	var lingered <-chan time.Time
+	flush := func() {
+		for partition, b := range open {
+			p.batches <- b
+			delete(open, partition)
+		}
+		if linger != nil {
+			linger.Stop()
+			lingered = nil
+		}
+	}
+	for {
+		select {
+		case r, ok := <-p.records:
+			if !ok {
+				flush()
+				return
+			}
+			if r.flushed != nil {
+				flush()
+				p.batches <- &batch{flushed: r.flushed}
+				continue
+			}
+			partition := uint32(0)
+			if p.Topic != "" {
+				partition = p.Partitioner.Partition(r.record, p.partitions)
+			}
+			b, ok := open[partition]
+			if !ok {
+				b = &batch{partition: partition}
+				open[partition] = b
+			}
+			b.records = append(b.records, r.record)
+			b.futures = append(b.futures, r.future)
+			if len(b.records) >= p.BatchSize {
+				p.batches <- b
+				delete(open, partition)
+			}
+			if lingered == nil && len(open) > 0 {
+				linger = time.NewTimer(p.Linger)
+				lingered = linger.C
+			}
+		case <-lingered:
+			lingered = nil
+			flush()
+		}
+	}
+}
+
+//send produces each batch in turn and resolves its records' futures
+func (p *Producer) send() {
+	defer close(p.done)
+	for b := range p.batches {
+		if b.flushed != nil {
+			close(b.flushed)
+			continue
+		}
+		base, err := p.produce(b)
+		for i, f := range b.futures {
+			if err != nil {
+				f.resolve(0, err)
+			} else {
+				f.resolve(base+uint64(i), nil)
+			}
+		}
+	}
+}
+
+//produce appends a batch, retrying while its server is unavailable
+func (p *Producer) produce(b *batch) (uint64, error) {
+	wait := p.Backoff
+	for retries := 0; ; retries++ {
+		res, err := p.client.ProduceBatch(
+			context.Background(),
+			&proto.ProduceBatchRequest{
+				Records:   b.records,
+				Topic:     p.Topic,
+				Partition: b.partition,
+			},
+		)
+		if err == nil {
+			return res.BaseOffset, nil
+		}
+		if !retryable(err) || retries >= p.MaxRetries {
+			return 0, err
+		}
+		time.Sleep(wait)
+		wait = backoff(wait)
+	}
+}
+
+//Future is the offset a record sent by a Producer is appended at, once it is
+type Future struct {
+	done   chan struct{}
+	offset uint64
+	err    error
+}
+
+//Done is closed once the record is appended or failed to be
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+//Offset blocks until the record is appended, returning its offset, or fails to be
+func (f *Future) Offset() (uint64, error) {
+	<-f.done
+	return f.offset, f.err
+}
+
+func (f *Future) resolve(offset uint64, err error) {
+	f.offset, f.err = offset, err
+	close(f.done)
+}
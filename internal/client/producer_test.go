@@ -0,0 +1,185 @@
+package client_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"logstore/internal/agent"
+	"logstore/internal/client"
+	"logstore/internal/config"
+	"logstore/internal/log/proto"
+	"logstore/internal/portutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+//rootTLSConfig is what clients of the test agents connect with
+var rootTLSConfig = &config.TLSConfig{
+	CertFile:      config.RootClientCertFile,
+	KeyFile:       config.RootClientKeyFile,
+	CAFile:        config.CAFile,
+	ServerAddress: "127.0.0.1",
+}
+
+//setupAgent configures and starts an agent of its own, returning its config to restart it with
+func setupAgent(t *testing.T) (*agent.Agent, agent.Config, func()) {
+	t.Helper()
+	serverTLSConfig, err := config.SetupFromTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		Server:        true,
+		ServerAddress: "127.0.0.1",
+	})
+	assert.NoError(t, err)
+	peerTLSConfig, err := config.SetupFromTLSConfig(*rootTLSConfig)
+	assert.NoError(t, err)
+	dataDir, err := ioutil.TempDir("", "client-test")
+	assert.NoError(t, err)
+	ports := portutil.Get(2)
+	c := agent.Config{
+		NodeName:        "0",
+		BindAddr:        fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		RPCPort:         ports[1],
+		DataDir:         dataDir,
+		ACLModelFile:    config.ACLModelFile,
+		ACLPolicyFile:   config.ACLPolicyFile,
+		ServerTLSConfig: serverTLSConfig,
+		PeerTLSConfig:   peerTLSConfig,
+	}
+	a, err := agent.New(c)
+	assert.NoError(t, err)
+	return a, c, func() {
+		os.RemoveAll(dataDir)
+	}
+}
+
+//logClient dials the agent with the generated client, to set up and check on it
+func logClient(t *testing.T, c agent.Config) proto.LogClient {
+	t.Helper()
+	tlsConfig, err := config.SetupFromTLSConfig(*rootTLSConfig)
+	assert.NoError(t, err)
+	addr, err := c.RPCAddr()
+	assert.NoError(t, err)
+	conn, err := grpc.Dial(
+		addr,
+		grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+	)
+	assert.NoError(t, err)
+	return proto.NewLogClient(conn)
+}
+
+func TestProducer(t *testing.T) {
+	a, c, teardown := setupAgent(t)
+	defer teardown()
+	defer a.Shutdown()
+	addr, err := c.RPCAddr()
+	assert.NoError(t, err)
+
+	producer, err := client.NewProducer(client.ProducerConfig{
+		Addr:      addr,
+		TLSConfig: rootTLSConfig,
+		BatchSize: 100,
+	})
+	assert.NoError(t, err)
+
+	//Records are appended in the order sent, some in full batches, the rest lingering
+	var futures []*client.Future
+	for i := 0; i < 250; i++ {
+		futures = append(futures, producer.Send(&proto.Record{
+			Value: []byte(fmt.Sprintf("record %d", i)),
+		}))
+	}
+	for i, f := range futures {
+		off, err := f.Offset()
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(i), off)
+	}
+	assert.NoError(t, producer.Flush())
+	assert.NoError(t, producer.Close())
+	_, err = producer.Send(&proto.Record{}).Offset()
+	assert.Error(t, err)
+
+	//Keyed records sent to a topic stay together in their partition
+	logs := logClient(t, c)
+	ctx := context.Background()
+	_, err = logs.CreateTopic(ctx, &proto.CreateTopicRequest{
+		Name:       "orders",
+		Partitions: 3,
+	})
+	assert.NoError(t, err)
+	producer, err = client.NewProducer(client.ProducerConfig{
+		Addr:      addr,
+		TLSConfig: rootTLSConfig,
+		Topic:     "orders",
+		Linger:    time.Hour,
+	})
+	assert.NoError(t, err)
+	var keyed []*client.Future
+	for i := 0; i < 6; i++ {
+		keyed = append(keyed, producer.Send(&proto.Record{
+			Key:   []byte("customer"),
+			Value: []byte(fmt.Sprintf("order %d", i)),
+		}))
+	}
+	assert.NoError(t, producer.Flush())
+	partition := (&client.HashPartitioner{}).Partition(
+		&proto.Record{Key: []byte("customer")},
+		3,
+	)
+	for i, f := range keyed {
+		off, err := f.Offset()
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(i), off)
+		read, err := logs.Read(ctx, &proto.ReadRequest{
+			Topic:     "orders",
+			Partition: partition,
+			Offset:    off,
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("order %d", i), string(read.Record.Value))
+	}
+	assert.NoError(t, producer.Close())
+
+	_, err = client.NewProducer(client.ProducerConfig{
+		Addr:      addr,
+		TLSConfig: rootTLSConfig,
+		Topic:     "clicks",
+	})
+	assert.Error(t, err)
+}
+
+func TestProducerRetry(t *testing.T) {
+	a, c, teardown := setupAgent(t)
+	defer teardown()
+	addr, err := c.RPCAddr()
+	assert.NoError(t, err)
+	producer, err := client.NewProducer(client.ProducerConfig{
+		Addr:       addr,
+		TLSConfig:  rootTLSConfig,
+		MaxRetries: 20,
+	})
+	assert.NoError(t, err)
+	defer producer.Close()
+
+	//Sent while the agent is down, the record is appended once it's back
+	assert.NoError(t, a.Shutdown())
+	future := producer.Send(&proto.Record{Value: []byte("record")})
+	time.Sleep(300 * time.Millisecond)
+	select {
+	case <-future.Done():
+		t.Fatal("appended while the agent was down")
+	default:
+	}
+	a, err = agent.New(c)
+	assert.NoError(t, err)
+	defer a.Shutdown()
+	off, err := future.Offset()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), off)
+}
@@ -4,6 +4,7 @@ import (
 	"net"
 
 	//"github.com/hashicorp/serf"
+	"github.com/hashicorp/raft"
 	"github.com/hashicorp/serf/serf"
 
 	"go.uber.org/zap"
@@ -125,12 +126,34 @@ func (m *Membership) Members() []serf.Member {
 	return m.serf.Members()
 }
 
+/*
+SetTag gossips a tag on the local member, keeping its others. Members
+see it once it has spread, in their Members.
+*/
+func (m *Membership) SetTag(key, value string) error {
+	tags := make(map[string]string)
+	for k, v := range m.serf.LocalMember().Tags {
+		tags[k] = v
+	}
+	tags[key] = value
+	return m.serf.SetTags(tags)
+}
+
 func (m *Membership) Leave() error {
-	return m.serf.Leave()
+	if err := m.serf.Leave(); err != nil {
+		return err
+	}
+	//Release the bind address so the node can come back on it
+	return m.serf.Shutdown()
 }
 
 func (m *Membership) logError(err error, msg string, member serf.Member) {
-	m.logger.Error(
+	log := m.logger.Error
+	//Only the Raft leader changes the cluster, the others are expected to fail
+	if err == raft.ErrNotLeader {
+		log = m.logger.Debug
+	}
+	log(
 		msg,
 		zap.Error(err),
 		zap.String("name", member.Name),
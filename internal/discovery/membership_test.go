@@ -21,6 +21,18 @@ func TestMembership(t *testing.T) {
 			0 == len(handler.leaves)
 	}, 3*time.Second, 250*time.Millisecond)
 
+	//Tags set later spread to the others
+	assert.NoError(t, m[1].SetTag("high_offset", "7"))
+	assert.Eventually(t, func() bool {
+		for _, member := range m[0].Members() {
+			if member.Name == "1" {
+				return member.Tags["high_offset"] == "7" &&
+					member.Tags["rpc_addr"] != ""
+			}
+		}
+		return false
+	}, 3*time.Second, 250*time.Millisecond)
+
 	err := m[2].Leave()
 	assert.NoError(t, err)
 
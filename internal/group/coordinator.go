@@ -0,0 +1,295 @@
+package group
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"logstore/internal/log/proto"
+	"sort"
+	"sync"
+	"time"
+)
+
+//defaultSessionTimeout is how long a member lasts without heartbeats by default
+const defaultSessionTimeout = 10 * time.Second
+
+//Topics tells the coordinator how many partitions the topics read have
+type Topics interface {
+	Partitions(topic string) (uint32, error)
+}
+
+/*
+Coordinator keeps consumer groups' members and assigns them the
+partitions of the topics they read. Members come and go by joining,
+leaving or letting their session expire, each change starting a new
+generation of the group. Assignments are worked out afresh from the
+members and partitions on every request, so they also follow topics
+being created and deleted. Membership is kept in memory, members join
+again after the agent restarts; committed offsets are kept in Offsets.
+*/
+type Coordinator struct {
+	Topics  Topics
+	Offsets *Offsets
+
+	mu     sync.Mutex
+	groups map[string]*group
+}
+
+type group struct {
+	generation uint64
+	members    map[string]*member
+}
+
+type member struct {
+	topics  []string
+	session time.Duration
+	seen    time.Time //last joined or heartbeat
+}
+
+func NewCoordinator(topics Topics, offsets *Offsets) *Coordinator {
+	return &Coordinator{
+		Topics:  topics,
+		Offsets: offsets,
+		groups:  make(map[string]*group),
+	}
+}
+
+/*
+JoinGroup adds a member reading topics to the group, or updates one
+that already joined. A new member, or one reading different topics,
+rebalances the group.
+*/
+func (c *Coordinator) JoinGroup(
+	name, id string,
+	topics []string,
+	session time.Duration,
+) (*proto.Assignment, error) {
+	topics = dedupe(topics)
+	for _, topic := range topics {
+		if _, err := c.partitions(topic); err != nil {
+			return nil, err
+		}
+	}
+	if session == 0 {
+		session = defaultSessionTimeout
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	g, ok := c.groups[name]
+	if !ok {
+		g = &group{members: make(map[string]*member)}
+		c.groups[name] = g
+	}
+	if id == "" {
+		var err error
+		if id, err = newMemberID(); err != nil {
+			return nil, err
+		}
+	}
+	m, ok := g.members[id]
+	if !ok || !sameTopics(m.topics, topics) {
+		g.generation++
+	}
+	g.members[id] = &member{
+		topics:  topics,
+		session: session,
+		seen:    time.Now(),
+	}
+	return c.assignment(g, id), nil
+}
+
+/*
+Heartbeat keeps the member's session alive and returns its assignment,
+in a new generation if the group rebalanced.
+*/
+func (c *Coordinator) Heartbeat(name, id string) (*proto.Assignment, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	g, m, err := c.member(name, id)
+	if err != nil {
+		return nil, err
+	}
+	m.seen = time.Now()
+	return c.assignment(g, id), nil
+}
+
+//LeaveGroup removes the member, rebalancing its partitions to the others
+func (c *Coordinator) LeaveGroup(name, id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	g, _, err := c.member(name, id)
+	if err != nil {
+		return err
+	}
+	c.remove(name, g, id)
+	return nil
+}
+
+/*
+Expire removes the members whose session has passed by now without a
+heartbeat. Returns the number removed.
+*/
+func (c *Coordinator) Expire(now time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expired := 0
+	for name, g := range c.groups {
+		for id, m := range g.members {
+			if now.Sub(m.seen) > m.session {
+				c.remove(name, g, id)
+				expired++
+			}
+		}
+	}
+	return expired
+}
+
+//remove drops a member and starts a generation, or the group once it's empty
+func (c *Coordinator) remove(name string, g *group, id string) {
+	delete(g.members, id)
+	g.generation++
+	if len(g.members) == 0 {
+		delete(c.groups, name)
+	}
+}
+
+/*
+CommitOffset records the group's progress through a partition. A
+member's commit is only taken under the group's current generation and
+for a partition assigned to it, so a member that missed a rebalance
+can't overwrite the progress of the one now reading its partition.
+*/
+func (c *Coordinator) CommitOffset(req *proto.CommitOffsetRequest) error {
+	partitions, err := c.partitions(req.Topic)
+	if err != nil {
+		return err
+	}
+	if req.Partition >= partitions {
+		return proto.ErrPartitionNotFound{
+			Topic:     req.Topic,
+			Partition: req.Partition,
+		}
+	}
+	if req.Member != "" {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		g, _, err := c.member(req.Group, req.Member)
+		if err != nil {
+			return err
+		}
+		if req.Generation != g.generation ||
+			!assigned(c.assignment(g, req.Member), req.Topic, req.Partition) {
+			return proto.ErrStaleGeneration{
+				Group:      req.Group,
+				Generation: req.Generation,
+			}
+		}
+	}
+	return c.Offsets.Commit(req.Group, req.Topic, req.Partition, req.Offset)
+}
+
+//FetchCommittedOffset returns the offset the group last committed for the partition
+func (c *Coordinator) FetchCommittedOffset(
+	name, topic string,
+	partition uint32,
+) (uint64, bool) {
+	return c.Offsets.Fetch(name, topic, partition)
+}
+
+//member looks up a member of a group. Callers must hold the lock
+func (c *Coordinator) member(name, id string) (*group, *member, error) {
+	g, ok := c.groups[name]
+	if !ok {
+		return nil, nil, proto.ErrUnknownMember{Group: name, Member: id}
+	}
+	m, ok := g.members[id]
+	if !ok {
+		return nil, nil, proto.ErrUnknownMember{Group: name, Member: id}
+	}
+	return g, m, nil
+}
+
+/*
+assignment deals each topic's partitions out in turn to the members
+reading it, sorted by ID, and returns those dealt to id. Callers must
+hold the lock.
+*/
+func (c *Coordinator) assignment(g *group, id string) *proto.Assignment {
+	readers := make(map[string][]string)
+	for mid, m := range g.members {
+		for _, topic := range m.topics {
+			readers[topic] = append(readers[topic], mid)
+		}
+	}
+	a := &proto.Assignment{Member: id, Generation: g.generation}
+	for _, topic := range g.members[id].topics {
+		members := readers[topic]
+		sort.Strings(members)
+		partitions, err := c.partitions(topic)
+		if err != nil {
+			continue //deleted since, nothing left to read
+		}
+		for p := uint32(0); p < partitions; p++ {
+			if members[int(p)%len(members)] == id {
+				a.Partitions = append(a.Partitions, &proto.TopicPartition{
+					Topic:     topic,
+					Partition: p,
+				})
+			}
+		}
+	}
+	return a
+}
+
+//partitions counts a topic's partitions, the default topic has one
+func (c *Coordinator) partitions(topic string) (uint32, error) {
+	if topic == "" {
+		return 1, nil
+	}
+	if c.Topics == nil {
+		return 0, proto.ErrTopicNotFound{Topic: topic}
+	}
+	return c.Topics.Partitions(topic)
+}
+
+func assigned(a *proto.Assignment, topic string, partition uint32) bool {
+	for _, tp := range a.Partitions {
+		if tp.Topic == topic && tp.Partition == partition {
+			return true
+		}
+	}
+	return false
+}
+
+//dedupe sorts topics and drops repeats
+func dedupe(topics []string) []string {
+	sorted := append([]string(nil), topics...)
+	sort.Strings(sorted)
+	unique := sorted[:0]
+	for _, topic := range sorted {
+		if len(unique) == 0 || topic != unique[len(unique)-1] {
+			unique = append(unique, topic)
+		}
+	}
+	return unique
+}
+
+func sameTopics(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func newMemberID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
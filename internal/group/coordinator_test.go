@@ -0,0 +1,104 @@
+package group
+
+import (
+	"io/ioutil"
+	"logstore/internal/log/proto"
+	"logstore/internal/logcomponents"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//topics is a fixed set of topics and their partition counts
+type topics map[string]uint32
+
+func (t topics) Partitions(topic string) (uint32, error) {
+	n, ok := t[topic]
+	if !ok {
+		return 0, proto.ErrTopicNotFound{Topic: topic}
+	}
+	return n, nil
+}
+
+func TestCoordinator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coordinator-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	offsets, err := NewOffsets(dir, logcomponents.Config{})
+	assert.NoError(t, err)
+	defer offsets.Close()
+	c := NewCoordinator(topics{"orders": 4}, offsets)
+
+	_, err = c.JoinGroup("readers", "", []string{"clicks"}, 0)
+	assert.Equal(t, proto.ErrTopicNotFound{Topic: "clicks"}, err)
+
+	//Alone, a member reads every partition
+	first, err := c.JoinGroup("readers", "", []string{"orders", ""}, 0)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, first.Member)
+	assert.Equal(t, uint64(1), first.Generation)
+	assert.Equal(t, 5, len(first.Partitions))
+
+	//A second member rebalances the group, splitting the partitions
+	second, err := c.JoinGroup("readers", "", []string{"orders"}, 50*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), second.Generation)
+	first, err = c.Heartbeat("readers", first.Member)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), first.Generation)
+	assert.Equal(t, 3, len(first.Partitions)) //two of orders and the default topic
+	assert.Equal(t, 2, len(second.Partitions))
+	for _, tp := range second.Partitions {
+		assert.False(t, assigned(first, tp.Topic, tp.Partition))
+	}
+
+	//Rejoining unchanged keeps the generation
+	again, err := c.JoinGroup("readers", first.Member, []string{"", "orders"}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), again.Generation)
+
+	//Members commit only what they're assigned, under the current generation
+	owned := second.Partitions[0]
+	commit := &proto.CommitOffsetRequest{
+		Group:      "readers",
+		Topic:      owned.Topic,
+		Partition:  owned.Partition,
+		Offset:     10,
+		Member:     first.Member,
+		Generation: first.Generation,
+	}
+	assert.IsType(t, proto.ErrStaleGeneration{}, c.CommitOffset(commit))
+	commit.Member, commit.Generation = second.Member, second.Generation
+	assert.NoError(t, c.CommitOffset(commit))
+	off, ok := c.FetchCommittedOffset("readers", owned.Topic, owned.Partition)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(10), off)
+
+	//A member that stops heartbeating expires, its partitions move on
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 1, c.Expire(time.Now()))
+	_, err = c.Heartbeat("readers", second.Member)
+	assert.Equal(t, proto.ErrUnknownMember{Group: "readers", Member: second.Member}, err)
+	assert.IsType(t, proto.ErrUnknownMember{}, c.CommitOffset(commit))
+	first, err = c.Heartbeat("readers", first.Member)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), first.Generation)
+	assert.Equal(t, 5, len(first.Partitions))
+
+	//Commits from outside the group are taken as they come
+	assert.NoError(t, c.CommitOffset(&proto.CommitOffsetRequest{
+		Group:  "readers",
+		Topic:  "orders",
+		Offset: 3,
+	}))
+	assert.IsType(t, proto.ErrPartitionNotFound{}, c.CommitOffset(&proto.CommitOffsetRequest{
+		Group:     "readers",
+		Topic:     "orders",
+		Partition: 4,
+	}))
+
+	assert.NoError(t, c.LeaveGroup("readers", first.Member))
+	assert.IsType(t, proto.ErrUnknownMember{}, c.LeaveGroup("readers", first.Member))
+}
@@ -0,0 +1,188 @@
+/*
+Package group coordinates consumer groups: which member reads which
+partitions, and how far the group has read each of them.
+*/
+package group
+
+import (
+	"encoding/binary"
+	"errors"
+	"logstore/internal/log/proto"
+	"logstore/internal/logcomponents"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	enc              = binary.BigEndian
+	errCorruptCommit = errors.New("group: corrupt offset commit")
+)
+
+/*
+Offsets keeps the offsets consumer groups have committed. Every commit
+is appended to a compacted Log keyed by group, topic and partition, so
+compaction keeps only the latest; the log is replayed on opening.
+*/
+type Offsets struct {
+	//Replicate, when set, takes commits instead of the log, as a
+	//DistributedLog does to apply them to the Offsets of every server
+	Replicate func(record *proto.Record) error
+
+	mu        sync.RWMutex
+	log       *logcomponents.Log
+	committed map[string]uint64 //by record key
+}
+
+var _ logcomponents.OffsetStore = (*Offsets)(nil)
+
+/*
+NewOffsets opens the offsets committed to the log in dir. The log is
+compacted whatever c says.
+*/
+func NewOffsets(dir string, c logcomponents.Config) (*Offsets, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c.Compaction.Enabled = true
+	if c.Segment.MaxStoreBytes == 0 {
+		c.Segment.MaxStoreBytes = 1 << 20
+	}
+	if c.Segment.MaxIndexBytes == 0 {
+		c.Segment.MaxIndexBytes = 1 << 20
+	}
+	log, err := logcomponents.NewLog(dir, c)
+	if err != nil {
+		return nil, err
+	}
+	o := &Offsets{log: log, committed: make(map[string]uint64)}
+	if err = o.replay(); err != nil {
+		log.Close()
+		return nil, err
+	}
+	return o, nil
+}
+
+//replay rebuilds the committed offsets from the log, latest commit winning
+func (o *Offsets) replay() error {
+	lowest, err := o.log.LowestOffset()
+	if err != nil {
+		return err
+	}
+	records, _, err := o.log.ReadRange(lowest, 0, 0)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if len(record.Value) != 8 {
+			return errCorruptCommit
+		}
+		o.committed[string(record.Key)] = enc.Uint64(record.Value)
+	}
+	return nil
+}
+
+//Commit records that group reads the partition from offset on
+func (o *Offsets) Commit(group, topic string, partition uint32, offset uint64) error {
+	value := make([]byte, 8)
+	enc.PutUint64(value, offset)
+	record := &proto.Record{Key: offsetKey(group, topic, partition), Value: value}
+	if o.Replicate != nil {
+		return o.Replicate(record)
+	}
+	return o.Apply(record)
+}
+
+//Apply appends a commit, a record as Commit makes them
+func (o *Offsets) Apply(record *proto.Record) error {
+	if len(record.Value) != 8 {
+		return errCorruptCommit
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.apply(record)
+}
+
+//apply is Apply for callers holding the lock
+func (o *Offsets) apply(record *proto.Record) error {
+	_, err := o.log.Append(&proto.Record{Key: record.Key, Value: record.Value})
+	if err != nil {
+		return err
+	}
+	o.committed[string(record.Key)] = enc.Uint64(record.Value)
+	return nil
+}
+
+//Records returns the latest commit for every group, topic and partition
+func (o *Offsets) Records() []*proto.Record {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	records := make([]*proto.Record, 0, len(o.committed))
+	for key, offset := range o.committed {
+		value := make([]byte, 8)
+		enc.PutUint64(value, offset)
+		records = append(records, &proto.Record{Key: []byte(key), Value: value})
+	}
+	return records
+}
+
+//Restore replaces every commit with records, as Records returns them
+func (o *Offsets) Restore(records []*proto.Record) error {
+	for _, record := range records {
+		if len(record.Value) != 8 {
+			return errCorruptCommit
+		}
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.log.Reset(); err != nil {
+		return err
+	}
+	o.committed = make(map[string]uint64)
+	for _, record := range records {
+		if err := o.apply(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Sync flushes the commits to stable storage
+func (o *Offsets) Sync() error {
+	return o.log.Sync()
+}
+
+//Fetch returns the offset group last committed for the partition
+func (o *Offsets) Fetch(group, topic string, partition uint32) (uint64, bool) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	offset, ok := o.committed[string(offsetKey(group, topic, partition))]
+	return offset, ok
+}
+
+//Compact drops superseded commits from the log, returning how many
+func (o *Offsets) Compact(now time.Time) (int, error) {
+	//Restore may be resetting the log meanwhile
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.log.Compact(now)
+}
+
+func (o *Offsets) Close() error {
+	return o.log.Close()
+}
+
+/*
+offsetKey is the record key commits for a partition share: the group
+and topic, each length prefixed, then the partition.
+*/
+func offsetKey(group, topic string, partition uint32) []byte {
+	key := make([]byte, 0, 2*binary.MaxVarintLen64+len(group)+len(topic)+4)
+	n := make([]byte, binary.MaxVarintLen64)
+	key = append(key, n[:binary.PutUvarint(n, uint64(len(group)))]...)
+	key = append(key, group...)
+	key = append(key, n[:binary.PutUvarint(n, uint64(len(topic)))]...)
+	key = append(key, topic...)
+	enc.PutUint32(n, partition)
+	return append(key, n[:4]...)
+}
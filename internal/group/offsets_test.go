@@ -0,0 +1,105 @@
+package group
+
+import (
+	"io/ioutil"
+	"logstore/internal/log/proto"
+	"logstore/internal/logcomponents"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOffsets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offsets-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	//Segments small enough for commits to fill a few
+	c := logcomponents.Config{}
+	c.Segment.MaxStoreBytes = 256
+	offsets, err := NewOffsets(dir, c)
+	assert.NoError(t, err)
+
+	_, ok := offsets.Fetch("readers", "orders", 0)
+	assert.False(t, ok)
+	for off := uint64(1); off <= 20; off++ {
+		assert.NoError(t, offsets.Commit("readers", "orders", 0, off))
+	}
+	assert.NoError(t, offsets.Commit("readers", "orders", 1, 5))
+	assert.NoError(t, offsets.Commit("writers", "orders", 0, 7))
+	assert.NoError(t, offsets.Commit("readers", "", 0, 3))
+
+	//Compaction drops superseded commits, the latest survive reopening
+	removed, err := offsets.Compact(time.Now())
+	assert.NoError(t, err)
+	assert.True(t, removed > 0)
+	assert.NoError(t, offsets.Close())
+
+	offsets, err = NewOffsets(dir, c)
+	assert.NoError(t, err)
+	defer offsets.Close()
+	for _, tc := range []struct {
+		group, topic string
+		partition    uint32
+		offset       uint64
+	}{
+		{"readers", "orders", 0, 20},
+		{"readers", "orders", 1, 5},
+		{"writers", "orders", 0, 7},
+		{"readers", "", 0, 3},
+	} {
+		off, ok := offsets.Fetch(tc.group, tc.topic, tc.partition)
+		assert.True(t, ok)
+		assert.Equal(t, tc.offset, off)
+	}
+	_, ok = offsets.Fetch("writers", "orders", 1)
+	assert.False(t, ok)
+}
+
+func TestOffsetsReplicate(t *testing.T) {
+	var offsets []*Offsets
+	for i := 0; i < 2; i++ {
+		dir, err := ioutil.TempDir("", "offsets-replicate-test")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dir)
+		o, err := NewOffsets(dir, logcomponents.Config{})
+		assert.NoError(t, err)
+		defer o.Close()
+		offsets = append(offsets, o)
+	}
+	leader, follower := offsets[0], offsets[1]
+
+	//Commits replicated are applied on every server, as Raft would
+	leader.Replicate = func(record *proto.Record) error {
+		for _, o := range offsets {
+			if err := o.Apply(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	assert.NoError(t, leader.Commit("readers", "", 0, 3))
+	assert.NoError(t, leader.Commit("writers", "", 0, 7))
+	for _, o := range offsets {
+		off, ok := o.Fetch("readers", "", 0)
+		assert.True(t, ok)
+		assert.Equal(t, uint64(3), off)
+	}
+
+	//Restoring the records of one replaces every commit of another
+	records := leader.Records()
+	assert.Equal(t, 2, len(records))
+	assert.NoError(t, follower.Apply(&proto.Record{
+		Key:   offsetKey("others", "", 0),
+		Value: make([]byte, 8),
+	}))
+	assert.NoError(t, follower.Restore(records))
+	_, ok := follower.Fetch("others", "", 0)
+	assert.False(t, ok)
+	off, ok := follower.Fetch("writers", "", 0)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(7), off)
+	assert.Equal(t, errCorruptCommit, follower.Apply(&proto.Record{}))
+}
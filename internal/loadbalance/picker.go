@@ -0,0 +1,193 @@
+package loadbalance
+
+import (
+	"context"
+	"logstore/internal/log/proto"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/status"
+)
+
+func init() {
+	balancer.Register(&builder{})
+}
+
+//leaderMethods are writes, which only the Raft leader can serve
+var leaderMethods = map[string]bool{
+	"/log.Log/Append":       true,
+	"/log.Log/AppendStream": true,
+	"/log.Log/ProduceBatch": true,
+}
+
+/*
+coordinatorMethods act on topics, consumer groups and transactions,
+which each server keeps to itself, so they all go to one server every
+client agrees on: the Raft leader, or else the replica with the lowest
+address. So do RPCs on a topic's records, marked with WithTopic.
+*/
+var coordinatorMethods = map[string]bool{
+	"/log.Log/CreateTopic":          true,
+	"/log.Log/ListTopics":           true,
+	"/log.Log/DescribeTopic":        true,
+	"/log.Log/DeleteTopic":          true,
+	"/log.Log/JoinGroup":            true,
+	"/log.Log/Heartbeat":            true,
+	"/log.Log/LeaveGroup":           true,
+	"/log.Log/CommitOffset":         true,
+	"/log.Log/FetchCommittedOffset": true,
+	"/log.Log/BeginTransaction":     true,
+	"/log.Log/CommitTransaction":    true,
+	"/log.Log/AbortTransaction":     true,
+}
+
+//topicKey marks a context whose RPC names a topic
+type topicKey struct{}
+
+/*
+WithTopic marks ctx as that of an RPC on topic's records, for the
+picker to send it to the coordinator, the only server with the topic.
+Streams pick their server before sending any request, so a stream on a
+topic must be opened with it; UnaryInterceptor marks the other RPCs.
+*/
+func WithTopic(ctx context.Context, topic string) context.Context {
+	if topic == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, topicKey{}, topic)
+}
+
+/*
+UnaryInterceptor marks RPCs whose request names a topic with WithTopic.
+Dial balanced clients with grpc.WithUnaryInterceptor(UnaryInterceptor).
+*/
+func UnaryInterceptor(
+	ctx context.Context,
+	method string,
+	req, reply interface{},
+	cc *grpc.ClientConn,
+	invoker grpc.UnaryInvoker,
+	opts ...grpc.CallOption,
+) error {
+	if r, ok := req.(interface{ GetTopic() string }); ok {
+		ctx = WithTopic(ctx, r.GetTopic())
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+/*
+builder builds the base balancer around a Picker per ClientConn, so
+pickers can ask that ClientConn's resolver to refresh
+*/
+type builder struct{}
+
+func (b *builder) Name() string {
+	return Name
+}
+
+func (b *builder) Build(
+	cc balancer.ClientConn,
+	opts balancer.BuildOptions,
+) balancer.Balancer {
+	pb := &pickerBuilder{clientConn: cc}
+	return base.NewBalancerBuilder(Name, pb, base.Config{}).Build(cc, opts)
+}
+
+type pickerBuilder struct {
+	clientConn balancer.ClientConn
+}
+
+func (pb *pickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	p := &Picker{clientConn: pb.clientConn}
+	var coordinatorAddr string
+	for sc, scInfo := range info.ReadySCs {
+		role, _ := scInfo.Address.Attributes.Value(roleKey{}).(proto.Server_Role)
+		switch role {
+		case proto.Server_LEADER:
+			p.leader = sc
+		case proto.Server_FOLLOWER:
+			p.followers = append(p.followers, sc)
+		default:
+			p.replicas = append(p.replicas, sc)
+			if p.coordinator == nil || scInfo.Address.Addr < coordinatorAddr {
+				p.coordinator, coordinatorAddr = sc, scInfo.Address.Addr
+			}
+		}
+	}
+	if p.leader != nil {
+		p.coordinator = p.leader
+	}
+	return p
+}
+
+/*
+Picker sends writes to the Raft leader and round-robins reads across
+its followers, or the leader when there are none. Reads from a follower
+may lag the leader. Outside Raft every replica serves both, round-robin.
+Topic, group and transaction RPCs all go to one coordinator, the leader
+or a fixed replica, as do RPCs marked WithTopic: topics aren't
+replicated, so any other replica would answer that the topic isn't found.
+An RPC failing as unavailable, such as a write to a server that lost
+its leadership, refreshes the servers.
+*/
+type Picker struct {
+	mu          sync.RWMutex
+	clientConn  balancer.ClientConn
+	leader      balancer.SubConn
+	followers   []balancer.SubConn
+	replicas    []balancer.SubConn
+	coordinator balancer.SubConn
+	current     uint64
+}
+
+var _ balancer.Picker = (*Picker)(nil)
+
+func (p *Picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var result balancer.PickResult
+	switch {
+	case coordinatorMethods[info.FullMethodName] || onTopic(info.Ctx):
+		result.SubConn = p.coordinator
+	case p.leader != nil && (leaderMethods[info.FullMethodName] || len(p.followers) == 0):
+		result.SubConn = p.leader
+	case p.leader != nil:
+		result.SubConn = p.next(p.followers)
+	case len(p.replicas) > 0:
+		result.SubConn = p.next(p.replicas)
+	case !leaderMethods[info.FullMethodName] && len(p.followers) > 0:
+		result.SubConn = p.next(p.followers)
+	}
+	if result.SubConn == nil {
+		//Leaderless, wait for the resolver to find one
+		p.refresh()
+		return result, balancer.ErrNoSubConnAvailable
+	}
+	result.Done = func(done balancer.DoneInfo) {
+		if status.Code(done.Err) == codes.Unavailable {
+			p.refresh()
+		}
+	}
+	return result, nil
+}
+
+//onTopic reports whether ctx was marked WithTopic
+func onTopic(ctx context.Context) bool {
+	return ctx != nil && ctx.Value(topicKey{}) != nil
+}
+
+func (p *Picker) next(subConns []balancer.SubConn) balancer.SubConn {
+	cur := atomic.AddUint64(&p.current, uint64(1))
+	return subConns[cur%uint64(len(subConns))]
+}
+
+func (p *Picker) refresh() {
+	if p.clientConn != nil {
+		p.clientConn.ResolveNow(resolver.ResolveNowOptions{})
+	}
+}
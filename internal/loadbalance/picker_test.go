@@ -0,0 +1,238 @@
+package loadbalance
+
+import (
+	"context"
+	"logstore/internal/log/proto"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+)
+
+func TestPickerNoSubConnAvailable(t *testing.T) {
+	picker := &Picker{}
+	for _, method := range []string{
+		"/log.Log/Append",
+		"/log.Log/Read",
+	} {
+		info := balancer.PickInfo{FullMethodName: method}
+		result, err := picker.Pick(info)
+		assert.Equal(t, balancer.ErrNoSubConnAvailable, err)
+		assert.Nil(t, result.SubConn)
+	}
+}
+
+func TestPickerWritesToLeader(t *testing.T) {
+	picker, subConns := setupTest()
+	for _, method := range []string{
+		"/log.Log/Append",
+		"/log.Log/AppendStream",
+		"/log.Log/ProduceBatch",
+	} {
+		info := balancer.PickInfo{FullMethodName: method}
+		result, err := picker.Pick(info)
+		assert.NoError(t, err)
+		assert.Equal(t, subConns[0], result.SubConn)
+	}
+}
+
+func TestPickerReadsFromFollowers(t *testing.T) {
+	picker, subConns := setupTest()
+	picked := map[balancer.SubConn]int{}
+	for i := 0; i < 4; i++ {
+		info := balancer.PickInfo{FullMethodName: "/log.Log/Read"}
+		result, err := picker.Pick(info)
+		assert.NoError(t, err)
+		picked[result.SubConn]++
+	}
+	assert.Equal(t, map[balancer.SubConn]int{
+		subConns[1]: 2,
+		subConns[2]: 2,
+	}, picked)
+}
+
+func TestPickerReadsFromLoneLeader(t *testing.T) {
+	sc := &subConn{}
+	picker := (&pickerBuilder{}).Build(base.PickerBuildInfo{
+		ReadySCs: map[balancer.SubConn]base.SubConnInfo{
+			sc: {Address: roleAddr(proto.Server_LEADER)},
+		},
+	})
+	result, err := picker.Pick(balancer.PickInfo{FullMethodName: "/log.Log/Read"})
+	assert.NoError(t, err)
+	assert.Equal(t, sc, result.SubConn)
+}
+
+func TestPickerReplicas(t *testing.T) {
+	var subConns []*subConn
+	buildInfo := base.PickerBuildInfo{
+		ReadySCs: make(map[balancer.SubConn]base.SubConnInfo),
+	}
+	for i := 0; i < 2; i++ {
+		sc := &subConn{}
+		buildInfo.ReadySCs[sc] = base.SubConnInfo{
+			Address: roleAddr(proto.Server_REPLICA),
+		}
+		subConns = append(subConns, sc)
+	}
+	picker := (&pickerBuilder{}).Build(buildInfo)
+	for _, method := range []string{"/log.Log/Append", "/log.Log/Read"} {
+		picked := map[balancer.SubConn]int{}
+		for i := 0; i < 4; i++ {
+			result, err := picker.Pick(balancer.PickInfo{FullMethodName: method})
+			assert.NoError(t, err)
+			picked[result.SubConn]++
+		}
+		assert.Equal(t, map[balancer.SubConn]int{
+			subConns[0]: 2,
+			subConns[1]: 2,
+		}, picked)
+	}
+}
+
+func TestPickerCoordinator(t *testing.T) {
+	methods := []string{
+		"/log.Log/CreateTopic",
+		"/log.Log/ListTopics",
+		"/log.Log/DescribeTopic",
+		"/log.Log/DeleteTopic",
+		"/log.Log/JoinGroup",
+		"/log.Log/Heartbeat",
+		"/log.Log/LeaveGroup",
+		"/log.Log/CommitOffset",
+		"/log.Log/FetchCommittedOffset",
+		"/log.Log/BeginTransaction",
+		"/log.Log/CommitTransaction",
+		"/log.Log/AbortTransaction",
+	}
+	//The leader in Raft mode
+	picker, subConns := setupTest()
+	for _, method := range methods {
+		result, err := picker.Pick(balancer.PickInfo{FullMethodName: method})
+		assert.NoError(t, err)
+		assert.Equal(t, subConns[0], result.SubConn)
+	}
+
+	//otherwise the replica with the lowest address
+	replicaPicker, replicas := setupReplicas()
+	for _, method := range methods {
+		for i := 0; i < 3; i++ {
+			result, err := replicaPicker.Pick(balancer.PickInfo{FullMethodName: method})
+			assert.NoError(t, err)
+			assert.Equal(t, replicas[1], result.SubConn)
+		}
+	}
+}
+
+func TestPickerTopics(t *testing.T) {
+	picker, replicas := setupReplicas()
+	methods := []string{
+		"/log.Log/Append",
+		"/log.Log/Read",
+		"/log.Log/ReadStream",
+		"/log.Log/ReadRange",
+	}
+	//RPCs on a topic go to the coordinator, the only replica with it
+	ctx := WithTopic(context.Background(), "orders")
+	for _, method := range methods {
+		for i := 0; i < 3; i++ {
+			result, err := picker.Pick(balancer.PickInfo{
+				FullMethodName: method,
+				Ctx:            ctx,
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, replicas[1], result.SubConn)
+		}
+	}
+
+	//while those on the default topic are spread over every replica
+	picked := map[balancer.SubConn]int{}
+	for i := 0; i < 3; i++ {
+		result, err := picker.Pick(balancer.PickInfo{
+			FullMethodName: "/log.Log/Read",
+			Ctx:            WithTopic(context.Background(), ""),
+		})
+		assert.NoError(t, err)
+		picked[result.SubConn]++
+	}
+	assert.Equal(t, 3, len(picked))
+}
+
+func TestUnaryInterceptor(t *testing.T) {
+	var marked bool
+	invoker := func(
+		ctx context.Context,
+		method string,
+		req, reply interface{},
+		cc *grpc.ClientConn,
+		opts ...grpc.CallOption,
+	) error {
+		marked = onTopic(ctx)
+		return nil
+	}
+	for req, want := range map[interface{}]bool{
+		&proto.ReadRequest{Topic: "orders"}:         true,
+		&proto.ProduceBatchRequest{Topic: "orders"}: true,
+		&proto.ReadRequest{}:                        false,
+		&proto.GetServersRequest{}:                  false,
+	} {
+		err := UnaryInterceptor(context.Background(), "", req, nil, nil, invoker)
+		assert.NoError(t, err)
+		assert.Equal(t, want, marked)
+	}
+}
+
+//setupTest builds a picker over a leader, subConns[0], and two followers
+func setupTest() (*Picker, []*subConn) {
+	var subConns []*subConn
+	buildInfo := base.PickerBuildInfo{
+		ReadySCs: make(map[balancer.SubConn]base.SubConnInfo),
+	}
+	for i := 0; i < 3; i++ {
+		role := proto.Server_FOLLOWER
+		if i == 0 {
+			role = proto.Server_LEADER
+		}
+		sc := &subConn{}
+		buildInfo.ReadySCs[sc] = base.SubConnInfo{Address: roleAddr(role)}
+		subConns = append(subConns, sc)
+	}
+	picker := (&pickerBuilder{}).Build(buildInfo).(*Picker)
+	return picker, subConns
+}
+
+//setupReplicas builds a picker over three replicas, subConns[1] the lowest
+func setupReplicas() (*Picker, []*subConn) {
+	var subConns []*subConn
+	buildInfo := base.PickerBuildInfo{
+		ReadySCs: make(map[balancer.SubConn]base.SubConnInfo),
+	}
+	for _, addr := range []string{"10.0.0.2:8400", "10.0.0.1:8400", "10.0.0.3:8400"} {
+		sc := &subConn{}
+		address := roleAddr(proto.Server_REPLICA)
+		address.Addr = addr
+		buildInfo.ReadySCs[sc] = base.SubConnInfo{Address: address}
+		subConns = append(subConns, sc)
+	}
+	picker := (&pickerBuilder{}).Build(buildInfo).(*Picker)
+	return picker, subConns
+}
+
+func roleAddr(role proto.Server_Role) resolver.Address {
+	return resolver.Address{Attributes: attributes.New(roleKey{}, role)}
+}
+
+//subConn implements balancer.SubConn
+type subConn struct {
+	addrs []resolver.Address
+}
+
+func (s *subConn) UpdateAddresses(addrs []resolver.Address) {
+	s.addrs = addrs
+}
+
+func (s *subConn) Connect() {}
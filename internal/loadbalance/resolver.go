@@ -0,0 +1,181 @@
+package loadbalance
+
+import (
+	"context"
+	"fmt"
+	"logstore/internal/log/proto"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+//Name is the resolver's scheme and the balancer's name: dial logstore:///<rpc addr>
+const Name = "logstore"
+
+//roleKey holds the role of the server at an address, for the picker
+type roleKey struct{}
+
+//How long a GetServers call may take, and how long to wait before asking again
+//after no server took writes or none answered
+const (
+	resolveTimeout = 3 * time.Second
+	retryInterval  = 250 * time.Millisecond
+)
+
+func init() {
+	resolver.Register(&Resolver{})
+}
+
+/*
+Resolver turns a logstore:/// target into the cluster's servers by
+calling GetServers on the target, or on any server it last resolved if
+the target is gone. Only live servers are resolved. It resolves again
+whenever gRPC asks, and keeps asking while no server takes writes.
+*/
+type Resolver struct {
+	mu            sync.Mutex
+	clientConn    resolver.ClientConn
+	dialOpts      []grpc.DialOption
+	serviceConfig *serviceconfig.ParseResult
+	addrs         []string //the target, then the servers last resolved
+	resolving     bool
+	closed        bool
+	logger        *zap.Logger
+}
+
+var _ resolver.Builder = (*Resolver)(nil)
+
+func (r *Resolver) Build(
+	target resolver.Target,
+	cc resolver.ClientConn,
+	opts resolver.BuildOptions,
+) (resolver.Resolver, error) {
+	var dialOpts []grpc.DialOption
+	if opts.DialCreds != nil {
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(opts.DialCreds))
+	} else {
+		dialOpts = append(dialOpts, grpc.WithInsecure())
+	}
+	res := &Resolver{
+		clientConn: cc,
+		dialOpts:   dialOpts,
+		serviceConfig: cc.ParseServiceConfig(
+			fmt.Sprintf(`{"loadBalancingConfig":[{"%s":{}}]}`, Name),
+		),
+		addrs:  []string{target.Endpoint},
+		logger: zap.L().Named("resolver"),
+	}
+	res.ResolveNow(resolver.ResolveNowOptions{})
+	return res, nil
+}
+
+func (r *Resolver) Scheme() string {
+	return Name
+}
+
+var _ resolver.Resolver = (*Resolver)(nil)
+
+/*
+ResolveNow starts resolving in the background, gRPC calls it with its
+own locks held. Calls made while resolving are folded into that one.
+*/
+func (r *Resolver) ResolveNow(resolver.ResolveNowOptions) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.resolving || r.closed {
+		return
+	}
+	r.resolving = true
+	go r.resolve()
+}
+
+func (r *Resolver) resolve() {
+	r.mu.Lock()
+	addrs := r.addrs
+	r.mu.Unlock()
+
+	var servers []*proto.Server
+	var err error
+	for _, addr := range addrs {
+		if servers, err = r.getServers(addr); err == nil {
+			break
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.resolving = false
+	if r.closed {
+		return
+	}
+	if err != nil {
+		r.logger.Error("failed to resolve servers", zap.Error(err))
+		r.clientConn.ReportError(err)
+		r.retry()
+		return
+	}
+
+	var state []resolver.Address
+	writable := false
+	known := []string{addrs[0]}
+	for _, server := range servers {
+		if server.Status != "alive" {
+			continue
+		}
+		state = append(state, resolver.Address{
+			Addr:       server.RpcAddr,
+			Attributes: attributes.New(roleKey{}, server.Role),
+		})
+		writable = writable || server.Role != proto.Server_FOLLOWER
+		if server.RpcAddr != addrs[0] {
+			known = append(known, server.RpcAddr)
+		}
+	}
+	r.addrs = known
+	if err = r.clientConn.UpdateState(resolver.State{
+		Addresses:     state,
+		ServiceConfig: r.serviceConfig,
+	}); err != nil {
+		r.logger.Error("failed to update state", zap.Error(err))
+	}
+	//Mid-election, writes have nowhere to go until a leader is known
+	if !writable {
+		r.retry()
+	}
+}
+
+//retry resolves again after retryInterval. Callers hold mu
+func (r *Resolver) retry() {
+	time.AfterFunc(retryInterval, func() {
+		r.ResolveNow(resolver.ResolveNowOptions{})
+	})
+}
+
+func (r *Resolver) getServers(addr string) ([]*proto.Server, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, addr, r.dialOpts...)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	res, err := proto.NewLogClient(conn).GetServers(
+		ctx,
+		&proto.GetServersRequest{},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return res.Servers, nil
+}
+
+func (r *Resolver) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+}
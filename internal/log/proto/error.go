@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
@@ -34,3 +35,391 @@ func (e ErrOffOutOfRange) GRPCStatus() *status.Status {
 func (e ErrOffOutOfRange) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
+
+/*
+ErrCorruptRecord is returned when a stored record fails its checksum
+or cannot be decoded.
+*/
+type ErrCorruptRecord struct {
+	Offset uint64
+}
+
+func (e ErrCorruptRecord) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.DataLoss, fmt.Sprintf("corrupt record: %d", e.Offset),
+	)
+	msg := fmt.Sprintf(
+		"The record stored at offset %d failed its integrity check",
+		e.Offset,
+	)
+
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	stwd, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return stwd
+}
+
+func (e ErrCorruptRecord) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+/*
+ErrOffNotPresent is returned for an offset inside the log's range that
+holds no record, such as one removed by compaction. Readers skip it.
+*/
+type ErrOffNotPresent struct {
+	Offset uint64
+}
+
+func (e ErrOffNotPresent) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound, fmt.Sprintf("offset not present: %d", e.Offset),
+	)
+	msg := fmt.Sprintf(
+		"The requested offset is within the log's range but holds no record: %d",
+		e.Offset,
+	)
+
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	stwd, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return stwd
+}
+
+func (e ErrOffNotPresent) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+/*
+ErrNotLeader is returned for a write sent to a Raft follower. Nothing
+was appended, clients refresh which server leads and retry there.
+*/
+type ErrNotLeader struct{}
+
+func (e ErrNotLeader) GRPCStatus() *status.Status {
+	st := status.New(codes.Unavailable, "not the leader")
+	msg := "Writes must go to the cluster's leader, this server follows it"
+
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	stwd, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return stwd
+}
+
+func (e ErrNotLeader) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+//ErrTopicNotFound is returned for a request naming a topic that doesn't exist
+type ErrTopicNotFound struct {
+	Topic string
+}
+
+func (e ErrTopicNotFound) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound, fmt.Sprintf("topic not found: %s", e.Topic),
+	)
+	msg := fmt.Sprintf(
+		"No topic named %q exists on this server",
+		e.Topic,
+	)
+
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	stwd, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return stwd
+}
+
+func (e ErrTopicNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+//ErrTopicExists is returned when creating a topic under a name already in use
+type ErrTopicExists struct {
+	Topic string
+}
+
+func (e ErrTopicExists) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.AlreadyExists, fmt.Sprintf("topic exists: %s", e.Topic),
+	)
+	msg := fmt.Sprintf(
+		"The name %q is already taken on this server",
+		e.Topic,
+	)
+
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	stwd, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return stwd
+}
+
+func (e ErrTopicExists) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+/*
+ErrInvalidTopic is returned when creating a topic with a name or
+partition count the server won't accept.
+*/
+type ErrInvalidTopic struct {
+	Topic  string
+	Reason string
+}
+
+func (e ErrInvalidTopic) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.InvalidArgument, fmt.Sprintf("invalid topic: %s", e.Topic),
+	)
+	msg := fmt.Sprintf(
+		"The topic %q can't be created: %s",
+		e.Topic,
+		e.Reason,
+	)
+
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	stwd, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return stwd
+}
+
+func (e ErrInvalidTopic) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+//ErrPartitionNotFound is returned for a partition past the end of its topic
+type ErrPartitionNotFound struct {
+	Topic     string
+	Partition uint32
+}
+
+func (e ErrPartitionNotFound) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound,
+		fmt.Sprintf("partition not found: %s/%d", e.Topic, e.Partition),
+	)
+	msg := fmt.Sprintf(
+		"The topic %q has no partition %d",
+		e.Topic,
+		e.Partition,
+	)
+
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	stwd, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return stwd
+}
+
+func (e ErrPartitionNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+/*
+ErrUnknownMember is returned for a consumer group member the server
+doesn't know, as after its session expired. It joins again.
+*/
+type ErrUnknownMember struct {
+	Group  string
+	Member string
+}
+
+func (e ErrUnknownMember) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound,
+		fmt.Sprintf("unknown member: %s/%s", e.Group, e.Member),
+	)
+	msg := fmt.Sprintf(
+		"The group %q has no member %q, it must join again",
+		e.Group,
+		e.Member,
+	)
+
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	stwd, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return stwd
+}
+
+func (e ErrUnknownMember) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+/*
+ErrStaleGeneration is returned for a commit made under an assignment
+the group has since rebalanced away from. Nothing was committed.
+*/
+type ErrStaleGeneration struct {
+	Group      string
+	Generation uint64
+}
+
+func (e ErrStaleGeneration) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("stale generation: %s/%d", e.Group, e.Generation),
+	)
+	msg := fmt.Sprintf(
+		"The group %q rebalanced after generation %d, heartbeat for the new assignment",
+		e.Group,
+		e.Generation,
+	)
+
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	stwd, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return stwd
+}
+
+func (e ErrStaleGeneration) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+/*
+ErrOutOfOrderSequence is returned for an idempotent append that skips
+sequence numbers, as when appends before it were lost. Nothing was appended.
+*/
+type ErrOutOfOrderSequence struct {
+	ProducerId string
+	Expected   uint64
+	Sequence   uint64
+}
+
+func (e ErrOutOfOrderSequence) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("out of order sequence: %s/%d", e.ProducerId, e.Sequence),
+	)
+	msg := fmt.Sprintf(
+		"Producer %q appended sequence %d, the partition expected %d",
+		e.ProducerId,
+		e.Sequence,
+		e.Expected,
+	)
+
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	stwd, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return stwd
+}
+
+func (e ErrOutOfOrderSequence) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+/*
+ErrDuplicateSequence is returned for a retry of an idempotent append
+too old for its offset to be remembered. The record is in the log.
+*/
+type ErrDuplicateSequence struct {
+	ProducerId string
+	Sequence   uint64
+}
+
+func (e ErrDuplicateSequence) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.AlreadyExists,
+		fmt.Sprintf("duplicate sequence: %s/%d", e.ProducerId, e.Sequence),
+	)
+	msg := fmt.Sprintf(
+		"Producer %q already appended sequence %d to the partition",
+		e.ProducerId,
+		e.Sequence,
+	)
+
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	stwd, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return stwd
+}
+
+func (e ErrDuplicateSequence) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+/*
+ErrTransactionNotFound is returned for a transaction that isn't open:
+never begun, already committed or aborted, or timed out.
+*/
+type ErrTransactionNotFound struct {
+	TransactionId string
+}
+
+func (e ErrTransactionNotFound) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound,
+		fmt.Sprintf("transaction not found: %s", e.TransactionId),
+	)
+	msg := fmt.Sprintf(
+		"The transaction %q isn't open on this server",
+		e.TransactionId,
+	)
+
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	stwd, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return stwd
+}
+
+func (e ErrTransactionNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
@@ -0,0 +1,66 @@
+package logcomponents
+
+import (
+	"context"
+	"sync"
+)
+
+/*
+Acks tracks how far each replica has copied the local log from the
+progress they report, so appends can wait until enough copies exist.
+Replicas that leave keep their last progress.
+*/
+type Acks struct {
+	mu      sync.Mutex
+	next    map[string]uint64 //per replica, the local offset it reads next
+	changed chan struct{}     //closed, then replaced, on every report
+}
+
+func NewAcks() *Acks {
+	return &Acks{
+		next:    make(map[string]uint64),
+		changed: make(chan struct{}),
+	}
+}
+
+//ReportProgress records that node holds the local log's records before next
+func (a *Acks) ReportProgress(node string, next uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if next <= a.next[node] {
+		return
+	}
+	a.next[node] = next
+	close(a.changed)
+	a.changed = make(chan struct{})
+}
+
+/*
+WaitForReplicas blocks until replicas nodes have reported holding off,
+or ctx is done.
+*/
+func (a *Acks) WaitForReplicas(
+	ctx context.Context,
+	off uint64,
+	replicas uint32,
+) error {
+	for {
+		a.mu.Lock()
+		var holding uint32
+		for _, next := range a.next {
+			if next > off {
+				holding++
+			}
+		}
+		changed := a.changed
+		a.mu.Unlock()
+		if holding >= replicas {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package logcomponents
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcks(t *testing.T) {
+	acks := NewAcks()
+	acks.ReportProgress("1", 3)
+
+	ctx := context.Background()
+	assert.NoError(t, acks.WaitForReplicas(ctx, 2, 1))
+
+	//Not enough replicas hold it yet
+	short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(
+		t,
+		context.DeadlineExceeded,
+		acks.WaitForReplicas(short, 2, 2),
+	)
+
+	//Progress only moves forward
+	acks.ReportProgress("1", 1)
+	assert.NoError(t, acks.WaitForReplicas(ctx, 2, 1))
+
+	done := make(chan error)
+	go func() {
+		done <- acks.WaitForReplicas(ctx, 5, 2)
+	}()
+	acks.ReportProgress("2", 6)
+	select {
+	case <-done:
+		t.Fatal("returned before a second replica held the offset")
+	case <-time.After(50 * time.Millisecond):
+	}
+	acks.ReportProgress("1", 6)
+	assert.NoError(t, <-done)
+}
@@ -0,0 +1,176 @@
+package logcomponents
+
+import (
+	"fmt"
+	"io/ioutil"
+	"logstore/internal/log/proto"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	compactDirPrefix = "compact-"
+	swapExt          = ".swap"
+)
+
+/*
+Compact rewrites closed segments keeping only the latest record per
+key. Keyless records are always kept; tombstones (a key with no value)
+are dropped once older than TombstoneRetention. Offsets are preserved,
+so compacted segments have gaps. Segments left empty are removed.
+Returns the number of records removed; a no-op unless compaction is enabled.
+*/
+func (l *Log) Compact(now time.Time) (int, error) {
+	if !l.Config.Compaction.Enabled {
+		return 0, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	latest := make(map[string]uint64)
+	for _, s := range l.segments {
+		if err := s.scan(func(r *proto.Record) error {
+			if len(r.Key) > 0 {
+				latest[string(r.Key)] = r.Offset
+			}
+			return nil
+		}); err != nil {
+			return 0, err
+		}
+	}
+
+	removed := 0
+	closed := l.segments[:len(l.segments)-1]
+	segments := make([]*segment, 0, len(l.segments))
+	for i, s := range closed {
+		var keep []*proto.Record
+		total := 0
+		err := s.scan(func(r *proto.Record) error {
+			total++
+			if l.retain(r, latest, now) {
+				keep = append(keep, r)
+			}
+			return nil
+		})
+		if err == nil && len(keep) < total {
+			removed += total - len(keep)
+			if len(keep) == 0 {
+				err = s.Remove()
+				s = nil
+			} else {
+				s, err = l.rewrite(s, keep)
+			}
+		}
+		if err != nil {
+			//Leave the log with every segment that is still open
+			if s != nil {
+				segments = append(segments, s)
+			}
+			l.segments = append(append(segments, closed[i+1:]...), l.activeSegment)
+			return removed, err
+		}
+		if s != nil {
+			segments = append(segments, s)
+		}
+	}
+	l.segments = append(segments, l.activeSegment)
+	return removed, nil
+}
+
+func (l *Log) retain(r *proto.Record, latest map[string]uint64, now time.Time) bool {
+	if len(r.Key) == 0 {
+		return true
+	}
+	if latest[string(r.Key)] != r.Offset {
+		return false
+	}
+	tombstone := len(r.Value) == 0
+	return !tombstone ||
+		now.Sub(time.Unix(0, r.Timestamp)) <= l.Config.Compaction.TombstoneRetention
+}
+
+/*
+rewrite replaces s with a segment holding only keep. The new files are
+built in a temporary directory, which is renamed to <base>.swap once
+complete; setup finishes any swap interrupted by a crash.
+*/
+func (l *Log) rewrite(s *segment, keep []*proto.Record) (*segment, error) {
+	tmp, err := ioutil.TempDir(l.Dir, compactDirPrefix)
+	if err != nil {
+		return s, err
+	}
+	defer os.RemoveAll(tmp)
+
+	c, err := newSegment(tmp, s.baseOffset, l.Config)
+	if err != nil {
+		return s, err
+	}
+	for _, r := range keep {
+		if err = c.write(r); err != nil {
+			c.Close()
+			return s, err
+		}
+	}
+	c.meta.copyFrom(s.meta)
+	if err = c.Close(); err != nil {
+		return s, err
+	}
+
+	if err = s.Close(); err != nil {
+		return s, err
+	}
+	swap := path.Join(l.Dir, fmt.Sprintf("%d%s", s.baseOffset, swapExt))
+	if err = os.Rename(tmp, swap); err != nil {
+		return nil, err
+	}
+	if err = completeSwap(l.Dir, swap); err != nil {
+		return nil, err
+	}
+	return newSegment(l.Dir, s.baseOffset, l.Config)
+}
+
+//completeSwap moves a compacted segment's files over the originals
+func completeSwap(dir, swap string) error {
+	files, err := ioutil.ReadDir(swap)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err = os.Rename(
+			path.Join(swap, file.Name()),
+			path.Join(dir, file.Name()),
+		); err != nil {
+			return err
+		}
+	}
+	return os.Remove(swap)
+}
+
+/*
+cleanCompaction finishes swaps and discards half-built segments left
+behind by a crash during compaction.
+*/
+func cleanCompaction(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+		p := path.Join(dir, file.Name())
+		switch {
+		case path.Ext(file.Name()) == swapExt:
+			err = completeSwap(dir, p)
+		case strings.HasPrefix(file.Name(), compactDirPrefix):
+			err = os.RemoveAll(p)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package logcomponents
+
+import (
+	"io/ioutil"
+	prolog "logstore/internal/log/proto"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-compaction-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 100
+	c.Compaction.Enabled = true
+	c.Compaction.TombstoneRetention = time.Hour
+	log, err := NewLog(dir, c)
+	assert.NoError(t, err)
+
+	records := []*prolog.Record{
+		{Key: []byte("k1"), Value: []byte("v1")},
+		{Key: []byte("k2"), Value: []byte("v1")},
+		{Value: []byte("no key")},
+		{Key: []byte("k1"), Value: []byte("v2")},
+		{Key: []byte("k2")}, //tombstone
+		{Key: []byte("k3"), Value: []byte("v1")},
+		{Key: []byte("k1"), Value: []byte("v3")},
+		{Value: []byte("no key")},
+		{Key: []byte("k3"), Value: []byte("v2")},
+		{Key: []byte("k4"), Value: []byte("v1")},
+	}
+	for _, r := range records {
+		_, err := log.Append(r)
+		assert.NoError(t, err)
+	}
+	assert.True(t, len(log.segments) > 2)
+	active := log.activeSegment.baseOffset
+
+	//Offsets expected to survive each pass, before the active segment
+	check := func(log *Log, survivors map[uint64]bool) {
+		for off, r := range records {
+			read, err := log.Read(uint64(off))
+			if uint64(off) >= active || survivors[uint64(off)] {
+				assert.NoError(t, err)
+				assert.Equal(t, uint64(off), read.Offset)
+				assert.Equal(t, r.Value, read.Value)
+				continue
+			}
+			//Holes read as not present, whole segments dropped from the front as out of range
+			lowest, _ := log.LowestOffset()
+			if uint64(off) < lowest {
+				assert.Equal(t, prolog.ErrOffOutOfRange{Offset: uint64(off)}, err)
+			} else {
+				assert.Equal(t, prolog.ErrOffNotPresent{Offset: uint64(off)}, err)
+			}
+		}
+		//Ranged reads step over the holes
+		lowest, _ := log.LowestOffset()
+		page, _, err := log.ReadRange(lowest, 0, 0)
+		assert.NoError(t, err)
+		var got []uint64
+		for _, r := range page {
+			got = append(got, r.Offset)
+		}
+		var want []uint64
+		for off := lowest; off < uint64(len(records)); off++ {
+			if off >= active || survivors[off] {
+				want = append(want, off)
+			}
+		}
+		assert.Equal(t, want, got)
+	}
+
+	now := time.Now()
+	removed, err := log.Compact(now)
+	assert.NoError(t, err)
+	survivors := map[uint64]bool{2: true, 4: true, 6: true, 7: true, 8: true, 9: true}
+	check(log, survivors)
+	assert.Equal(t, 4, removed)
+
+	//Tombstones go once they are old enough
+	removed, err = log.Compact(now.Add(2 * time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	delete(survivors, 4)
+	check(log, survivors)
+
+	//Gaps and offsets survive a restart
+	assert.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	assert.NoError(t, err)
+	check(log, survivors)
+	off, err := log.Append(&prolog.Record{Value: []byte("next")})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(len(records)), off)
+}
+
+func TestCompactionInterruptedSwap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-swap-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	//A half-built rewrite is discarded, a finished one is moved into place
+	assert.NoError(t, os.Mkdir(dir+"/"+compactDirPrefix+"1", 0755))
+	assert.NoError(t, os.Mkdir(dir+"/0"+swapExt, 0755))
+	assert.NoError(t, ioutil.WriteFile(dir+"/0"+swapExt+"/0.store", nil, 0644))
+
+	_, err = NewLog(dir, Config{})
+	assert.NoError(t, err)
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	for _, file := range files {
+		assert.False(t, file.IsDir(), file.Name())
+	}
+	_, err = os.Stat(dir + "/0.store")
+	assert.NoError(t, err)
+}
@@ -1,9 +1,71 @@
 package logcomponents
 
+import (
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
 type Config struct {
 	Segment struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
+		//IndexIntervalBytes of store data are written between time index entries
+		IndexIntervalBytes uint64
+	}
+	Durability Durability
+	Retention  Retention
+	Compaction Compaction
+	//Raft configures a DistributedLog, plain logs ignore it
+	Raft struct {
+		raft.Config
+		StreamLayer *StreamLayer
+		Bootstrap   bool
+		//Offsets, when set, keeps the offsets consumer groups commit through
+		//the DistributedLog, which Raft replicates to every server with the log
+		Offsets OffsetStore
 	}
 }
+
+/*
+Durability controls when appended records reach stable storage.
+- DurabilityNone (the zero value behaves the same): records sit in the store's write buffer until a read or Close flushes them
+- DurabilityFlush: every append is flushed to the OS, surviving a process crash
+- DurabilityPeriodic: fsync every SyncEvery records and/or every SyncInterval
+- DurabilitySync: fsync before Append returns, surviving a machine crash
+*/
+type Durability struct {
+	Mode         DurabilityMode
+	SyncEvery    uint64
+	SyncInterval time.Duration
+}
+
+type DurabilityMode string
+
+const (
+	DurabilityNone     DurabilityMode = "none"
+	DurabilityFlush    DurabilityMode = "flush"
+	DurabilityPeriodic DurabilityMode = "periodic"
+	DurabilitySync     DurabilityMode = "sync"
+)
+
+/*
+Retention bounds how much history the log keeps. Whole segments are
+dropped, oldest first, once their last append is older than MaxAge or
+while the log holds more than MaxBytes of records. Zero disables a bound.
+*/
+type Retention struct {
+	MaxAge   time.Duration
+	MaxBytes uint64
+}
+
+/*
+Compaction turns the log into a changelog: closed segments are rewritten
+to keep only the latest record per key, and tombstones are removed once
+older than TombstoneRetention.
+*/
+type Compaction struct {
+	Enabled            bool
+	TombstoneRetention time.Duration
+}
@@ -0,0 +1,922 @@
+package logcomponents
+
+import (
+	"context"
+	"fmt"
+	"io"
+	prolog "logstore/internal/log/proto"
+	"logstore/internal/mux"
+	"math"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+DistributedLog replicates a Log through Raft. Appends go through the
+leader and return once a quorum has committed them; reads are served
+from the local log and may lag the leader.
+*/
+type DistributedLog struct {
+	config  Config
+	log     *Log
+	raftLog *logStore
+	stable  *raftboltdb.BoltStore
+	fsm     *fsm
+	raft    *raft.Raft
+	matched *Acks //per follower, the Raft index it holds entries before
+}
+
+/*
+NewDistributedLog wraps log, the Raft state machine, keeping Raft's own
+log, stable store and snapshots under dataDir.
+*/
+func NewDistributedLog(log *Log, dataDir string, config Config) (
+	*DistributedLog,
+	error,
+) {
+	l := &DistributedLog{
+		config:  config,
+		log:     log,
+		matched: NewAcks(),
+	}
+	return l, l.setupRaft(dataDir)
+}
+
+func (l *DistributedLog) setupRaft(dataDir string) error {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return err
+	}
+	var err error
+	if l.fsm, err = newFSM(l.log, path.Join(dataDir, "applied")); err != nil {
+		return err
+	}
+	l.fsm.offsets = l.config.Raft.Offsets
+
+	//Raft indexes start at 1, the log store's offsets have to match
+	logConfig := Config{}
+	logConfig.Segment = l.config.Segment
+	logConfig.Segment.InitialOffset = 1
+	//Raft counts an entry committed once a quorum has stored it, so every
+	//stored entry must survive a crash whatever the data log's policy
+	logConfig.Durability = Durability{Mode: DurabilitySync}
+	if l.raftLog, err = newLogStore(path.Join(dataDir, "log"), logConfig); err != nil {
+		return err
+	}
+	if l.stable, err = raftboltdb.NewBoltStore(path.Join(dataDir, "stable")); err != nil {
+		return err
+	}
+	retain := 1
+	snapshotStore, err := raft.NewFileSnapshotStore(
+		path.Join(dataDir, "snapshots"),
+		retain,
+		os.Stderr,
+	)
+	if err != nil {
+		return err
+	}
+	maxPool := 5
+	timeout := 10 * time.Second
+	transport := &progressTransport{
+		NetworkTransport: raft.NewNetworkTransport(
+			l.config.Raft.StreamLayer,
+			maxPool,
+			timeout,
+			os.Stderr,
+		),
+		matched: l.matched,
+	}
+
+	config := raft.DefaultConfig()
+	config.LocalID = l.config.Raft.LocalID
+	if l.config.Raft.HeartbeatTimeout != 0 {
+		config.HeartbeatTimeout = l.config.Raft.HeartbeatTimeout
+	}
+	if l.config.Raft.ElectionTimeout != 0 {
+		config.ElectionTimeout = l.config.Raft.ElectionTimeout
+	}
+	if l.config.Raft.LeaderLeaseTimeout != 0 {
+		config.LeaderLeaseTimeout = l.config.Raft.LeaderLeaseTimeout
+	}
+	if l.config.Raft.CommitTimeout != 0 {
+		config.CommitTimeout = l.config.Raft.CommitTimeout
+	}
+	if l.config.Raft.TrailingLogs != 0 {
+		config.TrailingLogs = l.config.Raft.TrailingLogs
+	}
+
+	l.raft, err = raft.NewRaft(
+		config,
+		l.fsm,
+		l.raftLog,
+		l.stable,
+		snapshotStore,
+		transport,
+	)
+	if err != nil {
+		return err
+	}
+	hasState, err := raft.HasExistingState(l.raftLog, l.stable, snapshotStore)
+	if err != nil {
+		return err
+	}
+	if l.config.Raft.Bootstrap && !hasState {
+		err = l.raft.BootstrapCluster(raft.Configuration{
+			Servers: []raft.Server{{
+				ID:      config.LocalID,
+				Address: transport.LocalAddr(),
+			}},
+		}).Error()
+	}
+	return err
+}
+
+/*
+Append replicates a record through Raft. The leader stamps it here, so
+every replica stores the same timestamp rather than its own clock's.
+*/
+func (l *DistributedLog) Append(record *prolog.Record) (uint64, error) {
+	record.Timestamp = time.Now().UnixNano()
+	res, err := l.apply(
+		appendRequestType,
+		&prolog.AppendRequest{Record: record},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.(*prolog.AppendResponse).Offset, nil
+}
+
+func (l *DistributedLog) AppendBatch(records []*prolog.Record) (uint64, error) {
+	now := time.Now().UnixNano()
+	for _, record := range records {
+		record.Timestamp = now
+	}
+	res, err := l.apply(
+		batchRequestType,
+		&prolog.ProduceBatchRequest{Records: records},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.(*prolog.ProduceBatchResponse).BaseOffset, nil
+}
+
+//apply commits a request to the Raft log and returns what the FSM made of it
+func (l *DistributedLog) apply(reqType requestType, req proto.Message) (
+	interface{},
+	error,
+) {
+	b, err := encodeRequest(reqType, req)
+	if err != nil {
+		return nil, err
+	}
+	timeout := 10 * time.Second
+	future := l.raft.Apply(b, timeout)
+	if err := future.Error(); err == raft.ErrNotLeader {
+		return nil, prolog.ErrNotLeader{}
+	} else if err != nil {
+		return nil, err
+	}
+	res := future.Response()
+	if err, ok := res.(error); ok {
+		return nil, err
+	}
+	return res, nil
+}
+
+/*
+CommitOffset replicates a consumer group's commit, a record keyed by the
+group, topic and partition, to the Config.Raft.Offsets of every server.
+Only the leader can commit, everyone else gets ErrNotLeader.
+*/
+func (l *DistributedLog) CommitOffset(record *prolog.Record) error {
+	_, err := l.apply(offsetRequestType, record)
+	return err
+}
+
+//encodeRequest frames a request for the Raft log: its type byte, then the protobuf
+func encodeRequest(reqType requestType, req proto.Message) ([]byte, error) {
+	b, err := proto.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{byte(reqType)}, b...), nil
+}
+
+func (l *DistributedLog) Read(off uint64) (*prolog.Record, error) {
+	return l.log.Read(off)
+}
+
+func (l *DistributedLog) ReadRange(from, maxRecords, maxBytes uint64) (
+	[]*prolog.Record,
+	uint64,
+	error,
+) {
+	return l.log.ReadRange(from, maxRecords, maxBytes)
+}
+
+func (l *DistributedLog) WaitForOffset(ctx context.Context, off uint64) error {
+	return l.log.WaitForOffset(ctx, off)
+}
+
+func (l *DistributedLog) ReadCommitted(from, maxRecords, maxBytes uint64) (
+	[]*prolog.Record,
+	uint64,
+	error,
+) {
+	return l.log.ReadCommitted(from, maxRecords, maxBytes)
+}
+
+func (l *DistributedLog) WaitForCommitted(ctx context.Context, off uint64) error {
+	return l.log.WaitForCommitted(ctx, off)
+}
+
+/*
+OpenTransactions returns the transactions open in the replicated log
+once the leader has applied everything committed before the call.
+Every server holds the same ones, only the leader can end them.
+*/
+func (l *DistributedLog) OpenTransactions() ([]string, error) {
+	if err := l.raft.Barrier(10 * time.Second).Error(); err == raft.ErrNotLeader {
+		return nil, prolog.ErrNotLeader{}
+	} else if err != nil {
+		return nil, err
+	}
+	return l.log.OpenTransactions(), nil
+}
+
+func (l *DistributedLog) OffsetForTime(t time.Time) (uint64, error) {
+	return l.log.OffsetForTime(t)
+}
+
+/*
+LeaderCh signals true whenever this server gains leadership and false
+whenever it loses it, holding only the latest change for one reader.
+*/
+func (l *DistributedLog) LeaderCh() <-chan bool {
+	return l.raft.LeaderCh()
+}
+
+/*
+WaitForReplicas confirms appends for acks=all, blocking until replicas
+voters besides this server have replicated off or ctx is done. Raft
+entries don't map back to offsets, so it waits for everything applied
+so far, which includes off once Append has returned.
+*/
+func (l *DistributedLog) WaitForReplicas(
+	ctx context.Context,
+	off uint64,
+	replicas uint32,
+) error {
+	index := l.raft.AppliedIndex()
+	for {
+		future := l.raft.GetConfiguration()
+		if err := future.Error(); err != nil {
+			return err
+		}
+		var voters []string
+		for _, server := range future.Configuration().Servers {
+			if server.Suffrage == raft.Voter &&
+				server.ID != l.config.Raft.LocalID {
+				voters = append(voters, string(server.ID))
+			}
+		}
+		if replicas > uint32(len(voters)) {
+			return fmt.Errorf(
+				"only %d voters can replicate, not %d",
+				len(voters),
+				replicas,
+			)
+		}
+		l.matched.mu.Lock()
+		var holding uint32
+		for _, id := range voters {
+			if l.matched.next[id] > index {
+				holding++
+			}
+		}
+		changed := l.matched.changed
+		l.matched.mu.Unlock()
+		if holding >= replicas {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+//ReportProgress ignores progress reports, Raft tracks its own followers
+func (l *DistributedLog) ReportProgress(node string, next uint64) {}
+
+//Leader returns the RPC address of the cluster's leader, empty when there is none
+func (l *DistributedLog) Leader() string {
+	return string(l.raft.Leader())
+}
+
+/*
+Join adds the server as a voter. Only the leader can change the
+cluster, everyone else gets raft.ErrNotLeader.
+*/
+func (l *DistributedLog) Join(id, addr string) error {
+	configFuture := l.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return err
+	}
+	serverID := raft.ServerID(id)
+	serverAddr := raft.ServerAddress(addr)
+	for _, srv := range configFuture.Configuration().Servers {
+		if srv.ID == serverID || srv.Address == serverAddr {
+			if srv.ID == serverID && srv.Address == serverAddr {
+				return nil //already a member
+			}
+			//Stale entry for the same server, drop it before re-adding
+			if err := l.raft.RemoveServer(srv.ID, 0, 0).Error(); err != nil {
+				return err
+			}
+		}
+	}
+	return l.raft.AddVoter(serverID, serverAddr, 0, 0).Error()
+}
+
+func (l *DistributedLog) Leave(id string) error {
+	return l.raft.RemoveServer(raft.ServerID(id), 0, 0).Error()
+}
+
+//WaitForLeader blocks until the cluster has elected a leader or timeout passes
+func (l *DistributedLog) WaitForLeader(timeout time.Duration) error {
+	timeoutc := time.After(timeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-timeoutc:
+			return fmt.Errorf("timed out waiting for a leader")
+		case <-ticker.C:
+			if leader := l.raft.Leader(); leader != "" {
+				return nil
+			}
+		}
+	}
+}
+
+/*
+Close shuts Raft down and closes its stores. The wrapped log is left
+open for its owner to close.
+*/
+func (l *DistributedLog) Close() error {
+	if err := l.raft.Shutdown().Error(); err != nil {
+		return err
+	}
+	if err := l.raftLog.Close(); err != nil {
+		return err
+	}
+	if err := l.stable.Close(); err != nil {
+		return err
+	}
+	return l.fsm.Close()
+}
+
+type requestType uint8
+
+const (
+	appendRequestType requestType = 0
+	batchRequestType  requestType = 1
+	offsetRequestType requestType = 2
+)
+
+/*
+OffsetStore keeps the offsets consumer groups commit as records, the
+latest per key, beside a DistributedLog. The FSM applies each commit
+Raft replicates to it, and snapshots carry them all.
+*/
+type OffsetStore interface {
+	Apply(record *prolog.Record) error
+	//Records returns the latest commit for every key
+	Records() []*prolog.Record
+	//Restore replaces every commit with records
+	Restore(records []*prolog.Record) error
+	Sync() error
+}
+
+var _ raft.FSM = (*fsm)(nil)
+
+/*
+fsm applies committed requests to the log, and offset commits to the
+offsets when there are any. Raft replays entries after the latest
+snapshot when it starts, and the log already holds those that were
+applied before a restart, so the last applied index is kept on disk to
+skip them.
+*/
+type fsm struct {
+	log     *Log
+	offsets OffsetStore
+	applied *os.File
+	last    uint64 //index of the last entry applied
+}
+
+func newFSM(log *Log, name string) (*fsm, error) {
+	f := &fsm{log: log}
+	var err error
+	f.applied, err = os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, lenWidth)
+	if n, _ := f.applied.ReadAt(b, 0); n == len(b) {
+		f.last = enc.Uint64(b)
+	}
+	return f, nil
+}
+
+func (f *fsm) Apply(record *raft.Log) interface{} {
+	if record.Index <= f.last {
+		return nil
+	}
+	var res interface{}
+	buf := record.Data
+	switch requestType(buf[0]) {
+	case appendRequestType:
+		res = f.applyAppend(buf[1:])
+	case batchRequestType:
+		res = f.applyBatch(buf[1:])
+	case offsetRequestType:
+		res = f.applyOffset(buf[1:])
+	}
+	//the records must be on disk before the index that skips them is
+	if err := f.log.Sync(); err != nil {
+		return err
+	}
+	if err := f.setLast(record.Index); err != nil {
+		return err
+	}
+	return res
+}
+
+func (f *fsm) applyAppend(b []byte) interface{} {
+	var req prolog.AppendRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	off, err := f.log.appendStamped(req.Record)
+	if err != nil {
+		return err
+	}
+	return &prolog.AppendResponse{Offset: off}
+}
+
+func (f *fsm) applyBatch(b []byte) interface{} {
+	var req prolog.ProduceBatchRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	base, err := f.log.appendBatchStamped(req.Records)
+	if err != nil {
+		return err
+	}
+	return &prolog.ProduceBatchResponse{
+		BaseOffset: base,
+		Count:      uint64(len(req.Records)),
+	}
+}
+
+func (f *fsm) applyOffset(b []byte) interface{} {
+	if f.offsets == nil {
+		return nil
+	}
+	var record prolog.Record
+	if err := proto.Unmarshal(b, &record); err != nil {
+		return err
+	}
+	if err := f.offsets.Apply(&record); err != nil {
+		return err
+	}
+	//on disk before Apply counts the entry applied, as records are
+	if err := f.offsets.Sync(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (f *fsm) setLast(index uint64) error {
+	f.last = index
+	b := make([]byte, lenWidth)
+	enc.PutUint64(b, index)
+	if _, err := f.applied.WriteAt(b, 0); err != nil {
+		return err
+	}
+	return f.applied.Sync()
+}
+
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	var offsets []*prolog.Record
+	if f.offsets != nil {
+		offsets = f.offsets.Records()
+	}
+	f.log.mu.RLock()
+	defer f.log.mu.RUnlock()
+	return &snapshot{
+		log:     f.log,
+		from:    f.log.segments[0].baseOffset,
+		next:    f.log.activeSegment.nextOffset,
+		offsets: offsets,
+	}, nil
+}
+
+/*
+Restore replaces the log with a snapshot's records, keeping their
+offsets and timestamps, and the offsets with its commits. Raft applies
+the entries after the snapshot next, so none of them count as applied.
+*/
+func (f *fsm) Restore(r io.ReadCloser) error {
+	defer r.Close()
+	b := make([]byte, lenWidth)
+	reset := false
+	var offsets []*prolog.Record
+	commits := false //past the records, reading offset commits
+	for {
+		_, err := io.ReadFull(r, b)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if enc.Uint64(b) == offsetsMark {
+			commits = true
+			continue
+		}
+		p := make([]byte, enc.Uint64(b))
+		if _, err = io.ReadFull(r, p); err != nil {
+			return err
+		}
+		record := &prolog.Record{}
+		if err = proto.Unmarshal(p, record); err != nil {
+			return err
+		}
+		if commits {
+			offsets = append(offsets, record)
+			continue
+		}
+		if !reset {
+			f.log.Config.Segment.InitialOffset = record.Offset
+			if err = f.log.Reset(); err != nil {
+				return err
+			}
+			reset = true
+		}
+		if err = f.log.appendAt(record); err != nil {
+			return err
+		}
+	}
+	if !reset {
+		if err := f.log.Reset(); err != nil {
+			return err
+		}
+	}
+	if f.offsets != nil {
+		if err := f.offsets.Restore(offsets); err != nil {
+			return err
+		}
+	}
+	return f.setLast(0)
+}
+
+func (f *fsm) Close() error {
+	return f.applied.Close()
+}
+
+var _ raft.FSMSnapshot = (*snapshot)(nil)
+
+/*
+snapshot writes the records in [from, next) as length prefixed
+protobufs, then offsetsMark and the offset commits the same way. Raft
+persists it while appends carry on, so the range and the commits are
+fixed when the snapshot is taken.
+*/
+type snapshot struct {
+	log        *Log
+	from, next uint64
+	offsets    []*prolog.Record
+}
+
+//offsetsMark stands in a snapshot for a length, where its records end
+const offsetsMark = math.MaxUint64
+
+func (s *snapshot) Persist(sink raft.SnapshotSink) error {
+	if err := s.persist(sink); err != nil {
+		_ = sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *snapshot) persist(w io.Writer) error {
+	if err := s.persistRecords(w); err != nil {
+		return err
+	}
+	b := make([]byte, lenWidth)
+	enc.PutUint64(b, offsetsMark)
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+	for _, record := range s.offsets {
+		if err := writeRecord(w, record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *snapshot) persistRecords(w io.Writer) error {
+	for from := s.from; from < s.next; {
+		records, next, err := s.log.ReadRange(from, 0, 1<<20)
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			return nil
+		}
+		for _, record := range records {
+			if record.Offset >= s.next {
+				return nil
+			}
+			if err = writeRecord(w, record); err != nil {
+				return err
+			}
+		}
+		from = next
+	}
+	return nil
+}
+
+//writeRecord writes record to a snapshot, prefixed with its length
+func writeRecord(w io.Writer, record *prolog.Record) error {
+	p, err := proto.Marshal(record)
+	if err != nil {
+		return err
+	}
+	b := make([]byte, lenWidth)
+	enc.PutUint64(b, uint64(len(p)))
+	if _, err = w.Write(b); err != nil {
+		return err
+	}
+	_, err = w.Write(p)
+	return err
+}
+
+func (s *snapshot) Release() {}
+
+var _ raft.LogStore = (*logStore)(nil)
+
+//logStore keeps Raft's log in a Log, one record per entry at offset == index
+type logStore struct {
+	*Log
+}
+
+func newLogStore(dir string, c Config) (*logStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	log, err := NewLog(dir, c)
+	if err != nil {
+		return nil, err
+	}
+	return &logStore{log}, nil
+}
+
+func (l *logStore) FirstIndex() (uint64, error) {
+	return l.LowestOffset()
+}
+
+func (l *logStore) LastIndex() (uint64, error) {
+	return l.HighestOffset()
+}
+
+func (l *logStore) GetLog(index uint64, out *raft.Log) error {
+	in, err := l.Read(index)
+	switch err.(type) {
+	case nil:
+	case prolog.ErrOffOutOfRange, prolog.ErrOffNotPresent:
+		return raft.ErrLogNotFound
+	default:
+		return err
+	}
+	out.Data = in.Value
+	out.Index = in.Offset
+	out.Type = raft.LogType(in.Type)
+	out.Term = in.Term
+	return nil
+}
+
+func (l *logStore) StoreLog(record *raft.Log) error {
+	return l.StoreLogs([]*raft.Log{record})
+}
+
+/*
+StoreLogs appends entries at their indexes. After installing a snapshot
+a follower is sent the entries following it, past the end of its log,
+so the log starts over at the first of them, as an emptied log does;
+the snapshot holds the entries before.
+*/
+func (l *logStore) StoreLogs(records []*raft.Log) error {
+	if len(records) > 0 {
+		next := l.nextOffset()
+		if index := records[0].Index; index > next || index < next && l.empty() {
+			if err := l.resetAt(index); err != nil {
+				return err
+			}
+		}
+	}
+	batch := make([]*prolog.Record, len(records))
+	for i, record := range records {
+		batch[i] = &prolog.Record{
+			Value: record.Data,
+			Term:  record.Term,
+			Type:  uint32(record.Type),
+		}
+	}
+	base, err := l.AppendBatch(batch)
+	if err != nil {
+		return err
+	}
+	if len(records) > 0 && base != records[0].Index {
+		return fmt.Errorf(
+			"raft index %d stored at offset %d",
+			records[0].Index,
+			base,
+		)
+	}
+	return nil
+}
+
+/*
+DeleteRange removes entries min through max. Raft deletes from the
+front after a snapshot, and from the back when a follower's tail
+conflicts with the leader's. Deleting every entry leaves the log empty
+after max, which StoreLogs restarts from wherever the next entry is.
+*/
+func (l *logStore) DeleteRange(min, max uint64) error {
+	first, err := l.FirstIndex()
+	if err != nil {
+		return err
+	}
+	last, err := l.LastIndex()
+	if err != nil {
+		return err
+	}
+	if min > first {
+		return l.truncateTail(min)
+	}
+	if max >= last {
+		return l.resetAt(max + 1)
+	}
+	return l.Truncate(max)
+}
+
+//resetAt empties the log, the next entry to be stored at index
+func (l *logStore) resetAt(index uint64) error {
+	l.Config.Segment.InitialOffset = index
+	return l.Reset()
+}
+
+/*
+progressTransport records how far each follower's log matches the
+leader's from its AppendEntries replies, which Raft keeps to itself.
+Pipelined replies pass through a progressPipeline on their way to Raft.
+*/
+type progressTransport struct {
+	*raft.NetworkTransport
+	matched *Acks
+}
+
+func (t *progressTransport) AppendEntriesPipeline(
+	id raft.ServerID,
+	target raft.ServerAddress,
+) (raft.AppendPipeline, error) {
+	pipeline, err := t.NetworkTransport.AppendEntriesPipeline(id, target)
+	if err != nil {
+		return nil, err
+	}
+	return newProgressPipeline(pipeline, func(future raft.AppendFuture) {
+		t.report(id, future.Request(), future.Response())
+	}), nil
+}
+
+func (t *progressTransport) AppendEntries(
+	id raft.ServerID,
+	target raft.ServerAddress,
+	args *raft.AppendEntriesRequest,
+	resp *raft.AppendEntriesResponse,
+) error {
+	if err := t.NetworkTransport.AppendEntries(id, target, args, resp); err != nil {
+		return err
+	}
+	t.report(id, args, resp)
+	return nil
+}
+
+//report records the follower holding the entries a successful reply confirms
+func (t *progressTransport) report(
+	id raft.ServerID,
+	args *raft.AppendEntriesRequest,
+	resp *raft.AppendEntriesResponse,
+) {
+	if resp.Success {
+		match := args.PrevLogEntry + uint64(len(args.Entries))
+		t.matched.ReportProgress(string(id), match+1)
+	}
+}
+
+/*
+progressPipeline hands each reply of a pipeline to report before Raft
+consumes it, relaying them in order until the pipeline is closed.
+*/
+type progressPipeline struct {
+	raft.AppendPipeline
+	report   func(raft.AppendFuture)
+	consumer chan raft.AppendFuture
+	once     sync.Once
+	closed   chan struct{}
+}
+
+func newProgressPipeline(
+	pipeline raft.AppendPipeline,
+	report func(raft.AppendFuture),
+) *progressPipeline {
+	p := &progressPipeline{
+		AppendPipeline: pipeline,
+		report:         report,
+		consumer:       make(chan raft.AppendFuture),
+		closed:         make(chan struct{}),
+	}
+	go p.relay()
+	return p
+}
+
+func (p *progressPipeline) relay() {
+	for {
+		select {
+		case future := <-p.AppendPipeline.Consumer():
+			if future.Error() == nil {
+				p.report(future)
+			}
+			select {
+			case p.consumer <- future:
+			case <-p.closed:
+				return
+			}
+		case <-p.closed:
+			return
+		}
+	}
+}
+
+func (p *progressPipeline) Consumer() <-chan raft.AppendFuture {
+	return p.consumer
+}
+
+func (p *progressPipeline) Close() error {
+	p.once.Do(func() { close(p.closed) })
+	return p.AppendPipeline.Close()
+}
+
+/*
+RaftRPC is the first byte written on Raft connections, telling them
+apart from gRPC ones on the shared port.
+*/
+const RaftRPC = 1
+
+var _ raft.StreamLayer = (*StreamLayer)(nil)
+
+/*
+StreamLayer carries Raft's transport over a route of the agent's
+multiplexed listener, which strips the RaftRPC byte and handles TLS.
+*/
+type StreamLayer struct {
+	net.Listener
+	route mux.Route
+}
+
+func NewStreamLayer(ln net.Listener, route mux.Route) *StreamLayer {
+	return &StreamLayer{
+		Listener: ln,
+		route:    route,
+	}
+}
+
+func (s *StreamLayer) Dial(
+	addr raft.ServerAddress,
+	timeout time.Duration,
+) (net.Conn, error) {
+	return s.route.Dial(string(addr), timeout)
+}
@@ -0,0 +1,379 @@
+package logcomponents
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	prolog "logstore/internal/log/proto"
+	"logstore/internal/mux"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-store-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.Segment.InitialOffset = 1
+	store, err := newLogStore(dir, c)
+	assert.NoError(t, err)
+
+	var entries []*raft.Log
+	for i := uint64(1); i <= 6; i++ {
+		entries = append(entries, &raft.Log{
+			Index: i,
+			Term:  1,
+			Type:  raft.LogCommand,
+			Data:  []byte("entry"),
+		})
+	}
+	assert.NoError(t, store.StoreLogs(entries))
+
+	first, err := store.FirstIndex()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), first)
+	last, err := store.LastIndex()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(6), last)
+
+	var out raft.Log
+	assert.NoError(t, store.GetLog(3, &out))
+	assert.Equal(t, *entries[2], out)
+	assert.Equal(t, raft.ErrLogNotFound, store.GetLog(7, &out))
+
+	//A conflicting tail is replaced from where it diverges
+	assert.NoError(t, store.DeleteRange(4, 6))
+	last, err = store.LastIndex()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), last)
+	assert.Equal(t, raft.ErrLogNotFound, store.GetLog(4, &out))
+	assert.NoError(t, store.StoreLog(&raft.Log{
+		Index: 4,
+		Term:  2,
+		Type:  raft.LogCommand,
+		Data:  []byte("leader"),
+	}))
+	assert.NoError(t, store.GetLog(4, &out))
+	assert.Equal(t, uint64(2), out.Term)
+
+	//Entries before a snapshot go from the front, whole segments at a time
+	assert.NoError(t, store.DeleteRange(1, 3))
+	first, err = store.FirstIndex()
+	assert.NoError(t, err)
+	assert.True(t, first > 1 && first <= 4)
+
+	//Deleting every entry keeps where the next one goes
+	assert.NoError(t, store.DeleteRange(first, 4))
+	last, err = store.LastIndex()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4), last)
+	assert.NoError(t, store.StoreLog(&raft.Log{
+		Index: 5,
+		Term:  2,
+		Type:  raft.LogCommand,
+		Data:  []byte("leader"),
+	}))
+	assert.NoError(t, store.GetLog(5, &out))
+	assert.Equal(t, uint64(5), out.Index)
+	assert.NoError(t, store.Close())
+}
+
+func TestFSMSnapshotRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsm-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "log"), 0755))
+	log, err := NewLog(path.Join(dir, "log"), c)
+	assert.NoError(t, err)
+	f, err := newFSM(log, path.Join(dir, "applied"))
+	assert.NoError(t, err)
+
+	apply := func(index uint64, value string) interface{} {
+		//the leader's timestamp, which every replica keeps
+		req := &prolog.AppendRequest{Record: &prolog.Record{
+			Value:     []byte(value),
+			Timestamp: int64(index),
+		}}
+		data, err := encodeRequest(appendRequestType, req)
+		assert.NoError(t, err)
+		return f.Apply(&raft.Log{Index: index, Data: data})
+	}
+	for i, value := range []string{"uno", "dos", "tres"} {
+		res := apply(uint64(i+1), value)
+		assert.Equal(t, uint64(i), res.(*prolog.AppendResponse).Offset)
+	}
+	//Entries replayed after a restart are already in the log
+	assert.NoError(t, f.Close())
+	f, err = newFSM(log, path.Join(dir, "applied"))
+	assert.NoError(t, err)
+	assert.Nil(t, apply(3, "tres"))
+
+	snap, err := f.Snapshot()
+	assert.NoError(t, err)
+	var buf bytes.Buffer
+	assert.NoError(t, snap.(*snapshot).persist(&buf))
+
+	//Restoring drops what came after the snapshot, keeping offsets
+	res := apply(4, "cuatro")
+	assert.Equal(t, uint64(3), res.(*prolog.AppendResponse).Offset)
+	assert.NoError(t, f.Restore(ioutil.NopCloser(&buf)))
+	highest, err := log.HighestOffset()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), highest)
+	for i, value := range []string{"uno", "dos", "tres"} {
+		record, err := log.Read(uint64(i))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(value), record.Value)
+		assert.Equal(t, int64(i+1), record.Timestamp)
+	}
+	//and counts none of Raft's entries as applied
+	res = apply(4, "cuatro")
+	assert.Equal(t, uint64(3), res.(*prolog.AppendResponse).Offset)
+	assert.NoError(t, f.Close())
+	assert.NoError(t, log.Close())
+}
+
+func TestDistributedLogJoinAfterSnapshot(t *testing.T) {
+	newNode := func(id int) *DistributedLog {
+		dataDir, err := ioutil.TempDir("", "distributed-log-test")
+		assert.NoError(t, err)
+		t.Cleanup(func() { os.RemoveAll(dataDir) })
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		m := mux.New(ln)
+		route := mux.Route{Prefix: []byte{RaftRPC}}
+		c := Config{}
+		//small segments, for the Raft log to drop entries after snapshots
+		c.Segment.MaxStoreBytes = 64
+		c.Raft.StreamLayer = NewStreamLayer(m.Listen(route), route)
+		go m.Serve()
+		c.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", id))
+		c.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		c.Raft.ElectionTimeout = 50 * time.Millisecond
+		c.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		c.Raft.CommitTimeout = 5 * time.Millisecond
+		c.Raft.TrailingLogs = 1
+		c.Raft.Bootstrap = id == 0
+		c.Raft.Offsets = &offsetStore{committed: map[string]string{}}
+
+		logDir := path.Join(dataDir, "log")
+		assert.NoError(t, os.MkdirAll(logDir, 0755))
+		log, err := NewLog(logDir, c)
+		assert.NoError(t, err)
+		l, err := NewDistributedLog(log, path.Join(dataDir, "raft"), c)
+		assert.NoError(t, err)
+		t.Cleanup(func() {
+			l.Close()
+			log.Close()
+			m.Close()
+		})
+		if id == 0 {
+			assert.NoError(t, l.WaitForLeader(3*time.Second))
+		}
+		return l
+	}
+	//replicated waits until l serves value at off
+	replicated := func(l *DistributedLog, off uint64, value string) {
+		assert.Eventually(t, func() bool {
+			record, err := l.Read(off)
+			return err == nil && string(record.Value) == value
+		}, 5*time.Second, 50*time.Millisecond)
+	}
+
+	leader := newNode(0)
+	follower := newNode(1)
+	assert.NoError(t, leader.Join("1", follower.config.Raft.StreamLayer.Addr().String()))
+	values := []string{"uno", "dos", "tres"}
+	for i, value := range values {
+		off, err := leader.Append(&prolog.Record{Value: []byte(value)})
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(i), off)
+		replicated(follower, off, value)
+	}
+
+	commit := func(group, offset string) {
+		assert.NoError(t, leader.CommitOffset(&prolog.Record{
+			Key:   []byte(group),
+			Value: []byte(offset),
+		}))
+	}
+	commit("readers", "1")
+	assert.Equal(t, prolog.ErrNotLeader{}, follower.CommitOffset(&prolog.Record{}))
+
+	//The leader snapshots and drops the entries before it
+	assert.NoError(t, leader.raft.Snapshot().Error())
+	first, err := leader.raftLog.FirstIndex()
+	assert.NoError(t, err)
+	assert.True(t, first > 1)
+	off, err := leader.Append(&prolog.Record{Value: []byte("cuatro")})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), off)
+	values = append(values, "cuatro")
+
+	//so a node joining now installs the snapshot, then stores what follows
+	joined := newNode(2)
+	assert.NoError(t, leader.Join("2", joined.config.Raft.StreamLayer.Addr().String()))
+	off, err = leader.Append(&prolog.Record{Value: []byte("cinco")})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4), off)
+	values = append(values, "cinco")
+	commit("writers", "2")
+	for i, value := range values {
+		replicated(joined, uint64(i), value)
+	}
+	//with the offsets committed before the snapshot and since
+	assert.Eventually(t, func() bool {
+		return joined.config.Raft.Offsets.(*offsetStore).equal(map[string]string{
+			"readers": "1",
+			"writers": "2",
+		})
+	}, 5*time.Second, 50*time.Millisecond)
+	//its Raft log starting after the snapshot, with the leader's entries
+	first, err = joined.raftLog.FirstIndex()
+	assert.NoError(t, err)
+	assert.True(t, first > 1)
+	last, err := joined.raftLog.LastIndex()
+	assert.NoError(t, err)
+	assert.Equal(t, leader.raft.LastIndex(), last)
+	for index := first; index <= last; index++ {
+		var want, got raft.Log
+		assert.NoError(t, leader.raftLog.GetLog(index, &want))
+		assert.NoError(t, joined.raftLog.GetLog(index, &got))
+		assert.Equal(t, want, got)
+	}
+}
+
+//offsetStore keeps offset commits in memory, the latest value per key
+type offsetStore struct {
+	mu        sync.Mutex
+	committed map[string]string
+}
+
+func (s *offsetStore) Apply(record *prolog.Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.committed[string(record.Key)] = string(record.Value)
+	return nil
+}
+
+func (s *offsetStore) Records() []*prolog.Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var records []*prolog.Record
+	for key, value := range s.committed {
+		records = append(records, &prolog.Record{
+			Key:   []byte(key),
+			Value: []byte(value),
+		})
+	}
+	return records
+}
+
+func (s *offsetStore) Restore(records []*prolog.Record) error {
+	s.mu.Lock()
+	s.committed = map[string]string{}
+	s.mu.Unlock()
+	for _, record := range records {
+		s.Apply(record)
+	}
+	return nil
+}
+
+func (s *offsetStore) Sync() error {
+	return nil
+}
+
+func (s *offsetStore) equal(committed map[string]string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return reflect.DeepEqual(committed, s.committed)
+}
+
+func TestProgressPipeline(t *testing.T) {
+	inner := &fakePipeline{done: make(chan raft.AppendFuture, 1)}
+	acks := NewAcks()
+	transport := &progressTransport{matched: acks}
+	p := newProgressPipeline(inner, func(future raft.AppendFuture) {
+		transport.report("follower", future.Request(), future.Response())
+	})
+
+	future := &fakeFuture{
+		req: &raft.AppendEntriesRequest{
+			PrevLogEntry: 2,
+			Entries:      []*raft.Log{{Index: 3}, {Index: 4}},
+		},
+		resp: &raft.AppendEntriesResponse{Success: true},
+	}
+	inner.done <- future
+	select {
+	case got := <-p.Consumer():
+		assert.Equal(t, raft.AppendFuture(future), got)
+	case <-time.After(time.Second):
+		t.Fatal("reply not relayed")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, acks.WaitForReplicas(ctx, 4, 1))
+
+	assert.NoError(t, p.Close())
+	assert.NoError(t, p.Close())
+	assert.True(t, inner.closed)
+}
+
+type fakePipeline struct {
+	done   chan raft.AppendFuture
+	closed bool
+}
+
+func (p *fakePipeline) AppendEntries(
+	args *raft.AppendEntriesRequest,
+	resp *raft.AppendEntriesResponse,
+) (raft.AppendFuture, error) {
+	return nil, nil
+}
+
+func (p *fakePipeline) Consumer() <-chan raft.AppendFuture {
+	return p.done
+}
+
+func (p *fakePipeline) Close() error {
+	p.closed = true
+	return nil
+}
+
+type fakeFuture struct {
+	req  *raft.AppendEntriesRequest
+	resp *raft.AppendEntriesResponse
+}
+
+func (f *fakeFuture) Error() error {
+	return nil
+}
+
+func (f *fakeFuture) Start() time.Time {
+	return time.Time{}
+}
+
+func (f *fakeFuture) Request() *raft.AppendEntriesRequest {
+	return f.req
+}
+
+func (f *fakeFuture) Response() *raft.AppendEntriesResponse {
+	return f.resp
+}
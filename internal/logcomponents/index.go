@@ -1,17 +1,21 @@
 package logcomponents
 
 import (
+	"errors"
 	"io"
 	"os"
+	"sort"
 
 	"github.com/tysontate/gommap"
 )
 
 var (
-	//position of entry in file is offset * entWidth
+	//entries hold a relative offset and a store position
 	offWidth uint64 = 4
 	posWidth uint64 = 8
 	entWidth        = offWidth + posWidth
+
+	errOffsetOrder = errors.New("index: offsets must increase")
 )
 
 type index struct {
@@ -28,9 +32,13 @@ func newIndex(f *os.File, c Config) (*index, error) {
 	}
 	//TODO: Implement config struct
 	size := uint64(fi.Size())
-	err = os.Truncate(
-		f.Name(), int64(c.Segment.MaxIndexBytes),
-	)
+	//Never cut off entries, as in a segment copied from a node whose
+	//indexes are larger
+	max := c.Segment.MaxIndexBytes
+	if size > max {
+		max = size
+	}
+	err = os.Truncate(f.Name(), int64(max))
 	if err != nil {
 		return nil, err
 	}
@@ -51,6 +59,14 @@ func newIndex(f *os.File, c Config) (*index, error) {
 	return idx, nil
 }
 
+//sync commits the memory map and file to stable storage
+func (i *index) sync() error {
+	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
+		return err
+	}
+	return i.file.Sync()
+}
+
 func (i *index) Close() error {
 	//Ensure mmap has synced data to file and that file has flushed contents to stable store.
 	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
@@ -66,17 +82,45 @@ func (i *index) Close() error {
 	return i.file.Close()
 }
 
+/*
+Read returns the entry for relative offset in, or the last entry when
+in is -1. Offsets within a segment may have gaps (after compaction), so
+they are binary searched rather than assumed to sit at slot in.
+Returns io.EOF if the segment holds no such offset.
+*/
 func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
-	if i.size == 0 {
+	n := i.size / entWidth
+	if n == 0 {
 		return 0, 0, io.EOF
 	}
 	//Read the last entry
 	if in == -1 {
-		out = uint32((i.size / entWidth) - 1)
-	} else {
-		out = uint32(in)
+		return i.entry(n - 1)
+	}
+	//Dense segments keep every offset at its own slot
+	if uint64(in) < n {
+		if out, pos, _ := i.entry(uint64(in)); out == uint32(in) {
+			return out, pos, nil
+		}
 	}
-	pos = uint64(out) * entWidth
+	out, pos, err = i.entry(i.seek(uint32(in)))
+	if err != nil || out != uint32(in) {
+		return 0, 0, io.EOF
+	}
+	return out, pos, nil
+}
+
+//seek returns the slot of the first entry at or after relative offset rel
+func (i *index) seek(rel uint32) uint64 {
+	return uint64(sort.Search(int(i.size/entWidth), func(j int) bool {
+		out, _, _ := i.entry(uint64(j))
+		return out >= rel
+	}))
+}
+
+//entry returns the nth entry in the index
+func (i *index) entry(n uint64) (out uint32, pos uint64, err error) {
+	pos = n * entWidth
 	if i.size < pos+entWidth {
 		return 0, 0, io.EOF
 	}
@@ -85,11 +129,19 @@ func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
 	return out, pos, nil
 }
 
+/*
+Write appends an entry for relative offset off. Entries are placed in
+the next free slot rather than at slot off, so offsets may skip, but
+they must increase.
+*/
 func (i *index) Write(off uint32, pos uint64) error {
 	//Make sure there is space to write entry
 	if uint64(len(i.mmap)) < i.size+entWidth {
 		return io.EOF
 	}
+	if last, _, err := i.Read(-1); err == nil && off <= last {
+		return errOffsetOrder
+	}
 	// Put offset and position into memory map
 	enc.PutUint32(i.mmap[i.size:i.size+offWidth], off)
 	enc.PutUint64(i.mmap[i.size+offWidth:i.size+entWidth], pos)
@@ -98,6 +150,28 @@ func (i *index) Write(off uint32, pos uint64) error {
 	return nil
 }
 
+//blank reports whether the nth slot was never written
+func (i *index) blank(n uint64) bool {
+	for _, b := range i.mmap[n*entWidth : (n+1)*entWidth] {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+//truncate drops every entry past the first n, zeroing their slots
+func (i *index) truncate(n uint64) {
+	size := n * entWidth
+	if size >= i.size {
+		return
+	}
+	for j := size; j < i.size; j++ {
+		i.mmap[j] = 0
+	}
+	i.size = size
+}
+
 func (i *index) Name() string {
 	return i.file.Name()
 }
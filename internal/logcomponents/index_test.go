@@ -55,3 +55,40 @@ func TestIndex(t *testing.T) {
 	assert.Equal(t, entries[1].Pos, pos)
 
 }
+
+func TestIndexSparse(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "index_sparse_test")
+	assert.Equal(t, err, nil)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	idx, err := newIndex(f, c)
+	assert.Equal(t, err, nil)
+
+	//Offsets may skip, as after compaction, but never go backwards
+	for i, off := range []uint32{0, 3, 4, 9} {
+		err = idx.Write(off, uint64(i)*10)
+		assert.Equal(t, err, nil)
+	}
+	assert.Equal(t, errOffsetOrder, idx.Write(9, 40))
+	assert.Equal(t, errOffsetOrder, idx.Write(5, 40))
+
+	off, pos, err := idx.Read(4)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, uint32(4), off)
+	assert.Equal(t, uint64(20), pos)
+
+	off, pos, err = idx.Read(-1)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, uint32(9), off)
+	assert.Equal(t, uint64(30), pos)
+
+	for _, hole := range []int64{1, 2, 5, 8, 10} {
+		_, _, err = idx.Read(hole)
+		assert.Equal(t, io.EOF, err)
+	}
+	assert.Equal(t, uint64(1), idx.seek(1))
+	assert.Equal(t, uint64(3), idx.seek(9))
+	assert.Equal(t, idx.Close(), nil)
+}
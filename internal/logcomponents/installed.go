@@ -0,0 +1,104 @@
+package logcomponents
+
+import (
+	"bufio"
+	"fmt"
+	"logstore/internal/log/proto"
+	"net/url"
+	"os"
+	"path"
+)
+
+//installedFile lists the spans of a log installed from snapshots
+const installedFile = "installed"
+
+/*
+span says that records without an origin below next, and at or above
+the previous span's next, came from node. Segments installed from a
+snapshot are renamed into place as they are, so the origin their
+records would otherwise be stamped with on the way in is kept here.
+*/
+type span struct {
+	node string
+	next uint64
+}
+
+/*
+origin stamps a record read from an installed span with the node it
+came from, as replication does with records it copies.
+*/
+func origin(spans []span, record *proto.Record) {
+	if record.OriginNode != "" {
+		return
+	}
+	for _, s := range spans {
+		if record.Offset < s.next {
+			record.OriginNode = s.node
+			record.OriginOffset = record.Offset
+			return
+		}
+	}
+}
+
+/*
+installedSpans returns the spans of a snapshot taken up to next and
+installed from source: those it was installed with itself, cut at next,
+then source's own up to next.
+*/
+func installedSpans(spans []span, source string, next uint64) []span {
+	var installed []span
+	for _, s := range spans {
+		if s.next >= next {
+			break
+		}
+		installed = append(installed, s)
+	}
+	return append(installed, span{node: source, next: next})
+}
+
+//readSpans reads the spans listed in dir, none if it wasn't installed
+func readSpans(dir string) ([]span, error) {
+	f, err := os.Open(path.Join(dir, installedFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var spans []span
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var s span
+		var node string
+		if _, err = fmt.Sscanf(scanner.Text(), "%d %s", &s.next, &node); err != nil {
+			return nil, err
+		}
+		if s.node, err = url.PathUnescape(node); err != nil {
+			return nil, err
+		}
+		spans = append(spans, s)
+	}
+	return spans, scanner.Err()
+}
+
+//writeSpans lists spans in dir, one per line as their next and node
+func writeSpans(dir string, spans []span) error {
+	f, err := os.Create(path.Join(dir, installedFile))
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, s := range spans {
+		fmt.Fprintf(w, "%d %s\n", s.next, url.PathEscape(s.node))
+	}
+	if err = w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -1,6 +1,8 @@
 package logcomponents
 
 import (
+	"context"
+	"errors"
 	"io"
 	"io/ioutil"
 	"logstore/internal/log/proto"
@@ -10,6 +12,9 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	"go.uber.org/zap"
 )
 
 type Log struct {
@@ -20,6 +25,15 @@ type Log struct {
 
 	activeSegment *segment
 	segments      []*segment
+	recoveries    []Recovery
+	producers     producers //idempotent producers' latest appends
+	transactions  *transactions
+	installed     []span //where records installed from snapshots came from
+
+	unsynced uint64        //records appended since the last periodic sync
+	done     chan struct{} //stops the periodic sync loop
+	appended chan struct{} //closed, then replaced, whenever records are appended
+	closed   bool
 }
 
 /*
@@ -35,9 +49,14 @@ func NewLog(dir string, c Config) (*Log, error) {
 	if c.Segment.MaxIndexBytes == 0 {
 		c.Segment.MaxIndexBytes = 1024
 	}
+
+	if c.Segment.IndexIntervalBytes == 0 {
+		c.Segment.IndexIntervalBytes = 4096
+	}
 	l := &Log{
-		Dir:    dir,
-		Config: c,
+		Dir:      dir,
+		Config:   c,
+		appended: make(chan struct{}),
 	}
 	return l, l.setup()
 }
@@ -47,6 +66,16 @@ func (l *Log) newSegment(off uint64) error {
 	if err != nil {
 		return err
 	}
+	if r := s.recovery; r.DiscardedEntries > 0 || r.DiscardedBytes > 0 {
+		zap.L().Named("log").Warn(
+			"discarded torn segment tail",
+			zap.String("dir", l.Dir),
+			zap.Uint64("base_offset", r.BaseOffset),
+			zap.Uint64("entries", r.DiscardedEntries),
+			zap.Uint64("bytes", r.DiscardedBytes),
+		)
+		l.recoveries = append(l.recoveries, r)
+	}
 
 	l.segments = append(l.segments, s)
 	l.activeSegment = s
@@ -59,17 +88,54 @@ If there are existing segments to intialize state, otherwise starts
 with new segments
 */
 func (l *Log) setup() error {
+	if err := cleanCompaction(l.Dir); err != nil {
+		return err
+	}
+	var err error
+	if l.installed, err = readSpans(l.Dir); err != nil {
+		return err
+	}
+	if err = l.openSegments(); err != nil {
+		return err
+	}
+
+	if l.segments == nil {
+		if err = l.newSegment(
+			l.Config.Segment.InitialOffset,
+		); err != nil {
+			return err
+		}
+	}
+	l.replay()
+
+	d := l.Config.Durability
+	if d.Mode == DurabilityPeriodic && d.SyncInterval > 0 {
+		l.done = make(chan struct{})
+		go l.syncLoop(d.SyncInterval, l.done)
+	}
+	return nil
+}
+
+//openSegments opens the segments in the log's directory, oldest first
+func (l *Log) openSegments() error {
 	files, err := ioutil.ReadDir(l.Dir)
 	if err != nil {
 		return err
 	}
 	var baseOffsets []uint64
 	for _, file := range files {
+		//Each segment has a store, index and meta file; count it once
+		if path.Ext(file.Name()) != ".store" {
+			continue
+		}
 		offStr := strings.TrimSuffix(
 			file.Name(),
 			path.Ext(file.Name()),
 		)
-		off, _ := strconv.ParseUint(offStr, 10, 0)
+		off, err := strconv.ParseUint(offStr, 10, 0)
+		if err != nil {
+			continue
+		}
 		baseOffsets = append(baseOffsets, off)
 	}
 	sort.Slice(baseOffsets, func(i, j int) bool {
@@ -80,38 +146,298 @@ func (l *Log) setup() error {
 		if err = l.newSegment(baseOffsets[i]); err != nil {
 			return err
 		}
-		i++
 	}
+	return nil
+}
 
-	if l.segments == nil {
-		if err = l.newSegment(
-			l.Config.Segment.InitialOffset,
-		); err != nil {
-			return err
+/*
+replay rebuilds what the log tracks from its records: idempotent
+producers' latest appends and the transactions still open or aborted.
+A segment that can't be read past some record is tracked up to it.
+*/
+func (l *Log) replay() {
+	l.producers = make(producers)
+	l.transactions = newTransactions()
+	for _, s := range l.segments {
+		err := s.scan(func(record *proto.Record) error {
+			origin(l.installed, record)
+			l.track(record)
+			return nil
+		})
+		if err != nil {
+			zap.L().Named("log").Warn(
+				"failed to replay records",
+				zap.String("dir", l.Dir),
+				zap.Uint64("base_offset", s.baseOffset),
+				zap.Error(err),
+			)
 		}
 	}
-	return nil
+}
+
+//track follows a record just appended. Callers must hold the write lock.
+func (l *Log) track(record *proto.Record) {
+	l.producers.track(record)
+	l.transactions.track(record)
 }
 
 /*
 	Append appends a record to the log, specifically to the active segment.
+	A retry by an idempotent producer returns the offset first appended at.
 */
 func (l *Log) Append(record *proto.Record) (uint64, error) {
+	return l.append(record, (*segment).Append)
+}
+
+//appendStamped is Append keeping the timestamp the record carries
+func (l *Log) appendStamped(record *proto.Record) (uint64, error) {
+	return l.append(record, (*segment).appendStamped)
+}
+
+func (l *Log) append(
+	record *proto.Record,
+	add func(*segment, *proto.Record) (uint64, error),
+) (uint64, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if l.closed {
+		return 0, errClosed
+	}
 
-	off, err := l.activeSegment.Append(record)
+	off, dup, err := l.producers.check(record)
+	if err != nil || dup {
+		return off, err
+	}
+	off, err = add(l.activeSegment, record)
 	if err != nil {
 		return 0, err
 	}
+	l.track(record)
+	if err = l.persist(1); err != nil {
+		return 0, err
+	}
+	l.notify()
 
 	if l.activeSegment.IsMaxed() {
-		err = l.newSegment(off + 1)
+		err = l.roll(off + 1)
 	}
 
 	return off, err
 }
 
+/*
+AppendBatch appends records at contiguous offsets under a single lock,
+rolling to a new segment mid-batch when the active one fills up, and
+returns the offset of the first. Other appends can't interleave with
+the batch, and a failed write removes the records before it again, so
+the batch is appended whole or not at all.
+*/
+func (l *Log) AppendBatch(records []*proto.Record) (uint64, error) {
+	return l.appendBatch(records, (*segment).Append)
+}
+
+//appendBatchStamped is AppendBatch keeping the timestamps the records carry
+func (l *Log) appendBatchStamped(records []*proto.Record) (uint64, error) {
+	return l.appendBatch(records, (*segment).appendStamped)
+}
+
+func (l *Log) appendBatch(
+	records []*proto.Record,
+	add func(*segment, *proto.Record) (uint64, error),
+) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return 0, errClosed
+	}
+
+	base := l.activeSegment.nextOffset
+	fail := func(err error) (uint64, error) {
+		if terr := l.dropTail(base); terr != nil {
+			return 0, terr
+		}
+		return 0, err
+	}
+	var pending uint64
+	for _, record := range records {
+		off, err := add(l.activeSegment, record)
+		if err != nil {
+			return fail(err)
+		}
+		l.track(record)
+		pending++
+		if l.activeSegment.IsMaxed() {
+			//Persist against the segment the records went to before rolling
+			if err = l.persist(pending); err != nil {
+				return fail(err)
+			}
+			pending = 0
+			if err = l.roll(off + 1); err != nil {
+				return fail(err)
+			}
+		}
+	}
+	if pending > 0 {
+		if err := l.persist(pending); err != nil {
+			return fail(err)
+		}
+	}
+	if len(records) > 0 {
+		l.notify()
+	}
+	return base, nil
+}
+
+/*
+notify wakes everyone in WaitForOffset. Callers must hold the write lock.
+*/
+func (l *Log) notify() {
+	close(l.appended)
+	l.appended = make(chan struct{})
+}
+
+/*
+errClosed is returned by appends, reads and waits on a closed log, as
+when a topic is deleted while a request holds one of its partitions.
+*/
+var errClosed = errors.New("log: closed")
+
+/*
+WaitForOffset blocks until off has been appended, ctx is done or the
+log is closed. It returns straight away for offsets already in the log,
+including any below its lowest offset, so readers should still expect
+ErrOffOutOfRange.
+*/
+func (l *Log) WaitForOffset(ctx context.Context, off uint64) error {
+	for {
+		l.mu.RLock()
+		next, appended, closed := l.activeSegment.nextOffset, l.appended, l.closed
+		l.mu.RUnlock()
+		if off < next {
+			return nil
+		}
+		if closed {
+			return errClosed
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-appended:
+		}
+	}
+}
+
+/*
+WaitForCommitted is WaitForOffset for read-committed readers: it blocks
+until off is below the log's stable offset, ctx is done or the log is
+closed.
+*/
+func (l *Log) WaitForCommitted(ctx context.Context, off uint64) error {
+	for {
+		l.mu.RLock()
+		stable := l.transactions.stable(l.activeSegment.nextOffset)
+		appended, closed := l.appended, l.closed
+		l.mu.RUnlock()
+		if off < stable {
+			return nil
+		}
+		if closed {
+			return errClosed
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-appended:
+		}
+	}
+}
+
+/*
+OpenTransactions returns the transactions appended to the log, rather
+than replicated to it, that have yet to be committed or aborted.
+*/
+func (l *Log) OpenTransactions() []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.transactions.local()
+}
+
+/*
+persist applies the durability policy to records just appended to the
+active segment. Callers must hold the write lock.
+*/
+func (l *Log) persist(appended uint64) error {
+	d := l.Config.Durability
+	switch d.Mode {
+	case DurabilityFlush:
+		return l.activeSegment.store.flush()
+	case DurabilitySync:
+		return l.activeSegment.sync()
+	case DurabilityPeriodic:
+		l.unsynced += appended
+		if d.SyncEvery > 0 && l.unsynced >= d.SyncEvery {
+			l.unsynced = 0
+			return l.activeSegment.sync()
+		}
+	}
+	return nil
+}
+
+/*
+roll starts a new active segment at off. Records still awaiting a
+periodic sync are synced first, the ticker only ever sees the active segment.
+*/
+func (l *Log) roll(off uint64) error {
+	if l.unsynced > 0 {
+		if err := l.activeSegment.sync(); err != nil {
+			return err
+		}
+		l.unsynced = 0
+	}
+	return l.newSegment(off)
+}
+
+/*
+Sync commits the active segment to stable storage regardless of the
+durability policy.
+*/
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.unsynced = 0
+	return l.activeSegment.sync()
+}
+
+func (l *Log) syncLoop(interval time.Duration, done chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			l.mu.Lock()
+			if l.done != done { //closed while waiting on the lock
+				l.mu.Unlock()
+				return
+			}
+			var err error
+			if l.unsynced > 0 {
+				l.unsynced = 0
+				err = l.activeSegment.sync()
+			}
+			l.mu.Unlock()
+			if err != nil {
+				zap.L().Named("log").Error(
+					"periodic sync failed",
+					zap.String("dir", l.Dir),
+					zap.Error(err),
+				)
+			}
+		}
+	}
+}
+
 /*
  */
 func (l *Log) Read(off uint64) (*proto.Record, error) {
@@ -121,18 +447,137 @@ func (l *Log) Read(off uint64) (*proto.Record, error) {
 	*/
 	l.mu.RLock()
 	defer l.mu.RUnlock() // readers holding lock only have to wait to writers
+	if l.closed {
+		return nil, errClosed
+	}
+
+	s := l.segmentFor(off)
+	if s == nil || l.activeSegment.nextOffset <= off {
+		return nil, proto.ErrOffOutOfRange{Offset: off}
+	}
+	record, err := s.Read(off)
+	if err != nil {
+		return nil, err
+	}
+	origin(l.installed, record)
+	return record, nil
+}
+
+/*
+ReadRange returns a page of records starting at the first offset at or
+after from, along with the offset to read the next page from. A page
+holds at most maxRecords records and maxBytes of record data, zero
+meaning no limit, but always at least one record if any are left so a
+large record can't stall the reader. Reading from the next offset
+returns an empty page.
+*/
+func (l *Log) ReadRange(from, maxRecords, maxBytes uint64) (
+	[]*proto.Record,
+	uint64,
+	error,
+) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.readRange(from, maxRecords, maxBytes, l.activeSegment.nextOffset, nil)
+}
+
+/*
+ReadCommitted is ReadRange for read-committed readers. Pages stop at
+the log's stable offset, the first record of the earliest transaction
+still open, and leave out transaction markers and the records of
+aborted transactions. The next offset moves past records left out, so
+a page may be empty without the reader having caught up.
+*/
+func (l *Log) ReadCommitted(from, maxRecords, maxBytes uint64) (
+	[]*proto.Record,
+	uint64,
+	error,
+) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	stable := l.transactions.stable(l.activeSegment.nextOffset)
+	return l.readRange(from, maxRecords, maxBytes, stable, l.transactions.committed)
+}
+
+/*
+readRange reads a page of the records before until, leaving out those
+keep rejects when it's set. Callers must hold the lock.
+*/
+func (l *Log) readRange(
+	from, maxRecords, maxBytes, until uint64,
+	keep func(*proto.Record) bool,
+) ([]*proto.Record, uint64, error) {
+	if l.closed {
+		return nil, 0, errClosed
+	}
+	if l.segmentFor(from) == nil || l.activeSegment.nextOffset < from {
+		return nil, 0, proto.ErrOffOutOfRange{Offset: from}
+	}
+	if from >= until {
+		return nil, from, nil
+	}
 
+	var records []*proto.Record
+	var size uint64
+	next := from //just past the last record read, kept or not
+	full := false
+	for _, s := range l.segments {
+		if s.nextOffset <= from {
+			continue
+		}
+		off := from
+		if off < s.baseOffset {
+			off = s.baseOffset
+		}
+		err := s.readRange(off, func(record *proto.Record, n uint64) bool {
+			origin(l.installed, record)
+			if record.Offset >= until {
+				next, full = until, true
+				return false
+			}
+			if keep != nil && !keep(record) {
+				next = record.Offset + 1
+				return true
+			}
+			over := maxRecords > 0 && uint64(len(records)) >= maxRecords ||
+				maxBytes > 0 && size+n > maxBytes
+			if len(records) > 0 && over {
+				full = true
+				return false
+			}
+			records = append(records, record)
+			size += n
+			next = record.Offset + 1
+			return true
+		})
+		if err != nil {
+			//Hand back what was read, the next page reports the error
+			if next == from {
+				return nil, 0, err
+			}
+			full = true
+		}
+		if full {
+			return records, next, nil
+		}
+	}
+	return records, until, nil
+}
+
+/*
+segmentFor returns the segment whose range holds off: the last one
+based at or before it. Compacted segments may end short of the next
+segment's base, so nextOffset can't bound the search.
+*/
+func (l *Log) segmentFor(off uint64) *segment {
 	var s *segment
 	for _, segment := range l.segments {
-		if segment.baseOffset <= off && off < segment.nextOffset {
-			s = segment
+		if segment.baseOffset > off {
 			break
 		}
+		s = segment
 	}
-	if s == nil || s.nextOffset <= off {
-		return nil, proto.ErrOffOutOfRange{Offset: off}
-	}
-	return s.Read(off)
+	return s
 }
 
 /*
@@ -142,11 +587,18 @@ func (l *Log) Close() error {
 	l.mu.Lock() //ensure no more reads/writes occur
 	defer l.mu.Unlock()
 
+	if l.done != nil {
+		close(l.done)
+		l.done = nil
+	}
 	for _, segment := range l.segments {
 		if err := segment.Close(); err != nil { //close out existing segments
 			return err
 		}
 	}
+	//Wake anyone waiting for appends that won't come
+	l.closed = true
+	l.notify()
 	return nil
 }
 
@@ -167,9 +619,46 @@ func (l *Log) Reset() error {
 	if err := l.Remove(); err != nil {
 		return err
 	}
+	l.segments, l.recoveries = nil, nil
+	l.closed = false
+	if err := os.MkdirAll(l.Dir, 0755); err != nil {
+		return err
+	}
 	return l.setup()
 }
 
+/*
+OffsetForTime returns the first offset appended at or after t. If
+nothing has been appended since t, it returns the offset the next
+append will get, so reading from it tails the log.
+*/
+func (l *Log) OffsetForTime(t time.Time) (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	ts := t.UnixNano()
+	for _, s := range l.segments {
+		off, ok, err := s.offsetForTime(ts)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return off, nil
+		}
+	}
+	return l.activeSegment.nextOffset, nil
+}
+
+/*
+Recoveries reports what was discarded from segment tails when the log
+was opened. It is empty after a clean shutdown.
+*/
+func (l *Log) Recoveries() []Recovery {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.recoveries
+}
+
 func (l *Log) LowestOffset() (uint64, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
@@ -207,6 +696,279 @@ func (l *Log) Truncate(lowest uint64) error {
 	return nil
 }
 
+/*
+truncateTail removes every record at or after off, as when a Raft
+follower drops entries that conflict with its leader's. The next
+append gets off.
+*/
+func (l *Log) truncateTail(off uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.dropTail(off)
+}
+
+//dropTail is truncateTail for callers already holding the write lock
+func (l *Log) dropTail(off uint64) error {
+	for len(l.segments) > 0 && l.activeSegment.baseOffset >= off {
+		if err := l.activeSegment.Remove(); err != nil {
+			return err
+		}
+		l.segments = l.segments[:len(l.segments)-1]
+		l.activeSegment = nil
+		if len(l.segments) > 0 {
+			l.activeSegment = l.segments[len(l.segments)-1]
+		}
+	}
+	var err error
+	if l.activeSegment == nil {
+		err = l.newSegment(off)
+	} else {
+		err = l.activeSegment.truncateFrom(off)
+	}
+	if err != nil {
+		return err
+	}
+	//What the dropped records opened or appended is forgotten with them
+	l.replay()
+	return nil
+}
+
+/*
+appendAt appends a record that already carries its offset and
+timestamp, as when restoring a snapshot. Offsets must increase but may skip.
+*/
+func (l *Log) appendAt(record *proto.Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.writeAt(record); err != nil {
+		return err
+	}
+	l.notify()
+	return nil
+}
+
+//writeAt is appendAt without notifying. Callers must hold the write lock.
+func (l *Log) writeAt(record *proto.Record) error {
+	if err := l.activeSegment.write(record); err != nil {
+		return err
+	}
+	l.track(record)
+	if err := l.persist(1); err != nil {
+		return err
+	}
+	if l.activeSegment.IsMaxed() {
+		return l.roll(record.Offset + 1)
+	}
+	return nil
+}
+
+/*
+SnapshotFiles opens the store and index files of every segment but the
+active one, oldest first, for copying to another node, with the bytes
+of each in use. Open indexes are grown to MaxIndexBytes, so only their
+first sizes bytes are worth copying. Callers close the files. Open
+files stay readable after retention or compaction removes or replaces
+them.
+*/
+func (l *Log) SnapshotFiles() (files []*os.File, sizes []int64, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, s := range l.segments[:len(l.segments)-1] {
+		if err := s.store.flush(); err != nil {
+			closeAll(files)
+			return nil, nil, err
+		}
+		for _, name := range []string{s.store.Name(), s.index.Name()} {
+			f, err := os.Open(name)
+			if err != nil {
+				closeAll(files)
+				return nil, nil, err
+			}
+			files = append(files, f)
+		}
+		sizes = append(sizes, int64(s.store.size), int64(s.index.size))
+	}
+	//The spans say where records installed here, without an origin, came from
+	if len(files) > 0 && len(l.installed) > 0 {
+		f, err := os.Open(path.Join(l.Dir, installedFile))
+		if err != nil {
+			closeAll(files)
+			return nil, nil, err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			closeAll(files)
+			return nil, nil, err
+		}
+		files = append(files, f)
+		sizes = append(sizes, fi.Size())
+	}
+	return files, sizes, nil
+}
+
+func closeAll(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+var errNotEmpty = errors.New("log: not empty")
+
+//empty reports whether nothing has been appended to the log
+func (l *Log) empty() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.activeSegment.nextOffset == l.segments[0].baseOffset
+}
+
+//nextOffset returns the offset the next append will get
+func (l *Log) nextOffset() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.activeSegment.nextOffset
+}
+
+var errEmptySnapshot = errors.New("log: snapshot holds no records")
+
+/*
+install replaces the log, while it's empty, with the segments staged in
+dir, a copy of source's closed segments, keeping their offsets. Opening
+the copy recovers it, then its files are renamed into place as they
+are, records without an origin reading as source's from then on.
+Returns, by origin, the next of its offsets to replicate, for source
+the snapshot's next offset.
+*/
+func (l *Log) install(dir, source string) (map[string]uint64, error) {
+	if !l.empty() {
+		return nil, errNotEmpty
+	}
+	c := l.Config
+	c.Durability = Durability{}
+	snapshot, err := NewLog(dir, c)
+	if err != nil {
+		return nil, err
+	}
+	progress, spans, err := snapshot.origins(source)
+	//Closing trims the copy's indexes to their entries
+	if cerr := snapshot.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.activeSegment.nextOffset != l.segments[0].baseOffset {
+		return nil, errNotEmpty
+	}
+	for _, s := range l.segments {
+		if err := s.Remove(); err != nil {
+			return nil, err
+		}
+	}
+	l.segments = nil
+	if err := writeSpans(l.Dir, spans); err != nil {
+		return nil, err
+	}
+	l.installed = spans
+	for _, file := range files {
+		if file.Name() == installedFile {
+			continue
+		}
+		err := os.Rename(
+			path.Join(dir, file.Name()),
+			path.Join(l.Dir, file.Name()),
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := l.openSegments(); err != nil {
+		return nil, err
+	}
+	//The copy's segments were closed, appends go to a new one
+	if next := progress[source]; l.activeSegment.baseOffset < next {
+		if err := l.newSegment(next); err != nil {
+			return nil, err
+		}
+	}
+	l.replay()
+	l.notify()
+	return progress, nil
+}
+
+/*
+origins reads a snapshot installed from source, returning by origin the
+next of its offsets to replicate and the spans to install it with.
+*/
+func (l *Log) origins(source string) (map[string]uint64, []span, error) {
+	if l.empty() {
+		return nil, nil, errEmptySnapshot
+	}
+	lowest, err := l.LowestOffset()
+	if err != nil {
+		return nil, nil, err
+	}
+	next := l.nextOffset()
+	spans := installedSpans(l.installed, source, next)
+	progress := map[string]uint64{source: next}
+	for off := lowest; off < next; {
+		records, n, err := l.ReadRange(off, 1000, 1<<20)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, record := range records {
+			origin(spans, record)
+			if record.OriginNode != source &&
+				record.OriginOffset >= progress[record.OriginNode] {
+				progress[record.OriginNode] = record.OriginOffset + 1
+			}
+		}
+		off = n
+	}
+	return progress, spans, nil
+}
+
+/*
+EnforceRetention removes whole segments, oldest first, that fall outside
+the retention policy as of now. The active segment is never removed.
+Returns the number of segments removed.
+*/
+func (l *Log) EnforceRetention(now time.Time) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	r := l.Config.Retention
+	var total uint64
+	for _, s := range l.segments {
+		total += s.store.size
+	}
+
+	removed := 0
+	for len(l.segments) > 1 {
+		s := l.segments[0]
+		expired := r.MaxAge > 0 && now.Sub(s.meta.LastAppend()) > r.MaxAge
+		oversized := r.MaxBytes > 0 && total > r.MaxBytes
+		if !expired && !oversized {
+			break
+		}
+		total -= s.store.size
+		if err := s.Remove(); err != nil {
+			return removed, err
+		}
+		l.segments = l.segments[1:]
+		removed++
+	}
+	return removed, nil
+}
+
 /*
 Reader returns io.Reader to read log
 */
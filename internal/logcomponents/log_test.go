@@ -1,10 +1,14 @@
 package logcomponents
 
 import (
+	"context"
+	"io"
 	"io/ioutil"
 	prolog "logstore/internal/log/proto"
 	"os"
+	"path"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/protobuf/proto"
@@ -42,6 +46,111 @@ func TestAppendRead(t *testing.T) {
 	assert.Equal(t, record.Value, read.Value)
 }
 
+func TestAppendBatch(t *testing.T) {
+	log, err := newTestLog()
+	defer os.RemoveAll(dir)
+	assert.NoError(t, err)
+
+	_, err = log.Append(&prolog.Record{Value: []byte("first")})
+	assert.NoError(t, err)
+
+	//Enough records to roll the 32 byte segments several times mid-batch
+	var records []*prolog.Record
+	for i := 0; i < 5; i++ {
+		records = append(records, &prolog.Record{Value: []byte("record")})
+	}
+	base, err := log.AppendBatch(records)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), base)
+	assert.True(t, len(log.segments) > 2)
+
+	for i := range records {
+		read, err := log.Read(base + uint64(i))
+		assert.NoError(t, err)
+		assert.Equal(t, base+uint64(i), read.Offset)
+		assert.Equal(t, records[i].Value, read.Value)
+	}
+	off, err := log.HighestOffset()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(5), off)
+
+	base, err = log.AppendBatch(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(6), base)
+}
+
+func TestReadRange(t *testing.T) {
+	log, err := newTestLog()
+	defer os.RemoveAll(dir)
+	assert.NoError(t, err)
+
+	for i := 0; i < 6; i++ {
+		_, err = log.Append(&prolog.Record{Value: []byte("record")})
+		assert.NoError(t, err)
+	}
+	assert.True(t, len(log.segments) > 2)
+
+	//Pages run across segment boundaries
+	var got []uint64
+	for from := uint64(0); from < 6; {
+		records, next, err := log.ReadRange(from, 4, 0)
+		assert.NoError(t, err)
+		for _, record := range records {
+			got = append(got, record.Offset)
+		}
+		from = next
+	}
+	assert.Equal(t, []uint64{0, 1, 2, 3, 4, 5}, got)
+
+	//A byte limit below one record still returns that record
+	records, next, err := log.ReadRange(2, 0, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, uint64(2), records[0].Offset)
+	assert.Equal(t, uint64(3), next)
+
+	records, next, err = log.ReadRange(6, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(records))
+	assert.Equal(t, uint64(6), next)
+
+	_, _, err = log.ReadRange(7, 0, 0)
+	assert.Equal(t, prolog.ErrOffOutOfRange{Offset: 7}, err)
+}
+
+func TestWaitForOffset(t *testing.T) {
+	log, err := newTestLog()
+	defer os.RemoveAll(dir)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, log.WaitForOffset(ctx, 0))
+
+	done := make(chan error)
+	go func() {
+		done <- log.WaitForOffset(context.Background(), 1)
+	}()
+	_, err = log.Append(&prolog.Record{Value: []byte("record")})
+	assert.NoError(t, err)
+	select {
+	case <-done:
+		t.Fatal("woke before offset 1 was appended")
+	case <-time.After(20 * time.Millisecond):
+	}
+	_, err = log.AppendBatch([]*prolog.Record{{Value: []byte("record")}})
+	assert.NoError(t, err)
+	select {
+	case err = <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("not woken by append")
+	}
+
+	//Offsets already in the log don't block
+	assert.NoError(t, log.WaitForOffset(context.Background(), 0))
+}
+
 func TestOutOfRangeErr(t *testing.T) {
 	log, err := newTestLog()
 	defer os.RemoveAll(dir)
@@ -100,7 +209,7 @@ func TestReader(t *testing.T) {
 	assert.NoError(t, err)
 
 	readRec := &prolog.Record{}
-	err = proto.Unmarshal(byt[lenWidth:], readRec)
+	err = proto.Unmarshal(byt[headerWidth:], readRec)
 	assert.Equal(t, record.Value, readRec.Value)
 }
 
@@ -122,3 +231,507 @@ func TestTruncate(t *testing.T) {
 	_, err = log.Read(0)
 	assert.Error(t, err)
 }
+
+func TestCorruptRead(t *testing.T) {
+	log, err := newTestLog()
+	defer os.RemoveAll(dir)
+	assert.NoError(t, err)
+
+	record := &prolog.Record{
+		Value: []byte("record"),
+	}
+	off, err := log.Append(record)
+	assert.NoError(t, err)
+	_, err = log.Append(record)
+	assert.NoError(t, err)
+	first, err := log.Read(off)
+	assert.NoError(t, err)
+	assert.NoError(t, log.Close())
+
+	//Flip the last byte of the first record, leaving the tail intact
+	p, err := proto.Marshal(first)
+	assert.NoError(t, err)
+	f, err := os.OpenFile(log.segments[0].store.Name(), os.O_RDWR, 0644)
+	assert.NoError(t, err)
+	last := int64(headerWidth + len(p) - 1)
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, last)
+	assert.NoError(t, err)
+	_, err = f.WriteAt([]byte{b[0] ^ 0xff}, last)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	log, err = NewLog(log.Dir, log.Config)
+	assert.NoError(t, err)
+	read, err := log.Read(off)
+	assert.Nil(t, read)
+	assert.Equal(t, prolog.ErrCorruptRecord{Offset: off}, err)
+}
+
+func TestCrashRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-crash-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	log, err := NewLog(dir, c)
+	assert.NoError(t, err)
+
+	record := &prolog.Record{
+		Value: []byte("record"),
+	}
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(record)
+		assert.NoError(t, err)
+	}
+	//Reading flushes the store; the next two records stay buffered
+	_, err = log.Read(2)
+	assert.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err := log.Append(record)
+		assert.NoError(t, err)
+	}
+
+	//Torn write: a header with no payload behind it
+	f, err := os.OpenFile(log.activeSegment.store.Name(), os.O_WRONLY|os.O_APPEND, 0644)
+	assert.NoError(t, err)
+	_, err = f.Write([]byte{entryVersion, 0, 0, 0})
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	//Reopen without closing, as after a crash
+	recovered, err := NewLog(dir, c)
+	assert.NoError(t, err)
+	assert.Equal(t, []Recovery{{
+		BaseOffset:       0,
+		DiscardedEntries: 2,
+		DiscardedBytes:   4,
+	}}, recovered.Recoveries())
+
+	off, err := recovered.HighestOffset()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), off)
+
+	off, err = recovered.Append(record)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), off)
+	read, err := recovered.Read(off)
+	assert.NoError(t, err)
+	assert.Equal(t, record.Value, read.Value)
+	assert.NoError(t, recovered.Close())
+
+	//A clean shutdown leaves nothing to recover
+	recovered, err = NewLog(dir, c)
+	assert.NoError(t, err)
+	assert.Empty(t, recovered.Recoveries())
+}
+
+func TestDurability(t *testing.T) {
+	for scenario, tc := range map[string]struct {
+		durability Durability
+		wait       time.Duration
+		survivors  uint64
+	}{
+		"none":            {Durability{Mode: DurabilityNone}, 0, 0},
+		"flush":           {Durability{Mode: DurabilityFlush}, 0, 3},
+		"sync":            {Durability{Mode: DurabilitySync}, 0, 3},
+		"periodic count":  {Durability{Mode: DurabilityPeriodic, SyncEvery: 2}, 0, 2},
+		"periodic ticker": {Durability{Mode: DurabilityPeriodic, SyncInterval: 10 * time.Millisecond}, 100 * time.Millisecond, 3},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "log-durability-test")
+			assert.NoError(t, err)
+			defer os.RemoveAll(dir)
+			c := Config{}
+			c.Segment.MaxStoreBytes = 1024
+			c.Durability = tc.durability
+			log, err := NewLog(dir, c)
+			assert.NoError(t, err)
+
+			record := &prolog.Record{
+				Value: []byte("record"),
+			}
+			for i := 0; i < 3; i++ {
+				_, err := log.Append(record)
+				assert.NoError(t, err)
+			}
+			time.Sleep(tc.wait)
+
+			//Reopen without closing: whatever is still buffered is lost
+			recovered, err := NewLog(dir, c)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.survivors, recovered.activeSegment.nextOffset)
+			assert.NoError(t, recovered.Close())
+			assert.NoError(t, log.Close())
+		})
+	}
+}
+
+func TestRetention(t *testing.T) {
+	setup := func(r Retention) *Log {
+		var err error
+		dir, err = ioutil.TempDir("", "log-retention-test")
+		assert.NoError(t, err)
+		c := Config{}
+		c.Segment.MaxStoreBytes = 64
+		c.Retention = r
+		log, err := NewLog(dir, c)
+		assert.NoError(t, err)
+		record := &prolog.Record{
+			Value: []byte("record"),
+		}
+		//Two records per segment: [0,1] [2,3] [4,5] and an empty active one
+		for i := 0; i < 6; i++ {
+			_, err := log.Append(record)
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, 4, len(log.segments))
+		return log
+	}
+
+	t.Run("size", func(t *testing.T) {
+		log := setup(Retention{MaxBytes: 100})
+		defer os.RemoveAll(dir)
+
+		removed, err := log.EnforceRetention(time.Now())
+		assert.NoError(t, err)
+		assert.Equal(t, 2, removed)
+		off, err := log.LowestOffset()
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(4), off)
+		_, err = log.Read(3)
+		assert.Error(t, err)
+	})
+
+	t.Run("age survives restart", func(t *testing.T) {
+		log := setup(Retention{MaxAge: time.Hour})
+		defer os.RemoveAll(dir)
+		lastAppend := log.segments[0].meta.LastAppend()
+		assert.NoError(t, log.Close())
+
+		log, err := NewLog(log.Dir, log.Config)
+		assert.NoError(t, err)
+		assert.Equal(t, lastAppend.UnixNano(), log.segments[0].meta.LastAppend().UnixNano())
+
+		removed, err := log.EnforceRetention(time.Now())
+		assert.NoError(t, err)
+		assert.Equal(t, 0, removed)
+
+		removed, err = log.EnforceRetention(time.Now().Add(2 * time.Hour))
+		assert.NoError(t, err)
+		assert.Equal(t, 3, removed)
+		off, err := log.LowestOffset()
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(6), off)
+	})
+}
+
+func TestOffsetForTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-time-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 128
+	c.Segment.IndexIntervalBytes = 64
+	log, err := NewLog(dir, c)
+	assert.NoError(t, err)
+
+	before := time.Now()
+	var stamps []int64
+	for i := 0; i < 10; i++ {
+		off, err := log.Append(&prolog.Record{Value: []byte("record")})
+		assert.NoError(t, err)
+		read, err := log.Read(off)
+		assert.NoError(t, err)
+		stamps = append(stamps, read.Timestamp)
+		time.Sleep(time.Millisecond)
+	}
+	assert.True(t, len(log.segments) > 1)
+
+	check := func(log *Log) {
+		off, err := log.OffsetForTime(before)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(0), off)
+		for i, ts := range stamps {
+			off, err := log.OffsetForTime(time.Unix(0, ts))
+			assert.NoError(t, err)
+			assert.Equal(t, uint64(i), off)
+		}
+		//Past the last record the log's next offset is returned
+		off, err = log.OffsetForTime(time.Unix(0, stamps[9]+1))
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(10), off)
+	}
+	check(log)
+
+	assert.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	assert.NoError(t, err)
+	check(log)
+}
+
+func TestSnapshotInstall(t *testing.T) {
+	source, err := newTestLog()
+	assert.NoError(t, err)
+	sourceDir := dir
+	defer os.RemoveAll(sourceDir)
+
+	//Records from the source itself and ones it replicated from "other"
+	for i := 0; i < 6; i++ {
+		record := &prolog.Record{Value: []byte("record")}
+		if i%2 == 1 {
+			record.OriginNode = "other"
+			record.OriginOffset = uint64(10 + i)
+		}
+		_, err = source.Append(record)
+		assert.NoError(t, err)
+	}
+	//Retention has already removed the oldest records
+	assert.NoError(t, source.Truncate(1))
+	lowest, err := source.LowestOffset()
+	assert.NoError(t, err)
+	assert.True(t, lowest > 0)
+
+	//Copy the closed segments, as GetSnapshot does
+	files, sizes, err := source.SnapshotFiles()
+	assert.NoError(t, err)
+	assert.True(t, len(files) > 0)
+	snapshotDir, err := ioutil.TempDir("", "snapshot-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(snapshotDir)
+	for i, f := range files {
+		b, err := ioutil.ReadAll(io.LimitReader(f, sizes[i]))
+		assert.NoError(t, err)
+		//Indexes are copied up to their last entry, not their mapped size
+		if path.Ext(f.Name()) == ".index" {
+			assert.Equal(t, int64(0), sizes[i]%int64(entWidth))
+			assert.True(t, sizes[i] < int64(source.Config.Segment.MaxIndexBytes))
+		}
+		assert.NoError(t, f.Close())
+		assert.NoError(t, ioutil.WriteFile(
+			path.Join(snapshotDir, path.Base(f.Name())),
+			b,
+			0644,
+		))
+	}
+	//The snapshot holds the closed segments, ending where the active one starts
+	source.mu.RLock()
+	next := source.activeSegment.baseOffset
+	source.mu.RUnlock()
+
+	log, err := newTestLog()
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	progress, err := log.install(snapshotDir, "source")
+	assert.NoError(t, err)
+	assert.Equal(t, next, progress["source"])
+
+	//The copy's files are moved into place rather than rewritten
+	staged, err := ioutil.ReadDir(snapshotDir)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(staged))
+
+	//Offsets are kept and every record has an origin
+	check := func(log *Log) {
+		installedLowest, err := log.LowestOffset()
+		assert.NoError(t, err)
+		assert.Equal(t, lowest, installedLowest)
+		var otherNext uint64
+		for off := lowest; off < next; off++ {
+			record, err := log.Read(off)
+			assert.NoError(t, err)
+			if off%2 == 1 {
+				assert.Equal(t, "other", record.OriginNode)
+				otherNext = record.OriginOffset + 1
+			} else {
+				assert.Equal(t, "source", record.OriginNode)
+				assert.Equal(t, off, record.OriginOffset)
+			}
+		}
+		assert.Equal(t, otherNext, progress["other"])
+	}
+	check(log)
+
+	//and appends carry on from the snapshot's end, without an origin
+	off, err := log.Append(&prolog.Record{Value: []byte("record")})
+	assert.NoError(t, err)
+	assert.Equal(t, next, off)
+	record, err := log.Read(off)
+	assert.NoError(t, err)
+	assert.Equal(t, "", record.OriginNode)
+
+	//Where the records came from survives reopening the log
+	assert.NoError(t, log.Close())
+	log, err = NewLog(dir, log.Config)
+	assert.NoError(t, err)
+	check(log)
+
+	//Snapshots of it carry the spans on to the nodes installing them
+	files, _, err = log.SnapshotFiles()
+	assert.NoError(t, err)
+	assert.Equal(t, installedFile, path.Base(files[len(files)-1].Name()))
+	closeAll(files)
+
+	_, err = log.install(snapshotDir, "source")
+	assert.Equal(t, errNotEmpty, err)
+	assert.NoError(t, log.Close())
+}
+
+func TestIdempotentAppend(t *testing.T) {
+	log, err := newTestLog()
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	produce := func(producer string, seq uint64) (uint64, error) {
+		return log.Append(&prolog.Record{
+			Value:      []byte("record"),
+			ProducerId: producer,
+			Sequence:   seq,
+		})
+	}
+	for seq := uint64(0); seq < 8; seq++ {
+		off, err := produce("producer", seq)
+		assert.NoError(t, err)
+		assert.Equal(t, seq, off)
+	}
+	//Retries get their original offsets back, appending nothing
+	off, err := produce("producer", 7)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(7), off)
+	off, err = produce("producer", 3)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), off)
+	_, err = produce("producer", 2)
+	assert.Equal(t, prolog.ErrDuplicateSequence{ProducerId: "producer", Sequence: 2}, err)
+	_, err = produce("producer", 9)
+	assert.Equal(t, prolog.ErrOutOfOrderSequence{
+		ProducerId: "producer",
+		Expected:   8,
+		Sequence:   9,
+	}, err)
+
+	//Copies replicated from elsewhere aren't checked, nor plain records
+	off, err = log.Append(&prolog.Record{
+		Value:      []byte("copy"),
+		ProducerId: "producer",
+		Sequence:   0,
+		OriginNode: "peer",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(8), off)
+	off, err = log.Append(&prolog.Record{Value: []byte("plain")})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(9), off)
+
+	//Producers' sequences are rebuilt from the log on reopening
+	assert.NoError(t, log.Close())
+	log, err = NewLog(dir, log.Config)
+	assert.NoError(t, err)
+	off, err = produce("producer", 7)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(7), off)
+	off, err = produce("producer", 8)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(10), off)
+	off, err = produce("other", 100)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(11), off)
+}
+
+func TestReadCommitted(t *testing.T) {
+	log, err := newTestLog()
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	appendRecord := func(txn string, marker prolog.Record_Marker) uint64 {
+		off, err := log.Append(&prolog.Record{
+			Value:         []byte(txn),
+			TransactionId: txn,
+			Marker:        marker,
+		})
+		assert.NoError(t, err)
+		return off
+	}
+	values := func(records []*prolog.Record) []string {
+		var v []string
+		for _, record := range records {
+			v = append(v, string(record.Value))
+		}
+		return v
+	}
+	appendRecord("", prolog.Record_NONE)            //0
+	appendRecord("committed", prolog.Record_NONE)   //1
+	appendRecord("aborted", prolog.Record_NONE)     //2
+	appendRecord("open", prolog.Record_NONE)        //3
+	appendRecord("committed", prolog.Record_COMMIT) //4
+	appendRecord("aborted", prolog.Record_ABORT)    //5
+	appendRecord("", prolog.Record_NONE)            //6
+
+	//Nothing past the open transaction's first record is stable
+	records, next, err := log.ReadCommitted(0, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"", "committed"}, values(records))
+	assert.Equal(t, uint64(3), next)
+	records, next, err = log.ReadCommitted(next, 0, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, records)
+	assert.Equal(t, uint64(3), next)
+	assert.Equal(t, []string{"open"}, log.OpenTransactions())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, log.WaitForCommitted(ctx, 3))
+
+	//Committing makes the rest stable, aborted records and markers are skipped
+	appendRecord("open", prolog.Record_COMMIT) //7
+	assert.NoError(t, log.WaitForCommitted(context.Background(), 3))
+	records, next, err = log.ReadCommitted(2, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"open", ""}, values(records))
+	assert.Equal(t, uint64(8), next)
+	assert.Empty(t, log.OpenTransactions())
+
+	//Reading uncommitted still sees everything
+	records, _, err = log.ReadRange(0, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 8, len(records))
+
+	//Transactions are rebuilt from the log on reopening
+	appendRecord("reopened", prolog.Record_NONE) //8
+	assert.NoError(t, log.Close())
+	log, err = NewLog(dir, log.Config)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"reopened"}, log.OpenTransactions())
+	records, next, err = log.ReadCommitted(0, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"", "committed", "open", ""}, values(records))
+	assert.Equal(t, uint64(8), next)
+}
+
+func TestAppendBatchFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-batch-failure-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	//An index with room for three records fails the batch's third
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 3 * entWidth
+	log, err := NewLog(dir, c)
+	assert.NoError(t, err)
+
+	_, err = log.Append(&prolog.Record{Value: []byte("first")})
+	assert.NoError(t, err)
+	var records []*prolog.Record
+	for i := 0; i < 5; i++ {
+		records = append(records, &prolog.Record{Value: []byte("record")})
+	}
+	_, err = log.AppendBatch(records)
+	assert.Error(t, err)
+
+	//None of the batch is left, the next append takes its place
+	_, err = log.Read(1)
+	assert.Error(t, err)
+	off, err := log.Append(&prolog.Record{Value: []byte("second")})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), off)
+}
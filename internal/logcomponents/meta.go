@@ -0,0 +1,93 @@
+package logcomponents
+
+import (
+	"os"
+	"time"
+
+	"github.com/tysontate/gommap"
+)
+
+var (
+	//meta file holds two unix nano timestamps
+	createdWidth  uint64 = 8
+	appendedWidth uint64 = 8
+	metaWidth            = createdWidth + appendedWidth
+)
+
+/*
+meta persists a segment's creation and last-append times so that its
+age survives restarts.
+*/
+type meta struct {
+	file *os.File
+	mmap gommap.MMap
+}
+
+func newMeta(f *os.File) (*meta, error) {
+	fi, err := os.Stat(f.Name())
+	if err != nil {
+		return nil, err
+	}
+	if uint64(fi.Size()) < metaWidth {
+		if err = os.Truncate(f.Name(), int64(metaWidth)); err != nil {
+			return nil, err
+		}
+	}
+	m := &meta{
+		file: f,
+	}
+	m.mmap, err = gommap.Map(
+		m.file.Fd(),
+		gommap.PROT_READ|gommap.PROT_WRITE,
+		gommap.MAP_SHARED,
+	)
+	if err != nil {
+		return nil, err
+	}
+	//Segments created before meta files existed are dated from first open
+	if enc.Uint64(m.mmap[:createdWidth]) == 0 {
+		enc.PutUint64(m.mmap[:createdWidth], uint64(time.Now().UnixNano()))
+	}
+	return m, nil
+}
+
+//Created returns when the segment was created
+func (m *meta) Created() time.Time {
+	return time.Unix(0, int64(enc.Uint64(m.mmap[:createdWidth])))
+}
+
+//LastAppend returns when a record was last appended, or Created if none was
+func (m *meta) LastAppend() time.Time {
+	appended := enc.Uint64(m.mmap[createdWidth:metaWidth])
+	if appended == 0 {
+		return m.Created()
+	}
+	return time.Unix(0, int64(appended))
+}
+
+func (m *meta) touch(t time.Time) {
+	enc.PutUint64(m.mmap[createdWidth:metaWidth], uint64(t.UnixNano()))
+}
+
+//copyFrom carries another segment's timestamps over, as when it is rewritten
+func (m *meta) copyFrom(o *meta) {
+	copy(m.mmap[:metaWidth], o.mmap[:metaWidth])
+}
+
+func (m *meta) sync() error {
+	if err := m.mmap.Sync(gommap.MS_SYNC); err != nil {
+		return err
+	}
+	return m.file.Sync()
+}
+
+func (m *meta) Close() error {
+	if err := m.sync(); err != nil {
+		return err
+	}
+	return m.file.Close()
+}
+
+func (m *meta) Name() string {
+	return m.file.Name()
+}
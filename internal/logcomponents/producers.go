@@ -0,0 +1,74 @@
+package logcomponents
+
+import "logstore/internal/log/proto"
+
+/*
+producerWindow is how many of a producer's latest appends to a log are
+remembered, so retries of any still in flight get their offsets back.
+*/
+const producerWindow = 5
+
+/*
+producers holds the latest appends each idempotent producer made to a
+log, to recognize their retries. Only records appended by clients count;
+replicated copies carry an origin and are checked where they came from.
+*/
+type producers map[string][]sequenced
+
+type sequenced struct {
+	sequence uint64
+	offset   uint64
+}
+
+func idempotent(record *proto.Record) bool {
+	return record.ProducerId != "" && record.OriginNode == ""
+}
+
+//track remembers record, just appended, as its producer's latest
+func (p producers) track(record *proto.Record) {
+	if !idempotent(record) {
+		return
+	}
+	recent := append(p[record.ProducerId], sequenced{
+		sequence: record.Sequence,
+		offset:   record.Offset,
+	})
+	if len(recent) > producerWindow {
+		recent = recent[len(recent)-producerWindow:]
+	}
+	p[record.ProducerId] = recent
+}
+
+/*
+check looks for record among its producer's latest appends before it's
+appended. A retry of one returns its offset and dup. Sequences past the
+next one expected, or retries too old to be remembered, are errors.
+Producers the log doesn't know, or has forgotten along with their
+records, may start from any sequence.
+*/
+func (p producers) check(record *proto.Record) (off uint64, dup bool, err error) {
+	recent, ok := p[record.ProducerId]
+	if !idempotent(record) || !ok {
+		return 0, false, nil
+	}
+	next := recent[len(recent)-1].sequence + 1
+	switch {
+	case record.Sequence == next:
+		return 0, false, nil
+	case record.Sequence > next:
+		return 0, false, proto.ErrOutOfOrderSequence{
+			ProducerId: record.ProducerId,
+			Expected:   next,
+			Sequence:   record.Sequence,
+		}
+	}
+	for _, s := range recent {
+		if s.sequence == record.Sequence {
+			return s.offset, true, nil
+		}
+	}
+	return 0, false, proto.ErrDuplicateSequence{
+		ProducerId: record.ProducerId,
+		Sequence:   record.Sequence,
+	}
+}
@@ -2,9 +2,22 @@ package logcomponents
 
 import (
 	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"logstore/internal/log/proto"
+	"math"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 )
@@ -12,12 +25,39 @@ import (
 type Replica struct {
 	DialOptions []grpc.DialOption
 	LocalServer proto.LogClient
+	//NodeName is reported to peers with how far they've been replicated,
+	//confirming appends made there with acks=all, and tells the records that
+	//originated here apart as they come back. Unset, nothing is reported
+	NodeName string
+	//ProgressDir holds how far each peer has been replicated, and each origin
+	//ingested, so restarts and rejoins resume there. Without it every join
+	//starts from offset 0
+	ProgressDir string
+	//Failed replication is retried after MinBackoff, doubling up to
+	//MaxBackoff while it keeps failing. 100ms and 10s by default
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	//BufferSize bounds the records received from a peer ahead of being
+	//appended, 64 by default. A full buffer stops reading from the peer
+	BufferSize int
+	//LagInterval is how often each peer's end is polled for lag, a second by default
+	LagInterval time.Duration
+	//Log, when set and still empty as the first peer joins, is bootstrapped
+	//from a snapshot of that peer's log rather than replaying it record by
+	//record. Snapshots are staged in SnapshotDir, which it needs as well
+	Log         *Log
+	SnapshotDir string
 	logger      *zap.Logger
 
-	mu      sync.Mutex
+	bootstrapped sync.Once
+	mu           sync.Mutex
 	servers map[string]chan struct{}
+	peers   map[string]*peerState
 	closed  bool
 	close   chan struct{}
+
+	ingestMu sync.Mutex
+	ingested map[string]*progress //by origin, the next of its offsets to take
 }
 
 func (r *Replica) init() {
@@ -27,64 +67,483 @@ func (r *Replica) init() {
 	if r.servers == nil {
 		r.servers = make(map[string]chan struct{})
 	}
+	if r.peers == nil {
+		r.peers = make(map[string]*peerState)
+	}
+	if r.ingested == nil {
+		r.ingested = make(map[string]*progress)
+	}
 	if r.close == nil {
 		r.close = make(chan struct{})
 	}
+	if r.MinBackoff == 0 {
+		r.MinBackoff = 100 * time.Millisecond
+	}
+	if r.MaxBackoff == 0 {
+		r.MaxBackoff = 10 * time.Second
+	}
+	if r.BufferSize == 0 {
+		r.BufferSize = 64
+	}
+	if r.LagInterval == 0 {
+		r.LagInterval = time.Second
+	}
 }
 
-func (r *Replica) replicate(addr string, leave chan struct{}) {
-	clientConn, err := grpc.Dial(addr, r.DialOptions...)
+/*
+replicate copies the records a peer holds that aren't here yet until it
+leaves or the Replica closes, reconnecting with backoff whenever it fails
+*/
+func (r *Replica) replicate(
+	name, addr string,
+	peer *peerState,
+	leave chan struct{},
+) {
+	//Every peer waits on the first one's bootstrap before reading its progress
+	r.bootstrapped.Do(func() {
+		if err := r.bootstrap(name, addr, leave); err != nil {
+			r.logError(err, "failed to install snapshot", addr)
+		}
+	})
+	progress, err := r.openProgress(name, peerProgress)
 	if err != nil {
-		r.logError(err, "failed to dial", addr)
+		r.logError(err, "failed to open progress", addr)
 		return
 	}
+	defer progress.Close()
+	peer.advance(progress.next)
+
+	backoff := r.MinBackoff
+	for {
+		progressed, err := r.stream(name, addr, progress, peer, leave)
+		if err == nil {
+			return
+		}
+		peer.fail(err)
+		r.logError(err, "failed to replicate", addr)
+		if progressed {
+			backoff = r.MinBackoff
+		}
+		select {
+		case <-r.close:
+			return
+		case <-leave:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > r.MaxBackoff {
+			backoff = r.MaxBackoff
+		}
+	}
+}
+
+/*
+stream replicates over one connection to the peer. It returns nil once
+the peer leaves or the Replica closes, otherwise the error that broke
+the stream and whether any records were replicated before it.
+*/
+func (r *Replica) stream(
+	name, addr string,
+	progress *progress,
+	peer *peerState,
+	leave chan struct{},
+) (bool, error) {
+	clientConn, err := grpc.Dial(addr, r.DialOptions...)
+	if err != nil {
+		return false, err
+	}
 	defer clientConn.Close()
 
 	client := proto.NewLogClient(clientConn)
 
-	ctx := context.Background()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	stream, err := client.ReadStream(
 		ctx,
-		&proto.ReadRequest{Offset: 0},
+		&proto.ReadRequest{Offset: progress.next},
 	)
 	if err != nil {
-		r.logError(err, "failed to read", addr)
-		return
+		return false, err
+	}
+
+	//reports holds the latest progress the reporter hasn't sent yet
+	reports := make(chan uint64, 1)
+	report := func(next uint64) {
+		select {
+		case <-reports:
+		default:
+		}
+		reports <- next
+	}
+	if r.NodeName != "" {
+		go r.report(ctx, client, reports, addr)
+		report(progress.next)
 	}
+	go r.pollLag(ctx, client, peer)
 
-	records := make(chan *proto.Record)
+	records := make(chan *proto.Record, r.BufferSize)
+	errs := make(chan error, 1)
 	go func() {
 		for {
 			recv, err := stream.Recv()
 			if err != nil {
-				r.logError(err, "failed to receive msg", addr)
+				errs <- err
+				return
+			}
+			select {
+			case records <- recv.Record:
+			case <-ctx.Done():
 				return
 			}
-			records <- recv.Record
 		}
 	}()
 
+	progressed := false
 	for {
 		select {
 		case <-r.close:
-			return
+			return progressed, nil
 		case <-leave:
-			return
+			return progressed, nil
+		case err = <-errs:
+			return progressed, err
 		case record := <-records:
-			_, err = r.LocalServer.Append(
+			peer.connect()
+			next := record.Offset + 1
+			if err = r.ingest(ctx, name, record); err != nil {
+				return progressed, err
+			}
+			//A crash before this lands re-copies the record on restart
+			if err = progress.advance(next); err != nil {
+				return progressed, err
+			}
+			progressed = true
+			peer.advance(next)
+			if r.NodeName != "" {
+				report(next)
+			}
+		}
+	}
+}
+
+/*
+bootstrap installs a snapshot of the peer's closed segments into the
+empty Log, then saves progress for the peer and every origin in it, so
+replication resumes where the snapshot ends. Other peers are still
+read from the start, for the records they relayed, but what came with
+the snapshot isn't taken again. Replication falls back to replaying the
+peer if it fails, or is given up as the peer leaves or the Replica closes.
+*/
+func (r *Replica) bootstrap(name, addr string, leave chan struct{}) error {
+	if r.Log == nil || r.SnapshotDir == "" || !r.Log.empty() {
+		return nil
+	}
+	dir := path.Join(r.SnapshotDir, url.PathEscape(name))
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	clientConn, err := grpc.Dial(addr, r.DialOptions...)
+	if err != nil {
+		return err
+	}
+	defer clientConn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-r.close:
+		case <-leave:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	stream, err := proto.NewLogClient(clientConn).GetSnapshot(
+		ctx,
+		&proto.GetSnapshotRequest{},
+	)
+	if err != nil {
+		return err
+	}
+	received, err := receiveSnapshot(stream, dir)
+	if err != nil || !received {
+		return err
+	}
+	origins, err := r.Log.install(dir, name)
+	if err != nil {
+		return err
+	}
+	if err = r.saveProgress(name, peerProgress, origins[name]); err != nil {
+		return err
+	}
+	for origin, next := range origins {
+		if origin == r.NodeName {
+			continue
+		}
+		if err = r.saveProgress(origin, originProgress, next); err != nil {
+			return err
+		}
+	}
+	r.logger.Info(
+		"installed snapshot",
+		zap.String("addr", addr),
+		zap.Uint64("next_offset", origins[name]),
+	)
+	return nil
+}
+
+/*
+receiveSnapshot writes the files streamed by GetSnapshot into dir,
+checking each against its checksum and that every store came with its
+index. Returns whether any segments came.
+*/
+func receiveSnapshot(
+	stream proto.Log_GetSnapshotClient,
+	dir string,
+) (bool, error) {
+	var f *os.File
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	hash := crc32.New(crcTable)
+	missingIndex := make(map[string]bool) //by segment, whether only its store came
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+		if f == nil {
+			name, ext := chunk.File, path.Ext(chunk.File)
+			if path.Base(name) != name ||
+				(ext != ".store" && ext != ".index" && name != installedFile) {
+				return false, fmt.Errorf("snapshot: unexpected file %q", name)
+			}
+			if f, err = os.Create(path.Join(dir, name)); err != nil {
+				return false, err
+			}
+			hash.Reset()
+		} else if chunk.File != path.Base(f.Name()) {
+			return false, fmt.Errorf("snapshot: %s ended early", f.Name())
+		}
+		if _, err = f.Write(chunk.Data); err != nil {
+			return false, err
+		}
+		hash.Write(chunk.Data)
+		if !chunk.End {
+			continue
+		}
+		if hash.Sum32() != chunk.Checksum {
+			return false, fmt.Errorf("snapshot: %s failed its checksum", chunk.File)
+		}
+		base := strings.TrimSuffix(chunk.File, path.Ext(chunk.File))
+		if path.Ext(chunk.File) == ".index" {
+			missingIndex[base] = false
+		} else if chunk.File != installedFile {
+			if _, ok := missingIndex[base]; !ok {
+				missingIndex[base] = true
+			}
+		}
+		err = f.Close()
+		f = nil
+		if err != nil {
+			return false, err
+		}
+	}
+	if f != nil {
+		return false, fmt.Errorf("snapshot: %s ended early", f.Name())
+	}
+	for base, missing := range missingIndex {
+		if missing {
+			return false, fmt.Errorf("snapshot: %s.store has no index", base)
+		}
+	}
+	return len(missingIndex) > 0, nil
+}
+
+/*
+report sends the peer the progress made replicating it until ctx is
+done, skipping ahead to the latest whenever it falls behind
+*/
+func (r *Replica) report(
+	ctx context.Context,
+	client proto.LogClient,
+	reports <-chan uint64,
+	addr string,
+) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case next := <-reports:
+			_, err := client.ReportProgress(
 				ctx,
-				&proto.AppendRequest{
-					Record: record,
+				&proto.ReportProgressRequest{
+					Node:       r.NodeName,
+					NextOffset: next,
 				},
 			)
-			if err != nil {
-				r.logError(err, "failed to append", addr)
-				return
+			if err != nil && ctx.Err() == nil {
+				r.logError(err, "failed to report progress", addr)
 			}
 		}
 	}
 }
 
+/*
+pollLag asks the peer for the end of its log every LagInterval until
+ctx is done, the first offset appended at or after the end of time
+being its next offset
+*/
+func (r *Replica) pollLag(
+	ctx context.Context,
+	client proto.LogClient,
+	peer *peerState,
+) {
+	ticker := time.NewTicker(r.LagInterval)
+	defer ticker.Stop()
+	for {
+		res, err := client.OffsetsForTimes(
+			ctx,
+			&proto.OffsetsForTimesRequest{Timestamps: []int64{math.MaxInt64}},
+		)
+		if err == nil && len(res.Offsets) == 1 {
+			peer.poll(res.Offsets[0])
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+/*
+ingest appends a record read from peer unless it's here already,
+stamping its origin on the way in. Every node pulls from every other,
+so a record comes along as many paths as there are peers, relayed by
+any that have it: it's taken from whichever brings it first, unless it
+originated here, and skipped on the others by its offset at its origin.
+Each log holds an origin's records in the order they were appended
+there, so what's behind the latest taken from an origin is here already.
+*/
+func (r *Replica) ingest(
+	ctx context.Context,
+	peer string,
+	record *proto.Record,
+) error {
+	if record.OriginNode == "" {
+		record.OriginNode = peer
+		record.OriginOffset = record.Offset
+	}
+	if record.OriginNode == r.NodeName {
+		return nil
+	}
+	//Held while appending, so two peers can't both bring the same record
+	r.ingestMu.Lock()
+	defer r.ingestMu.Unlock()
+	select {
+	case <-r.close:
+		return nil
+	default:
+	}
+	p, ok := r.ingested[record.OriginNode]
+	if !ok {
+		var err error
+		if p, err = r.openProgress(record.OriginNode, originProgress); err != nil {
+			return err
+		}
+		r.ingested[record.OriginNode] = p
+	}
+	if record.OriginOffset < p.next {
+		return nil
+	}
+	_, err := r.LocalServer.Append(ctx, &proto.AppendRequest{Record: record})
+	if err != nil {
+		return err
+	}
+	return p.advance(record.OriginOffset + 1)
+}
+
+/*
+progress tracks the next offset to replicate from a peer, or to take
+from an origin, persisted as a big endian uint64 when the Replica has
+a ProgressDir.
+*/
+const progressWidth = 8
+
+//Extensions of the progress files, by peer and by origin
+const (
+	peerProgress   = ".offset"
+	originProgress = ".origin"
+)
+
+type progress struct {
+	file *os.File
+	next uint64
+}
+
+func (r *Replica) openProgress(name, ext string) (*progress, error) {
+	p := &progress{}
+	if r.ProgressDir == "" {
+		return p, nil
+	}
+	if err := os.MkdirAll(r.ProgressDir, 0755); err != nil {
+		return nil, err
+	}
+	var err error
+	p.file, err = os.OpenFile(
+		path.Join(r.ProgressDir, url.PathEscape(name)+ext),
+		os.O_RDWR|os.O_CREATE,
+		0644,
+	)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, progressWidth)
+	if n, _ := p.file.ReadAt(b, 0); n == len(b) {
+		p.next = enc.Uint64(b)
+	}
+	return p, nil
+}
+
+//saveProgress sets the progress kept for name, with the extension ext
+func (r *Replica) saveProgress(name, ext string, next uint64) error {
+	p, err := r.openProgress(name, ext)
+	if err != nil {
+		return err
+	}
+	err = p.advance(next)
+	p.Close()
+	return err
+}
+
+func (p *progress) advance(next uint64) error {
+	p.next = next
+	if p.file == nil {
+		return nil
+	}
+	b := make([]byte, progressWidth)
+	enc.PutUint64(b, next)
+	_, err := p.file.WriteAt(b, 0)
+	return err
+}
+
+func (p *progress) Close() error {
+	if p.file == nil {
+		return nil
+	}
+	return p.file.Close()
+}
+
 func (r *Replica) Join(name, addr string) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -98,7 +557,8 @@ func (r *Replica) Join(name, addr string) error {
 		return nil
 	}
 	r.servers[name] = make(chan struct{})
-	go r.replicate(addr, r.servers[name])
+	r.peers[name] = newPeerState(name, addr)
+	go r.replicate(name, addr, r.peers[name], r.servers[name])
 
 	return nil
 }
@@ -113,9 +573,24 @@ func (r *Replica) Leave(name string) error {
 	}
 	close(r.servers[name])
 	delete(r.servers, name)
+	delete(r.peers, name)
 	return nil
 }
 
+//Replication describes how far each peer is replicated, ordered by name
+func (r *Replica) Replication() []*proto.ReplicationStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var statuses []*proto.ReplicationStatus
+	for _, peer := range r.peers {
+		statuses = append(statuses, peer.snapshot(time.Now()))
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Node < statuses[j].Node
+	})
+	return statuses
+}
+
 func (r *Replica) Close() error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -126,6 +601,12 @@ func (r *Replica) Close() error {
 	}
 	r.closed = true
 	close(r.close)
+
+	r.ingestMu.Lock()
+	defer r.ingestMu.Unlock()
+	for _, p := range r.ingested {
+		p.Close()
+	}
 	return nil
 }
 
@@ -136,3 +617,151 @@ func (r *Replica) logError(err error, msg, addr string) {
 		zap.Error(err),
 	)
 }
+
+/*
+peerState is replication's view of a peer. Lag counts the records
+between where replication has got to and the peer's next offset when
+last polled, and the time since replication last reached it.
+*/
+type peerState struct {
+	mu        sync.Mutex
+	name      string
+	addr      string
+	connected bool
+	next      uint64
+	peerNext  uint64
+	caughtUp  time.Time
+	errors    uint64
+	lastError string
+	ctx       context.Context //tagged with the peer for metrics
+}
+
+func newPeerState(name, addr string) *peerState {
+	ctx, _ := tag.New(context.Background(), tag.Upsert(peerKey, name))
+	return &peerState{
+		name:     name,
+		addr:     addr,
+		caughtUp: time.Now(),
+		ctx:      ctx,
+	}
+}
+
+func (p *peerState) connect() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.connected {
+		p.connected = true
+		stats.Record(p.ctx, connectedMeasure.M(1))
+	}
+}
+
+func (p *peerState) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.connected = false
+	p.errors++
+	p.lastError = err.Error()
+	stats.Record(p.ctx, connectedMeasure.M(0), errorsMeasure.M(1))
+}
+
+func (p *peerState) advance(next uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.next = next
+	p.update(time.Now())
+}
+
+func (p *peerState) poll(peerNext uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.connected = true
+	p.peerNext = peerNext
+	p.update(time.Now())
+	s := p.status(time.Now())
+	stats.Record(
+		p.ctx,
+		connectedMeasure.M(1),
+		lagRecordsMeasure.M(int64(s.LagRecords)),
+		lagSecondsMeasure.M(s.LagSeconds),
+	)
+}
+
+//update notes replication caught up. Callers hold mu
+func (p *peerState) update(now time.Time) {
+	if p.next >= p.peerNext {
+		p.caughtUp = now
+	}
+}
+
+func (p *peerState) snapshot(now time.Time) *proto.ReplicationStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status(now)
+}
+
+//status describes the peer's replication. Callers hold mu
+func (p *peerState) status(now time.Time) *proto.ReplicationStatus {
+	s := &proto.ReplicationStatus{
+		Node:           p.name,
+		RpcAddr:        p.addr,
+		Connected:      p.connected,
+		NextOffset:     p.next,
+		PeerNextOffset: p.peerNext,
+		Errors:         p.errors,
+		LastError:      p.lastError,
+	}
+	if p.next < p.peerNext {
+		s.LagRecords = p.peerNext - p.next
+		s.LagSeconds = now.Sub(p.caughtUp).Seconds()
+	}
+	return s
+}
+
+var (
+	peerKey = tag.MustNewKey("peer")
+
+	connectedMeasure = stats.Int64(
+		"logstore/replica/connected",
+		"1 while streaming from the peer, 0 after a failure",
+		stats.UnitDimensionless,
+	)
+	errorsMeasure = stats.Int64(
+		"logstore/replica/errors",
+		"Failures replicating the peer",
+		stats.UnitDimensionless,
+	)
+	lagRecordsMeasure = stats.Int64(
+		"logstore/replica/lag_records",
+		"Records the peer has that aren't replicated yet",
+		stats.UnitDimensionless,
+	)
+	lagSecondsMeasure = stats.Float64(
+		"logstore/replica/lag_seconds",
+		"Time since replication last caught up with the peer",
+		stats.UnitSeconds,
+	)
+)
+
+//ReplicaViews report each peer's replication, tagged by peer, once registered
+var ReplicaViews = []*view.View{
+	{
+		Measure:     connectedMeasure,
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{peerKey},
+	},
+	{
+		Measure:     errorsMeasure,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{peerKey},
+	},
+	{
+		Measure:     lagRecordsMeasure,
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{peerKey},
+	},
+	{
+		Measure:     lagSecondsMeasure,
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{peerKey},
+	},
+}
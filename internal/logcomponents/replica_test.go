@@ -0,0 +1,255 @@
+package logcomponents
+
+import (
+	"io/ioutil"
+	"logstore/internal/log/proto"
+	"logstore/internal/server"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+func TestReplica(t *testing.T) {
+	var logs []*Log
+	for i := 0; i < 2; i++ {
+		dir, err := ioutil.TempDir("", "replica-test")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dir)
+		log, err := NewLog(dir, Config{})
+		assert.NoError(t, err)
+		defer log.Close()
+		logs = append(logs, log)
+	}
+	peerLog, localLog := logs[0], logs[1]
+	peerAddr, stopPeer := serveLog(t, peerLog, "")
+	localAddr, stopLocal := serveLog(t, localLog, "")
+	defer stopLocal()
+
+	conn, err := grpc.Dial(localAddr, grpc.WithInsecure())
+	assert.NoError(t, err)
+	defer conn.Close()
+	replica := &Replica{
+		DialOptions: []grpc.DialOption{grpc.WithInsecure()},
+		LocalServer: proto.NewLogClient(conn),
+		MinBackoff:  10 * time.Millisecond,
+		MaxBackoff:  50 * time.Millisecond,
+		BufferSize:  1,
+		LagInterval: 20 * time.Millisecond,
+	}
+	defer replica.Close()
+
+	appendValues := func(values ...string) {
+		for _, value := range values {
+			_, err := peerLog.Append(&proto.Record{Value: []byte(value)})
+			assert.NoError(t, err)
+		}
+	}
+	//caughtUp waits until the local log holds n records and replication knows it
+	caughtUp := func(n uint64) {
+		assert.Eventually(t, func() bool {
+			high, err := localLog.HighestOffset()
+			assert.NoError(t, err)
+			peers := replica.Replication()
+			return high+1 == n &&
+				len(peers) == 1 &&
+				peers[0].Connected &&
+				peers[0].NextOffset == n &&
+				peers[0].PeerNextOffset == n &&
+				peers[0].LagRecords == 0
+		}, 3*time.Second, 20*time.Millisecond)
+	}
+
+	appendValues("uno", "dos", "tres")
+	assert.NoError(t, replica.Join("peer", peerAddr))
+	caughtUp(3)
+
+	//Losing the peer is counted, then retried until it's back
+	stopPeer()
+	assert.Eventually(t, func() bool {
+		peers := replica.Replication()
+		return !peers[0].Connected && peers[0].Errors > 0 &&
+			peers[0].LastError != ""
+	}, 3*time.Second, 20*time.Millisecond)
+	appendValues("cuatro", "cinco")
+	_, stopPeer = serveLog(t, peerLog, peerAddr)
+	defer stopPeer()
+	caughtUp(5)
+	record, err := localLog.Read(4)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("cinco"), record.Value)
+
+	assert.NoError(t, replica.Leave("peer"))
+	assert.Empty(t, replica.Replication())
+}
+
+func TestReplicaSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replica-snapshot-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	var logs []*Log
+	for _, name := range []string{"peer", "local"} {
+		assert.NoError(t, os.MkdirAll(path.Join(dir, name), 0755))
+		log, err := NewLog(path.Join(dir, name), c)
+		assert.NoError(t, err)
+		defer log.Close()
+		logs = append(logs, log)
+	}
+	peerLog, localLog := logs[0], logs[1]
+	for i := 0; i < 5; i++ {
+		_, err := peerLog.Append(&proto.Record{Value: []byte("record")})
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, peerLog.Truncate(1))
+	peerAddr, stopPeer := serveLog(t, peerLog, "")
+	defer stopPeer()
+	localAddr, stopLocal := serveLog(t, localLog, "")
+	defer stopLocal()
+
+	conn, err := grpc.Dial(localAddr, grpc.WithInsecure())
+	assert.NoError(t, err)
+	defer conn.Close()
+	replica := &Replica{
+		DialOptions: []grpc.DialOption{grpc.WithInsecure()},
+		LocalServer: proto.NewLogClient(conn),
+		ProgressDir: path.Join(dir, "replication"),
+		Log:         localLog,
+		SnapshotDir: path.Join(dir, "snapshot"),
+	}
+	defer replica.Close()
+	assert.NoError(t, replica.Join("peer", peerAddr))
+
+	//The new log starts where retention left the peer's, then follows it
+	_, err = peerLog.Append(&proto.Record{Value: []byte("tail")})
+	assert.NoError(t, err)
+	peerLowest, err := peerLog.LowestOffset()
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		high, err := localLog.HighestOffset()
+		return err == nil && high == 5
+	}, 3*time.Second, 20*time.Millisecond)
+	lowest, err := localLog.LowestOffset()
+	assert.NoError(t, err)
+	assert.Equal(t, peerLowest, lowest)
+	for off := lowest; off <= 5; off++ {
+		record, err := localLog.Read(off)
+		assert.NoError(t, err)
+		assert.Equal(t, "peer", record.OriginNode)
+		assert.Equal(t, off, record.OriginOffset)
+	}
+	record, err := localLog.Read(5)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("tail"), record.Value)
+}
+
+func TestReplicaRelay(t *testing.T) {
+	logs := map[string]*Log{}
+	addrs := map[string]string{}
+	stops := map[string]func(){}
+	replicas := map[string]*Replica{}
+	for _, name := range []string{"a", "b", "c"} {
+		dir, err := ioutil.TempDir("", "replica-relay-test")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dir)
+		assert.NoError(t, os.MkdirAll(path.Join(dir, "log"), 0755))
+		log, err := NewLog(path.Join(dir, "log"), Config{})
+		assert.NoError(t, err)
+		defer log.Close()
+		logs[name] = log
+		addrs[name], stops[name] = serveLog(t, log, "")
+		defer func(name string) { stops[name]() }(name)
+
+		conn, err := grpc.Dial(addrs[name], grpc.WithInsecure())
+		assert.NoError(t, err)
+		defer conn.Close()
+		replicas[name] = &Replica{
+			DialOptions: []grpc.DialOption{grpc.WithInsecure()},
+			LocalServer: proto.NewLogClient(conn),
+			NodeName:    name,
+			ProgressDir: path.Join(dir, "replication"),
+			MinBackoff:  10 * time.Millisecond,
+			MaxBackoff:  50 * time.Millisecond,
+		}
+		defer replicas[name].Close()
+	}
+	appendValues := func(name string, values ...string) {
+		for _, value := range values {
+			_, err := logs[name].Append(&proto.Record{Value: []byte(value)})
+			assert.NoError(t, err)
+		}
+	}
+	//holds waits until name's log holds values, then checks it keeps only those
+	holds := func(name string, values ...string) {
+		read := func() []string {
+			var held []string
+			for off := uint64(0); ; off++ {
+				record, err := logs[name].Read(off)
+				if err != nil {
+					return held
+				}
+				held = append(held, string(record.Value))
+			}
+		}
+		assert.Eventually(t, func() bool {
+			return len(read()) == len(values)
+		}, 3*time.Second, 20*time.Millisecond)
+		time.Sleep(100 * time.Millisecond)
+		assert.ElementsMatch(t, values, read())
+	}
+
+	appendValues("a", "uno", "dos")
+	assert.NoError(t, replicas["b"].Join("a", addrs["a"]))
+	holds("b", "uno", "dos")
+
+	//A node joining after the origin left gets its records through a relay
+	stops["a"]()
+	appendValues("b", "tres")
+	assert.NoError(t, replicas["c"].Join("b", addrs["b"]))
+	holds("c", "uno", "dos", "tres")
+	record, err := logs["c"].Read(0)
+	assert.NoError(t, err)
+	assert.Equal(t, "a", record.OriginNode)
+	assert.Equal(t, uint64(0), record.OriginOffset)
+
+	//and only once when the origin is back too, nor echoing anywhere
+	addrs["a"], stops["a"] = serveLog(t, logs["a"], addrs["a"])
+	appendValues("a", "cuatro")
+	for _, join := range [][2]string{
+		{"a", "b"}, {"a", "c"}, {"b", "c"}, {"c", "a"},
+	} {
+		assert.NoError(t, replicas[join[0]].Join(join[1], addrs[join[1]]))
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		holds(name, "uno", "dos", "tres", "cuatro")
+	}
+}
+
+//serveLog serves log without TLS or authorization on addr, any port when empty
+func serveLog(t *testing.T, log *Log, addr string) (string, func()) {
+	t.Helper()
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	ln, err := net.Listen("tcp", addr)
+	assert.NoError(t, err)
+	srv, err := server.NewGRPCServer(&server.Config{
+		CommitLog:   log,
+		Authorizer:  allowAll{},
+		Snapshotter: log,
+	})
+	assert.NoError(t, err)
+	go srv.Serve(ln)
+	return ln.Addr().String(), srv.Stop
+}
+
+type allowAll struct{}
+
+func (allowAll) Authorize(subject, object, action string) error {
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	prolog "logstore/internal/log/proto"
 	"os"
 	"path"
+	"time"
 
 	"google.golang.org/protobuf/proto"
 )
@@ -12,9 +13,25 @@ import (
 type segment struct {
 	store      *store
 	index      *index
+	meta       *meta
+	timeIndex  *timeIndex
 	baseOffset uint64
 	nextOffset uint64
 	config     Config
+	recovery   Recovery
+
+	maxTimestamp   int64  //latest timestamp stamped on a record
+	sinceTimeIndex uint64 //store bytes appended since the last time index entry
+}
+
+/*
+Recovery describes what was discarded from the tail of a segment when
+it was opened after an unclean shutdown.
+*/
+type Recovery struct {
+	BaseOffset       uint64
+	DiscardedEntries uint64 //index entries pointing at missing/torn records
+	DiscardedBytes   uint64 //store bytes past the last intact record
 }
 
 func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
@@ -46,54 +63,300 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	if s.index, err = newIndex(indexFile, c); err != nil {
 		return nil, err
 	}
+	metaFile, err := os.OpenFile(
+		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".meta")),
+		os.O_RDWR|os.O_CREATE,
+		0644,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if s.meta, err = newMeta(metaFile); err != nil {
+		return nil, err
+	}
+	timeIndexFile, err := os.OpenFile(
+		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".timeindex")),
+		os.O_RDWR|os.O_CREATE|os.O_APPEND,
+		0644,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if s.timeIndex, err = newTimeIndex(timeIndexFile, c); err != nil {
+		return nil, err
+	}
+	if s.recovery, err = s.recover(); err != nil {
+		return nil, err
+	}
 	//Check if there are any entries via index
 	if off, _, err := s.index.Read(-1); err != nil {
 		s.nextOffset = baseOffset
 	} else {
 		//If records exist, set offset to the position of the next entry
 		s.nextOffset = baseOffset + uint64(off) + 1
+		last, err := s.Read(s.nextOffset - 1)
+		if err != nil {
+			return nil, err
+		}
+		s.maxTimestamp = last.Timestamp
 	}
+	s.timeIndex.recover(s.nextOffset - baseOffset)
 	return s, nil
 }
 
 func (s *segment) Append(record *prolog.Record) (offset uint64, err error) {
+	record.Timestamp = time.Now().UnixNano()
+	return s.appendStamped(record)
+}
+
+/*
+appendStamped is Append for a record that already carries its timestamp,
+as those a Raft leader stamps for every replica to store alike.
+*/
+func (s *segment) appendStamped(record *prolog.Record) (offset uint64, err error) {
 	cur := s.nextOffset
 	record.Offset = cur
+	//Timestamps never go backwards within a segment, even if the clock does
+	if record.Timestamp < s.maxTimestamp {
+		record.Timestamp = s.maxTimestamp
+	}
+	if err = s.write(record); err != nil {
+		return 0, err
+	}
+	return cur, nil
+}
+
+/*
+write stores a record that already carries its offset and timestamp.
+Offsets must increase but may skip, as when compaction rewrites a segment.
+*/
+func (s *segment) write(record *prolog.Record) error {
 	//Marshal protobuf message
 	p, err := proto.Marshal(record)
 	if err != nil {
-		return 0, err
+		return err
 	}
 	//Write actual record to store
-	_, pos, err := s.store.Append(p)
+	n, pos, err := s.store.Append(p)
 	if err != nil {
-		return 0, err
+		return err
 	}
 	//Update index
-	if err = s.index.Write(
-		uint32(s.nextOffset-uint64(s.baseOffset)),
-		pos,
-	); err != nil {
-		return 0, err
+	rel := uint32(record.Offset - s.baseOffset)
+	if err = s.index.Write(rel, pos); err != nil {
+		return err
 	}
-	s.nextOffset++
-	return cur, nil
+	s.indexTime(record.Timestamp, rel, n)
+	s.meta.touch(time.Unix(0, record.Timestamp))
+	s.nextOffset = record.Offset + 1
+	return nil
+}
+
+/*
+indexTime adds a time index entry for the record just appended if
+IndexIntervalBytes have been written since the last one. The time index
+is only a lookup hint, so a full one is not an error.
+*/
+func (s *segment) indexTime(ts int64, rel uint32, n uint64) {
+	s.sinceTimeIndex += n
+	first := s.timeIndex.size == 0
+	if !first && (s.sinceTimeIndex < s.config.Segment.IndexIntervalBytes ||
+		ts <= s.maxTimestamp) {
+		s.maxTimestamp = ts
+		return
+	}
+	if err := s.timeIndex.Write(ts, rel); err == nil {
+		s.sinceTimeIndex = 0
+	}
+	s.maxTimestamp = ts
+}
+
+/*
+offsetForTime returns the first offset in the segment stamped at or
+after ts. ok is false when every record in the segment is older.
+*/
+func (s *segment) offsetForTime(ts int64) (offset uint64, ok bool, err error) {
+	if s.nextOffset == s.baseOffset || s.maxTimestamp < ts {
+		return 0, false, nil
+	}
+	var slot uint64
+	if rel, found := s.timeIndex.Lookup(ts); found {
+		slot = s.index.seek(rel)
+	}
+	for ; slot < s.index.size/entWidth; slot++ {
+		record, err := s.readSlot(slot)
+		if err != nil {
+			return 0, false, err
+		}
+		if record.Timestamp >= ts {
+			return record.Offset, true, nil
+		}
+	}
+	return 0, false, nil
 }
 
 func (s *segment) Read(off uint64) (*prolog.Record, error) {
 	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	if err != nil {
+		//Callers check the log's range first, anything missed is a hole
+		return nil, prolog.ErrOffNotPresent{Offset: off}
+	}
+	return s.readAt(off, pos)
+}
+
+//readSlot reads the record indexed by the nth index entry
+func (s *segment) readSlot(n uint64) (*prolog.Record, error) {
+	rel, pos, err := s.index.entry(n)
 	if err != nil {
 		return nil, err
 	}
+	return s.readAt(s.baseOffset+uint64(rel), pos)
+}
 
+func (s *segment) readAt(off, pos uint64) (*prolog.Record, error) {
 	p, err := s.store.Read(pos)
+	if err == errChecksum || err == errUnknownVersion {
+		return nil, prolog.ErrCorruptRecord{Offset: off}
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	record := &prolog.Record{}
-	err = proto.Unmarshal(p, record)
-	return record, err
+	if err = proto.Unmarshal(p, record); err != nil {
+		return nil, prolog.ErrCorruptRecord{Offset: off}
+	}
+	return record, nil
+}
+
+/*
+readRange calls fn with the records at and after off, in offset order,
+until it returns false. Only the first record is looked up in the index,
+the rest are read sequentially from the store. fn is also given the
+record's size in the store.
+*/
+func (s *segment) readRange(off uint64, fn func(*prolog.Record, uint64) bool) error {
+	slot := s.index.seek(uint32(off - s.baseOffset))
+	_, pos, err := s.index.entry(slot)
+	if err != nil {
+		return nil //nothing at or after off in this segment
+	}
+	var corrupt bool
+	n, err := s.store.scan(pos, func(p []byte) bool {
+		record := &prolog.Record{}
+		if err := proto.Unmarshal(p, record); err != nil {
+			corrupt = true
+			return false
+		}
+		return fn(record, uint64(len(p)))
+	})
+	if corrupt || err == errChecksum || err == errUnknownVersion {
+		rel, _, _ := s.index.entry(slot + n)
+		return prolog.ErrCorruptRecord{Offset: s.baseOffset + uint64(rel)}
+	}
+	return err
+}
+
+//scan calls fn with every record in the segment, in offset order
+func (s *segment) scan(fn func(*prolog.Record) error) error {
+	for n := uint64(0); n < s.index.size/entWidth; n++ {
+		record, err := s.readSlot(n)
+		if err != nil {
+			return err
+		}
+		if err = fn(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+recover walks the index backwards to the last entry whose record is
+intact and truncates the index and store to just past it.
+- the index file is grown to MaxIndexBytes on open and only shrunk on
+  Close, so after a crash its tail is zeroed slots
+- the store may hold a partial record, or records the index never saw
+*/
+func (s *segment) recover() (Recovery, error) {
+	r := Recovery{BaseOffset: s.baseOffset}
+	size := s.index.size
+	if size > uint64(len(s.index.mmap)) {
+		size = uint64(len(s.index.mmap))
+	}
+	s.index.size = size
+	entries := size / entWidth
+	var valid, end uint64
+	for n := entries; n > 0; n-- {
+		if e, ok := s.validEntry(n - 1); ok {
+			valid, end = n, e
+			break
+		}
+		if !s.index.blank(n - 1) {
+			r.DiscardedEntries++
+		}
+	}
+	s.index.truncate(valid)
+	if end < s.store.size {
+		r.DiscardedBytes = s.store.size - end
+		if err := s.store.truncate(end); err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
+
+/*
+validEntry checks the nth index entry against its neighbour and the
+store, returning the store position just past its record.
+*/
+func (s *segment) validEntry(n uint64) (uint64, bool) {
+	rel, pos, err := s.index.entry(n)
+	if err != nil {
+		return 0, false
+	}
+	//Offsets and positions only ever grow, which also rules out zeroed slots
+	if n > 0 {
+		prevRel, prevPos, err := s.index.entry(n - 1)
+		if err != nil || rel <= prevRel || pos <= prevPos {
+			return 0, false
+		}
+	}
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	if err := s.store.buf.Flush(); err != nil {
+		return 0, false
+	}
+	p, width, err := s.store.readEntry(pos)
+	if err != nil {
+		return 0, false
+	}
+	record := &prolog.Record{}
+	if err := proto.Unmarshal(p, record); err != nil {
+		return 0, false
+	}
+	if record.Offset != s.baseOffset+uint64(rel) {
+		return 0, false
+	}
+	return pos + width, true
+}
+
+//truncateFrom drops the records at and after off
+func (s *segment) truncateFrom(off uint64) error {
+	if off >= s.nextOffset {
+		return nil
+	}
+	rel := uint32(off - s.baseOffset)
+	slot := s.index.seek(rel)
+	if _, pos, err := s.index.entry(slot); err == nil {
+		s.index.truncate(slot)
+		if err = s.store.truncate(pos); err != nil {
+			return err
+		}
+	}
+	s.timeIndex.recover(uint64(rel))
+	s.nextOffset = off
+	return nil
 }
 
 func (s *segment) IsMaxed() bool {
@@ -106,6 +369,20 @@ func (s *segment) IsMaxed() bool {
 		s.index.size >= s.config.Segment.MaxStoreBytes
 }
 
+//sync commits the segment's store and index to stable storage
+func (s *segment) sync() error {
+	if err := s.store.sync(); err != nil {
+		return err
+	}
+	if err := s.meta.sync(); err != nil {
+		return err
+	}
+	if err := s.timeIndex.sync(); err != nil {
+		return err
+	}
+	return s.index.sync()
+}
+
 func (s *segment) Remove() error {
 	if err := s.Close(); err != nil {
 		return err
@@ -116,6 +393,12 @@ func (s *segment) Remove() error {
 	if err := os.Remove(s.store.Name()); err != nil {
 		return err
 	}
+	if err := os.Remove(s.meta.Name()); err != nil {
+		return err
+	}
+	if err := os.Remove(s.timeIndex.Name()); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -126,5 +409,11 @@ func (s *segment) Close() error {
 	if err := s.store.Close(); err != nil {
 		return err
 	}
+	if err := s.meta.Close(); err != nil {
+		return err
+	}
+	if err := s.timeIndex.Close(); err != nil {
+		return err
+	}
 	return nil
 }
@@ -54,3 +54,37 @@ func TestSegment(t *testing.T) {
 	assert.False(t, s.IsMaxed())
 
 }
+
+func TestSegmentHoles(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "seg-holes-test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := newSegment(dir, 16, c)
+	assert.NoError(t, err)
+	for _, off := range []uint64{16, 18, 21} {
+		err = s.write(&prolog.Record{Value: []byte("hello world"), Offset: off})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, uint64(22), s.nextOffset)
+
+	got, err := s.Read(18)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(18), got.Offset)
+
+	_, err = s.Read(19)
+	assert.Equal(t, prolog.ErrOffNotPresent{Offset: 19}, err)
+
+	//Holes survive a reopen
+	assert.NoError(t, s.Close())
+	s, err = newSegment(dir, 16, c)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(22), s.nextOffset)
+	got, err = s.Read(21)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(21), got.Offset)
+	assert.NoError(t, s.Remove())
+}
@@ -3,6 +3,8 @@ package logcomponents
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
+	"hash/crc32"
 	"os"
 	"sync"
 )
@@ -24,10 +26,31 @@ var (
 		- little endianness is superior when you want flexibility in the size of the data being represented
 	*/
 	enc = binary.BigEndian
+
+	//Castagnoli polynomial, hardware accelerated on most platforms
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errChecksum       = errors.New("store: checksum mismatch")
+	errUnknownVersion = errors.New("store: unknown entry version")
 )
 
+/*
+Store entry layout
+-----------------------
+- v1:     | version (1) | length (8) | crc32c of payload (4) | payload |
+- legacy: | length (8) | payload |
+
+Legacy entries are told apart by their first byte: it is the high byte
+of the length and is always zero, whereas v1 entries start with 1.
+*/
 const (
-	lenWidth = 8
+	lenWidth     = 8
+	versionWidth = 1
+	crcWidth     = 4
+	headerWidth  = versionWidth + lenWidth + crcWidth
+
+	legacyVersion byte = 0
+	entryVersion  byte = 1
 )
 
 type store struct {
@@ -50,54 +73,118 @@ func newStore(f *os.File) (*store, error) {
 	}, nil
 }
 
-//Append writes value bytes as a record to the file using the binary Write method
+//Append writes value bytes as a checksummed entry to the file
 func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	pos = s.size
-	//Writing length of record for later read at position
-	if err := binary.Write(s.buf, enc, uint64(len(p))); err != nil {
+	//Writing header (version, length, checksum) for later read at position
+	header := make([]byte, headerWidth)
+	header[0] = entryVersion
+	enc.PutUint64(header[versionWidth:versionWidth+lenWidth], uint64(len(p)))
+	enc.PutUint32(header[versionWidth+lenWidth:], crc32.Checksum(p, crcTable))
+	if _, err := s.buf.Write(header); err != nil {
 		return 0, 0, err
 	}
-	// log.Println("Record len: ", uint64(len(p)))
-	// log.Println("Appending: ", p)
-	// log.Println("Pos: ", pos)
-
 	//Writing actual record
 	w, err := s.buf.Write(p)
 	if err != nil {
 		return 0, 0, err
 	}
-
-	w += lenWidth
+	w += headerWidth
 	s.size += uint64(w)
 	return uint64(w), pos, nil
 }
 
-// Read reads bytes at a given postion and returns them
+// Read reads the entry at a given postion, verifies it and returns its payload
 func (s *store) Read(pos uint64) ([]byte, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if err := s.buf.Flush(); err != nil { //ensure no data is still in the buffer
 		return nil, err
 	}
-	//Read the first 8 bytes for length of record at position
-	size := make([]byte, lenWidth)
-	_, err := s.File.ReadAt(size, int64(pos))
-	if err != nil {
-		return nil, err
+	p, _, err := s.readEntry(pos)
+	return p, err
+}
+
+/*
+scan reads entries sequentially from pos straight through the file,
+handing each payload to fn until it returns false or the store ends.
+n counts the entries fn accepted, so on error the failing entry is the
+nth after pos.
+*/
+func (s *store) scan(pos uint64, fn func(p []byte) bool) (n uint64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return 0, err
+	}
+	for pos < s.size {
+		p, width, err := s.readEntry(pos)
+		if err != nil {
+			return n, err
+		}
+		if !fn(p) {
+			return n, nil
+		}
+		n++
+		pos += width
+	}
+	return n, nil
+}
+
+/*
+readEntry reads the entry at pos and returns its payload along with the
+number of bytes the entry occupies in the file. Callers must hold the
+lock and have flushed the buffer.
+*/
+func (s *store) readEntry(pos uint64) ([]byte, uint64, error) {
+	//The first byte tells the entry format apart
+	version := make([]byte, versionWidth)
+	if _, err := s.File.ReadAt(version, int64(pos)); err != nil {
+		return nil, 0, err
+	}
+	switch version[0] {
+	case legacyVersion:
+		return s.readLegacy(pos)
+	case entryVersion:
+	default:
+		return nil, 0, errUnknownVersion
+	}
+	header := make([]byte, lenWidth+crcWidth)
+	if _, err := s.File.ReadAt(header, int64(pos+versionWidth)); err != nil {
+		return nil, 0, err
 	}
-	// log.Println("N-read: ", n)
-	// log.Println("Size: ", size) //remove logs after test
-	// log.Println("Sint: ", enc.Uint64(size))
+	//A torn or flipped length must not make us allocate past the file
+	size := enc.Uint64(header[:lenWidth])
+	if size > s.size-pos-headerWidth {
+		return nil, 0, errChecksum
+	}
+	//Read the next `size` number of bytes after the header.
+	b := make([]byte, size)
+	if _, err := s.File.ReadAt(b, int64(pos+headerWidth)); err != nil {
+		return nil, 0, err
+	}
+	if crc32.Checksum(b, crcTable) != enc.Uint32(header[lenWidth:]) {
+		return nil, 0, errChecksum
+	}
+	return b, headerWidth + size, nil
+}
 
-	//Read the next `size` number of bytes after the length record.
+//readLegacy reads a length-prefixed entry written before checksums existed
+func (s *store) readLegacy(pos uint64) ([]byte, uint64, error) {
+	size := make([]byte, lenWidth)
+	if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
+		return nil, 0, err
+	}
+	if enc.Uint64(size) > s.size-pos-lenWidth {
+		return nil, 0, errChecksum
+	}
 	b := make([]byte, enc.Uint64(size))
-	if _, err := s.File.ReadAt(b, int64(pos+lenWidth)); err != nil { // try and read record of length lenWidth starting at position pos
-		return nil, err
+	if _, err := s.File.ReadAt(b, int64(pos+lenWidth)); err != nil {
+		return nil, 0, err
 	}
-	// log.Println("Read: ", b) //remove logs after test
-	return b, nil
+	return b, lenWidth + uint64(len(b)), nil
 }
 
 //TODO: This seems redudant?
@@ -110,6 +197,37 @@ func (s *store) ReadAt(p []byte, off int64) (int, error) {
 	return s.File.ReadAt(p, off)
 }
 
+//flush hands buffered entries to the OS
+func (s *store) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Flush()
+}
+
+//sync flushes buffered entries and commits the file to stable storage
+func (s *store) sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	return s.File.Sync()
+}
+
+//truncate discards everything in the file past size
+func (s *store) truncate(size uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	if err := s.File.Truncate(int64(size)); err != nil {
+		return err
+	}
+	s.size = size
+	return nil
+}
+
 //Close persists data before closing the store file
 func (s *store) Close() error {
 	s.mu.Lock()
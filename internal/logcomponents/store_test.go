@@ -10,7 +10,7 @@ import (
 
 var (
 	record = []byte("hello, world")
-	width  = uint64(len(record)) + lenWidth
+	width  = uint64(len(record)) + headerWidth
 )
 
 func TestStoreAppendRead(t *testing.T) {
@@ -62,13 +62,14 @@ func testRead(t *testing.T, s *store) {
 func testReadAt(t *testing.T, s *store) {
 	t.Helper()
 	for i, off := uint64(1), int64(0); i < 4; i++ {
-		b := make([]byte, lenWidth)
+		b := make([]byte, headerWidth)
 		n, err := s.ReadAt(b, off)
 		assert.Equal(t, err, nil)
-		assert.Equal(t, lenWidth, n)
+		assert.Equal(t, headerWidth, n)
+		assert.Equal(t, entryVersion, b[0])
 		off += int64(n)
 
-		size := enc.Uint64(b)
+		size := enc.Uint64(b[versionWidth : versionWidth+lenWidth])
 		b = make([]byte, size)
 		n, err = s.ReadAt(b, off)
 		assert.Equal(t, err, nil)
@@ -99,3 +100,52 @@ func TestStoreClose(t *testing.T) {
 	assert.Equal(t, err, nil)
 	assert.Equal(t, after > before, true)
 }
+
+func TestStoreChecksum(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_checksum_test")
+	assert.Equal(t, err, nil)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	assert.Equal(t, err, nil)
+	_, pos, err := s.Append(record)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, s.buf.Flush(), nil)
+
+	//Flip a bit in the payload
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, int64(pos+headerWidth))
+	assert.Equal(t, err, nil)
+	_, err = f.WriteAt([]byte{b[0] ^ 0x01}, int64(pos+headerWidth))
+	assert.Equal(t, err, nil)
+
+	_, err = s.Read(pos)
+	assert.Equal(t, errChecksum, err)
+}
+
+func TestStoreLegacy(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_legacy_test")
+	assert.Equal(t, err, nil)
+	defer os.Remove(f.Name())
+
+	//Entry in the pre-checksum format: length prefix followed by payload
+	legacy := make([]byte, lenWidth)
+	enc.PutUint64(legacy, uint64(len(record)))
+	legacy = append(legacy, record...)
+	_, err = f.Write(legacy)
+	assert.Equal(t, err, nil)
+
+	s, err := newStore(f)
+	assert.Equal(t, err, nil)
+	_, pos, err := s.Append(record)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, uint64(len(legacy)), pos)
+
+	read, err := s.Read(0)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, record, read)
+
+	read, err = s.Read(pos)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, record, read)
+}
@@ -0,0 +1,145 @@
+package logcomponents
+
+import (
+	"io"
+	"os"
+	"sort"
+
+	"github.com/tysontate/gommap"
+)
+
+var (
+	//time index entries pair a timestamp with the relative offset stamped with it
+	tsWidth     uint64 = 8
+	tsEntWidth         = tsWidth + offWidth
+)
+
+/*
+timeIndex is a sparse index from append time to offset. Entries are
+only written every IndexIntervalBytes of store data, so a lookup lands
+near the wanted record and the segment scans forward from there.
+*/
+type timeIndex struct {
+	file *os.File
+	mmap gommap.MMap
+	size uint64
+}
+
+func newTimeIndex(f *os.File, c Config) (*timeIndex, error) {
+	fi, err := os.Stat(f.Name())
+	if err != nil {
+		return nil, err
+	}
+	size := uint64(fi.Size())
+	err = os.Truncate(
+		f.Name(), int64(c.Segment.MaxIndexBytes),
+	)
+	if err != nil {
+		return nil, err
+	}
+	idx := &timeIndex{
+		file: f,
+		size: size,
+	}
+	idx.mmap, err = gommap.Map(
+		idx.file.Fd(),
+		gommap.PROT_READ|gommap.PROT_WRITE,
+		gommap.MAP_SHARED,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if idx.size > uint64(len(idx.mmap)) {
+		idx.size = uint64(len(idx.mmap))
+	}
+	idx.size -= idx.size % tsEntWidth
+	return idx, nil
+}
+
+func (t *timeIndex) entries() uint64 {
+	return t.size / tsEntWidth
+}
+
+//Read returns the nth entry
+func (t *timeIndex) Read(n uint64) (ts int64, rel uint32, err error) {
+	pos := n * tsEntWidth
+	if t.size < pos+tsEntWidth {
+		return 0, 0, io.EOF
+	}
+	ts = int64(enc.Uint64(t.mmap[pos : pos+tsWidth]))
+	rel = enc.Uint32(t.mmap[pos+tsWidth : pos+tsEntWidth])
+	return ts, rel, nil
+}
+
+func (t *timeIndex) Write(ts int64, rel uint32) error {
+	if uint64(len(t.mmap)) < t.size+tsEntWidth {
+		return io.EOF
+	}
+	enc.PutUint64(t.mmap[t.size:t.size+tsWidth], uint64(ts))
+	enc.PutUint32(t.mmap[t.size+tsWidth:t.size+tsEntWidth], rel)
+	t.size += tsEntWidth
+	return nil
+}
+
+/*
+Lookup returns the relative offset of the last entry stamped before ts,
+the point to start scanning from. ok is false when no entry is.
+*/
+func (t *timeIndex) Lookup(ts int64) (rel uint32, ok bool) {
+	n := sort.Search(int(t.entries()), func(i int) bool {
+		entTs, _, _ := t.Read(uint64(i))
+		return entTs >= ts
+	})
+	if n == 0 {
+		return 0, false
+	}
+	_, rel, _ = t.Read(uint64(n - 1))
+	return rel, true
+}
+
+/*
+recover drops trailing entries that are blank, out of order or refer
+to offsets at or past next, the segment's recovered relative end.
+*/
+func (t *timeIndex) recover(next uint64) {
+	n := t.entries()
+	for ; n > 0; n-- {
+		ts, rel, _ := t.Read(n - 1)
+		if ts == 0 || uint64(rel) >= next {
+			continue
+		}
+		if n > 1 {
+			prevTs, prevRel, _ := t.Read(n - 2)
+			if ts <= prevTs || rel <= prevRel {
+				continue
+			}
+		}
+		break
+	}
+	size := n * tsEntWidth
+	for j := size; j < t.size; j++ {
+		t.mmap[j] = 0
+	}
+	t.size = size
+}
+
+func (t *timeIndex) sync() error {
+	if err := t.mmap.Sync(gommap.MS_SYNC); err != nil {
+		return err
+	}
+	return t.file.Sync()
+}
+
+func (t *timeIndex) Close() error {
+	if err := t.sync(); err != nil {
+		return err
+	}
+	if err := t.file.Truncate(int64(t.size)); err != nil {
+		return err
+	}
+	return t.file.Close()
+}
+
+func (t *timeIndex) Name() string {
+	return t.file.Name()
+}
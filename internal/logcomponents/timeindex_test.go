@@ -0,0 +1,60 @@
+package logcomponents
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimeIndex(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "timeindex_test")
+	assert.Equal(t, err, nil)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	idx, err := newTimeIndex(f, c)
+	assert.Equal(t, err, nil)
+
+	_, ok := idx.Lookup(100)
+	assert.False(t, ok)
+	_, _, err = idx.Read(0)
+	assert.Equal(t, io.EOF, err)
+
+	entries := []struct {
+		Ts  int64
+		Rel uint32
+	}{
+		{Ts: 100, Rel: 0},
+		{Ts: 200, Rel: 5},
+		{Ts: 300, Rel: 9},
+	}
+	for _, want := range entries {
+		err = idx.Write(want.Ts, want.Rel)
+		assert.Equal(t, err, nil)
+	}
+
+	for ts, want := range map[int64]uint32{101: 0, 200: 0, 201: 5, 1000: 9} {
+		rel, ok := idx.Lookup(ts)
+		assert.True(t, ok)
+		assert.Equal(t, want, rel)
+	}
+	_, ok = idx.Lookup(100)
+	assert.False(t, ok)
+
+	//Entries past the segment's end are dropped on recovery
+	idx.recover(6)
+	assert.Equal(t, uint64(2), idx.entries())
+	assert.NoError(t, idx.Close())
+
+	f, _ = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	idx, err = newTimeIndex(f, c)
+	assert.Equal(t, err, nil)
+	ts, rel, err := idx.Read(idx.entries() - 1)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, int64(200), ts)
+	assert.Equal(t, uint32(5), rel)
+}
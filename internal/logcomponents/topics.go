@@ -0,0 +1,359 @@
+package logcomponents
+
+import (
+	"io/ioutil"
+	"logstore/internal/log/proto"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//partitionsFile in a topic's directory holds its partition count
+	partitionsFile = "partitions"
+	//A topic's directory is staged, and removed, under a hidden name
+	creatingExt = ".creating"
+	deletingExt = ".deleting"
+	//maxPartitions caps a topic's partitions, each holds open files
+	maxPartitions = 1024
+)
+
+var topicName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]{0,127}$`)
+
+/*
+Topics keeps named topics, each split into partitions that are
+independent Logs under Dir/<topic>/<partition>. Every partition is
+configured the same. Topics live only in the directory they were
+created in, nothing replicates them.
+*/
+type Topics struct {
+	Dir    string
+	Config Config
+
+	mu       sync.RWMutex
+	topics   map[string][]*Log
+	reserved map[string]bool
+}
+
+/*
+NewTopics opens the topics found in dir. Names in reserved can't be
+used for topics, for directories other components keep in dir.
+*/
+func NewTopics(dir string, c Config, reserved ...string) (*Topics, error) {
+	t := &Topics{
+		Dir:      dir,
+		Config:   c,
+		topics:   make(map[string][]*Log),
+		reserved: make(map[string]bool),
+	}
+	for _, name := range reserved {
+		t.reserved[name] = true
+	}
+	return t, t.setup()
+}
+
+/*
+setup removes topics left half created or half deleted by a crash and
+opens the rest. Directories without a partition count aren't topics.
+*/
+func (t *Topics) setup() error {
+	files, err := ioutil.ReadDir(t.Dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := file.Name()
+		if !file.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(name, ".") {
+			if path.Ext(name) == creatingExt || path.Ext(name) == deletingExt {
+				if err = os.RemoveAll(path.Join(t.Dir, name)); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		_, err := os.Stat(path.Join(t.Dir, name, partitionsFile))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		logs, err := t.open(name)
+		if err != nil {
+			t.Close()
+			return err
+		}
+		t.topics[name] = logs
+	}
+	return nil
+}
+
+//open opens the partitions of the topic stored under name
+func (t *Topics) open(name string) ([]*Log, error) {
+	b, err := ioutil.ReadFile(path.Join(t.Dir, name, partitionsFile))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != 4 {
+		return nil, proto.ErrInvalidTopic{
+			Topic:  name,
+			Reason: "corrupt partition count",
+		}
+	}
+	logs := make([]*Log, enc.Uint32(b))
+	for i := range logs {
+		dir := path.Join(t.Dir, name, strconv.Itoa(i))
+		if logs[i], err = NewLog(dir, t.Config); err != nil {
+			closeLogs(logs[:i])
+			return nil, err
+		}
+	}
+	return logs, nil
+}
+
+/*
+CreateTopic adds a topic with the given number of partitions, each
+empty. Its directory is built under a hidden name and renamed into
+place, so a crash never leaves a topic with partitions missing.
+*/
+func (t *Topics) CreateTopic(name string, partitions uint32) error {
+	if err := t.validate(name, partitions); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	dir := path.Join(t.Dir, name)
+	if _, ok := t.topics[name]; ok || t.reserved[name] {
+		return proto.ErrTopicExists{Topic: name}
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return proto.ErrTopicExists{Topic: name}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	staging := path.Join(t.Dir, "."+name+creatingExt)
+	if err := os.RemoveAll(staging); err != nil {
+		return err
+	}
+	for i := uint32(0); i < partitions; i++ {
+		p := path.Join(staging, strconv.FormatUint(uint64(i), 10))
+		if err := os.MkdirAll(p, 0755); err != nil {
+			return err
+		}
+	}
+	b := make([]byte, 4)
+	enc.PutUint32(b, partitions)
+	err := ioutil.WriteFile(path.Join(staging, partitionsFile), b, 0644)
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(staging, dir); err != nil {
+		return err
+	}
+	logs, err := t.open(name)
+	if err != nil {
+		return err
+	}
+	t.topics[name] = logs
+	return nil
+}
+
+func (t *Topics) validate(name string, partitions uint32) error {
+	switch {
+	case !topicName.MatchString(name):
+		return proto.ErrInvalidTopic{
+			Topic:  name,
+			Reason: "names are up to 128 letters, digits, '-' and '_'",
+		}
+	//The default log compacts into directories named like this
+	case strings.HasPrefix(name, compactDirPrefix):
+		return proto.ErrInvalidTopic{
+			Topic:  name,
+			Reason: "names can't start with " + compactDirPrefix,
+		}
+	case partitions == 0 || partitions > maxPartitions:
+		return proto.ErrInvalidTopic{
+			Topic:  name,
+			Reason: "topics have 1 to " + strconv.Itoa(maxPartitions) + " partitions",
+		}
+	}
+	return nil
+}
+
+//DeleteTopic closes the topic's partitions and removes their records
+func (t *Topics) DeleteTopic(name string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	logs, ok := t.topics[name]
+	if !ok {
+		return proto.ErrTopicNotFound{Topic: name}
+	}
+	delete(t.topics, name)
+	if err := closeLogs(logs); err != nil {
+		return err
+	}
+	deleting := path.Join(t.Dir, "."+name+deletingExt)
+	if err := os.Rename(path.Join(t.Dir, name), deleting); err != nil {
+		return err
+	}
+	return os.RemoveAll(deleting)
+}
+
+//ListTopics returns every topic, sorted by name
+func (t *Topics) ListTopics() []*proto.Topic {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	topics := make([]*proto.Topic, 0, len(t.topics))
+	for name, logs := range t.topics {
+		topics = append(topics, &proto.Topic{
+			Name:       name,
+			Partitions: uint32(len(logs)),
+		})
+	}
+	sort.Slice(topics, func(i, j int) bool {
+		return topics[i].Name < topics[j].Name
+	})
+	return topics
+}
+
+//Partitions returns the number of partitions in a topic
+func (t *Topics) Partitions(name string) (uint32, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	logs, ok := t.topics[name]
+	if !ok {
+		return 0, proto.ErrTopicNotFound{Topic: name}
+	}
+	return uint32(len(logs)), nil
+}
+
+//DescribeTopic returns the topic and the range of offsets in each partition
+func (t *Topics) DescribeTopic(name string) (
+	*proto.Topic,
+	[]*proto.PartitionInfo,
+	error,
+) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	logs, ok := t.topics[name]
+	if !ok {
+		return nil, nil, proto.ErrTopicNotFound{Topic: name}
+	}
+	partitions := make([]*proto.PartitionInfo, len(logs))
+	for i, l := range logs {
+		lowest, err := l.LowestOffset()
+		if err != nil {
+			return nil, nil, err
+		}
+		partitions[i] = &proto.PartitionInfo{
+			Partition:    uint32(i),
+			LowestOffset: lowest,
+			NextOffset:   l.nextOffset(),
+		}
+	}
+	topic := &proto.Topic{Name: name, Partitions: uint32(len(logs))}
+	return topic, partitions, nil
+}
+
+//Partition returns the log holding one of a topic's partitions
+func (t *Topics) Partition(topic string, partition uint32) (*Log, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	logs, ok := t.topics[topic]
+	if !ok {
+		return nil, proto.ErrTopicNotFound{Topic: topic}
+	}
+	if partition >= uint32(len(logs)) {
+		return nil, proto.ErrPartitionNotFound{Topic: topic, Partition: partition}
+	}
+	return logs[partition], nil
+}
+
+/*
+EnforceRetention enforces the retention policy on every partition,
+returning the number of segments removed.
+*/
+func (t *Topics) EnforceRetention(now time.Time) (int, error) {
+	return t.each(func(l *Log) (int, error) {
+		return l.EnforceRetention(now)
+	})
+}
+
+//Compact compacts every partition, returning the number of records removed
+func (t *Topics) Compact(now time.Time) (int, error) {
+	return t.each(func(l *Log) (int, error) {
+		return l.Compact(now)
+	})
+}
+
+/*
+OpenTransactions returns, by transaction ID, the partitions holding
+records of transactions appended to them that are still open.
+*/
+func (t *Topics) OpenTransactions() map[string][]*proto.TopicPartition {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	open := make(map[string][]*proto.TopicPartition)
+	for name, logs := range t.topics {
+		for p, l := range logs {
+			for _, id := range l.OpenTransactions() {
+				open[id] = append(open[id], &proto.TopicPartition{
+					Topic:     name,
+					Partition: uint32(p),
+				})
+			}
+		}
+	}
+	return open
+}
+
+/*
+each calls fn with every partition of every topic and sums what it
+returns. Topics can't be deleted meanwhile.
+*/
+func (t *Topics) each(fn func(*Log) (int, error)) (int, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var total int
+	for _, logs := range t.topics {
+		for _, l := range logs {
+			n, err := fn(l)
+			total += n
+			if err != nil {
+				return total, err
+			}
+		}
+	}
+	return total, nil
+}
+
+func (t *Topics) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for name, logs := range t.topics {
+		if err := closeLogs(logs); err != nil {
+			return err
+		}
+		delete(t.topics, name)
+	}
+	return nil
+}
+
+func closeLogs(logs []*Log) error {
+	for _, l := range logs {
+		if err := l.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
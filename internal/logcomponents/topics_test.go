@@ -0,0 +1,79 @@
+package logcomponents
+
+import (
+	"io/ioutil"
+	prolog "logstore/internal/log/proto"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "topics-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	topics, err := NewTopics(dir, Config{}, "raft")
+	assert.NoError(t, err)
+
+	assert.NoError(t, topics.CreateTopic("orders", 3))
+	assert.NoError(t, topics.CreateTopic("clicks", 1))
+	assert.Equal(t, prolog.ErrTopicExists{Topic: "orders"}, topics.CreateTopic("orders", 1))
+	assert.Equal(t, prolog.ErrTopicExists{Topic: "raft"}, topics.CreateTopic("raft", 1))
+	for _, name := range []string{"", ".orders", "a/b", "compact-1"} {
+		assert.IsType(t, prolog.ErrInvalidTopic{}, topics.CreateTopic(name, 1))
+	}
+	assert.IsType(t, prolog.ErrInvalidTopic{}, topics.CreateTopic("empty", 0))
+
+	l, err := topics.Partition("orders", 2)
+	assert.NoError(t, err)
+	_, err = l.Append(&prolog.Record{Value: []byte("order")})
+	assert.NoError(t, err)
+	_, err = topics.Partition("orders", 3)
+	assert.Equal(t, prolog.ErrPartitionNotFound{Topic: "orders", Partition: 3}, err)
+
+	list := topics.ListTopics()
+	assert.Equal(t, 2, len(list))
+	assert.Equal(t, "clicks", list[0].Name)
+	assert.Equal(t, uint32(3), list[1].Partitions)
+
+	//Topics are found again on reopening, half-created ones are cleaned up
+	assert.NoError(t, topics.Close())
+	staging := path.Join(dir, ".metrics"+creatingExt)
+	assert.NoError(t, os.MkdirAll(path.Join(staging, "0"), 0755))
+	topics, err = NewTopics(dir, Config{}, "raft")
+	assert.NoError(t, err)
+	defer topics.Close()
+	_, err = os.Stat(staging)
+	assert.True(t, os.IsNotExist(err))
+
+	topic, partitions, err := topics.DescribeTopic("orders")
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(3), topic.Partitions)
+	assert.Equal(t, uint64(0), partitions[0].NextOffset)
+	assert.Equal(t, uint64(1), partitions[2].NextOffset)
+
+	//Requests still holding a partition find it closed once it's deleted
+	held, err := topics.Partition("orders", 2)
+	assert.NoError(t, err)
+	assert.NoError(t, topics.DeleteTopic("orders"))
+	_, err = held.Append(&prolog.Record{Value: []byte("late")})
+	assert.Equal(t, errClosed, err)
+	_, err = held.AppendBatch([]*prolog.Record{{Value: []byte("late")}})
+	assert.Equal(t, errClosed, err)
+	_, err = held.Read(0)
+	assert.Equal(t, errClosed, err)
+	_, err = os.Stat(path.Join(dir, "orders"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = topics.Partition("orders", 0)
+	assert.Equal(t, prolog.ErrTopicNotFound{Topic: "orders"}, err)
+	assert.Equal(t, prolog.ErrTopicNotFound{Topic: "orders"}, topics.DeleteTopic("orders"))
+
+	//The name is free again
+	assert.NoError(t, topics.CreateTopic("orders", 1))
+	_, partitions, err = topics.DescribeTopic("orders")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), partitions[0].NextOffset)
+}
@@ -0,0 +1,80 @@
+package logcomponents
+
+import "logstore/internal/log/proto"
+
+/*
+transactions tracks the transactions a log holds records of, from the
+records and markers appended to it. Records of open transactions, and
+everything after the first of them, aren't stable yet: their fate is
+unknown, so read-committed readers stop short of them.
+*/
+type transactions struct {
+	open    map[string]openTransaction
+	aborted map[string]bool
+}
+
+type openTransaction struct {
+	first uint64 //offset of its first record in the log
+	local bool   //appended here rather than replicated from elsewhere
+}
+
+func newTransactions() *transactions {
+	return &transactions{
+		open:    make(map[string]openTransaction),
+		aborted: make(map[string]bool),
+	}
+}
+
+//track follows record, just appended, into or out of its transaction
+func (t *transactions) track(record *proto.Record) {
+	id := record.TransactionId
+	if id == "" {
+		return
+	}
+	switch record.Marker {
+	case proto.Record_NONE:
+		if _, ok := t.open[id]; !ok {
+			t.open[id] = openTransaction{
+				first: record.Offset,
+				local: record.OriginNode == "",
+			}
+		}
+	case proto.Record_ABORT:
+		t.aborted[id] = true
+		delete(t.open, id)
+	default:
+		delete(t.open, id)
+	}
+}
+
+//stable returns the offset reads are stable up to, given the log's next offset
+func (t *transactions) stable(next uint64) uint64 {
+	for _, txn := range t.open {
+		if txn.first < next {
+			next = txn.first
+		}
+	}
+	return next
+}
+
+/*
+committed reports whether a stable record is read committed: it isn't
+a marker, and it's outside a transaction or in one that committed.
+*/
+func (t *transactions) committed(record *proto.Record) bool {
+	if record.Marker != proto.Record_NONE {
+		return false
+	}
+	return record.TransactionId == "" || !t.aborted[record.TransactionId]
+}
+
+//local returns the open transactions appended to the log itself
+func (t *transactions) local() []string {
+	var ids []string
+	for id, txn := range t.open {
+		if txn.local {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
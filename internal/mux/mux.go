@@ -0,0 +1,225 @@
+package mux
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+Mux shares one listener between protocols. Each connection is routed
+by the first bytes its client writes:
+- a Route's Prefix is a marker written by Route.Dial; it is consumed,
+  and the connection wrapped in TLS when the route has a ServerTLSConfig
+- connections matching no prefix go to the Fallback listener untouched,
+  any bytes read while sniffing are replayed
+*/
+type Mux struct {
+	//SniffTimeout bounds how long a new connection has to pick a route
+	SniffTimeout time.Duration
+
+	ln       net.Listener
+	mu       sync.Mutex
+	routes   []*listener
+	fallback *listener
+	closed   chan struct{}
+	once     sync.Once
+}
+
+var ErrClosed = errors.New("mux: listener closed")
+
+func New(ln net.Listener) *Mux {
+	return &Mux{
+		SniffTimeout: 10 * time.Second,
+		ln:           ln,
+		closed:       make(chan struct{}),
+	}
+}
+
+/*
+Route is one protocol on the shared port. Prefixes must not be
+prefixes of one another.
+*/
+type Route struct {
+	Prefix []byte
+	//ServerTLSConfig secures connections accepted on the route
+	ServerTLSConfig *tls.Config
+	//PeerTLSConfig secures connections made with Dial
+	PeerTLSConfig *tls.Config
+}
+
+//Dial connects to the route on a Mux at addr
+func (r Route) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.Write(r.Prefix); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if r.PeerTLSConfig != nil {
+		conn = tls.Client(conn, r.PeerTLSConfig)
+	}
+	return conn, nil
+}
+
+//Listen returns a listener for connections on the route
+func (m *Mux) Listen(r Route) net.Listener {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l := m.newListener(r)
+	m.routes = append(m.routes, l)
+	return l
+}
+
+//Fallback returns a listener for connections matching no route
+func (m *Mux) Fallback() net.Listener {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fallback = m.newListener(Route{})
+	return m.fallback
+}
+
+func (m *Mux) newListener(r Route) *listener {
+	return &listener{
+		route:  r,
+		addr:   m.ln.Addr(),
+		conns:  make(chan net.Conn),
+		done:   make(chan struct{}),
+		closed: m.closed,
+	}
+}
+
+//Serve accepts connections until the Mux is closed
+func (m *Mux) Serve() error {
+	for {
+		conn, err := m.ln.Accept()
+		if err != nil {
+			select {
+			case <-m.closed:
+				return nil
+			default:
+				return err
+			}
+		}
+		go m.serve(conn)
+	}
+}
+
+func (m *Mux) serve(conn net.Conn) {
+	if m.SniffTimeout > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(m.SniffTimeout))
+	}
+	l, sniffed, err := m.match(conn)
+	if err != nil || l == nil {
+		conn.Close()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	//A route's prefix is consumed, whatever the fallback's sniffing read is not
+	if rest := sniffed[len(l.route.Prefix):]; len(rest) > 0 {
+		conn = &sniffedConn{
+			Conn: conn,
+			r:    io.MultiReader(bytes.NewReader(rest), conn),
+		}
+	}
+	if l.route.ServerTLSConfig != nil {
+		conn = tls.Server(conn, l.route.ServerTLSConfig)
+	}
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	case <-m.closed:
+		conn.Close()
+	}
+}
+
+/*
+match reads a byte at a time until the bytes read are a route's prefix,
+or no longer start any, returning the route's listener (the fallback,
+possibly nil, when none match) and the bytes read.
+*/
+func (m *Mux) match(conn net.Conn) (*listener, []byte, error) {
+	m.mu.Lock()
+	routes, fallback := m.routes, m.fallback
+	m.mu.Unlock()
+
+	var sniffed []byte
+	b := make([]byte, 1)
+	for {
+		candidates := 0
+		for _, l := range routes {
+			if !bytes.HasPrefix(l.route.Prefix, sniffed) {
+				continue
+			}
+			if len(l.route.Prefix) == len(sniffed) {
+				return l, sniffed, nil
+			}
+			candidates++
+		}
+		if candidates == 0 {
+			return fallback, sniffed, nil
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil, nil, err
+		}
+		sniffed = append(sniffed, b[0])
+	}
+}
+
+//Close stops Serve and closes the shared listener and every route
+func (m *Mux) Close() error {
+	var err error
+	m.once.Do(func() {
+		close(m.closed)
+		err = m.ln.Close()
+	})
+	return err
+}
+
+//listener hands out a route's connections. Closing it closes only the route
+type listener struct {
+	route  Route
+	addr   net.Addr
+	conns  chan net.Conn
+	done   chan struct{}
+	closed <-chan struct{} //the Mux's
+	once   sync.Once
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, ErrClosed
+	case <-l.closed:
+		return nil, ErrClosed
+	}
+}
+
+func (l *listener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.addr
+}
+
+//sniffedConn replays the bytes read while routing before reading on
+type sniffedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *sniffedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
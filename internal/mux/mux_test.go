@@ -0,0 +1,109 @@
+package mux
+
+import (
+	"io"
+	"io/ioutil"
+	"logstore/internal/config"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMux(t *testing.T) {
+	serverTLSConfig, err := config.SetupFromTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		Server:        true,
+		ServerAddress: "127.0.0.1",
+	})
+	assert.NoError(t, err)
+	peerTLSConfig, err := config.SetupFromTLSConfig(config.TLSConfig{
+		CertFile:      config.RootClientCertFile,
+		KeyFile:       config.RootClientKeyFile,
+		CAFile:        config.CAFile,
+		Server:        false,
+		ServerAddress: "127.0.0.1",
+	})
+	assert.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	m := New(ln)
+	plain := Route{Prefix: []byte{1}}
+	secure := Route{
+		Prefix:          []byte{2, 2},
+		ServerTLSConfig: serverTLSConfig,
+		PeerTLSConfig:   peerTLSConfig,
+	}
+	plainLn := m.Listen(plain)
+	secureLn := m.Listen(secure)
+	fallbackLn := m.Fallback()
+	served := make(chan error)
+	go func() {
+		served <- m.Serve()
+	}()
+
+	//accept echoes the first message on a connection back with the listener's name
+	accept := func(ln net.Listener, name string) {
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					b := make([]byte, 5)
+					if _, err := io.ReadFull(conn, b); err != nil {
+						return
+					}
+					conn.Write(append([]byte(name+":"), b...))
+				}()
+			}
+		}()
+	}
+	accept(plainLn, "plain")
+	accept(secureLn, "secure")
+	accept(fallbackLn, "fallback")
+
+	send := func(conn net.Conn, msg string) string {
+		_, err := conn.Write([]byte(msg))
+		assert.NoError(t, err)
+		b, err := ioutil.ReadAll(conn)
+		assert.NoError(t, err)
+		return string(b)
+	}
+	addr := ln.Addr().String()
+
+	conn, err := plain.Dial(addr, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, "plain:hello", send(conn, "hello"))
+
+	conn, err = secure.Dial(addr, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, "secure:hello", send(conn, "hello"))
+
+	//Bytes read while looking for a route reach the fallback
+	conn, err = net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	assert.Equal(t, "fallback:\x02hell", send(conn, "\x02hell"))
+
+	//Closing a route drops its connections and leaves the others up
+	assert.NoError(t, plainLn.Close())
+	conn, err = plain.Dial(addr, time.Second)
+	assert.NoError(t, err)
+	_, _ = conn.Write([]byte("hello"))
+	b, _ := ioutil.ReadAll(conn)
+	assert.Empty(t, b)
+	conn, err = net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	assert.Equal(t, "fallback:hello", send(conn, "hello"))
+
+	assert.NoError(t, m.Close())
+	assert.NoError(t, <-served)
+	_, err = secureLn.Accept()
+	assert.Equal(t, ErrClosed, err)
+}
@@ -2,7 +2,11 @@ package server
 
 import (
 	"context"
+	"hash/crc32"
+	"io"
 	"logstore/internal/log/proto"
+	"os"
+	"path/filepath"
 
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	grpc_auth "github.com/grpc-ecosystem/go-grpc-middleware/auth"
@@ -27,6 +31,22 @@ import (
 type Config struct {
 	CommitLog  CommitLog
 	Authorizer Authorizer
+	//GetServerer lists the cluster's members
+	GetServerer GetServerer
+	//Acknowledger confirms appends reached other servers, needed for acks=all
+	Acknowledger Acknowledger
+	//ReplicationReporter describes replication from peers, unset in Raft mode
+	ReplicationReporter ReplicationReporter
+	//Snapshotter serves snapshots of the log for new nodes to start from
+	Snapshotter Snapshotter
+	//TopicManager keeps the named topics served beside CommitLog's default topic
+	TopicManager TopicManager
+	//Partitioner picks the partition for appends to a topic that leave it unset
+	Partitioner Partitioner
+	//GroupCoordinator keeps consumer groups and the offsets they commit
+	GroupCoordinator GroupCoordinator
+	//TransactionCoordinator keeps the transactions open on this server
+	TransactionCoordinator TransactionCoordinator
 }
 
 /*
@@ -34,7 +54,93 @@ CommitLog interface
 */
 type CommitLog interface {
 	Append(*proto.Record) (uint64, error)
+	AppendBatch([]*proto.Record) (uint64, error)
 	Read(uint64) (*proto.Record, error)
+	ReadRange(from, maxRecords, maxBytes uint64) ([]*proto.Record, uint64, error)
+	WaitForOffset(ctx context.Context, off uint64) error
+	OffsetForTime(time.Time) (uint64, error)
+	//ReadCommitted and WaitForCommitted serve read-committed readers
+	ReadCommitted(from, maxRecords, maxBytes uint64) ([]*proto.Record, uint64, error)
+	WaitForCommitted(ctx context.Context, off uint64) error
+}
+
+/*
+GetServerer lists the servers in the cluster, their roles and how far
+their logs reach, for clients to balance across and operators to inspect
+*/
+type GetServerer interface {
+	GetServers() ([]*proto.Server, error)
+}
+
+/*
+Acknowledger tracks the progress other servers report replicating this
+one, to wait on appends made with acks=all
+*/
+type Acknowledger interface {
+	ReportProgress(node string, next uint64)
+	WaitForReplicas(ctx context.Context, off uint64, replicas uint32) error
+}
+
+//ReplicationReporter describes how far this server is replicating each peer
+type ReplicationReporter interface {
+	Replication() []*proto.ReplicationStatus
+}
+
+/*
+Snapshotter opens the files making up a snapshot of the log, for
+GetSnapshot to send the first sizes bytes of and close
+*/
+type Snapshotter interface {
+	SnapshotFiles() (files []*os.File, sizes []int64, err error)
+}
+
+/*
+TopicManager keeps named topics, each split into partitions that are
+logs of their own. The default topic, named "", is CommitLog and isn't
+kept here.
+*/
+type TopicManager interface {
+	CreateTopic(name string, partitions uint32) error
+	DeleteTopic(name string) error
+	ListTopics() []*proto.Topic
+	Partitions(topic string) (uint32, error)
+	DescribeTopic(name string) (*proto.Topic, []*proto.PartitionInfo, error)
+	Partition(topic string, partition uint32) (CommitLog, error)
+}
+
+/*
+Partitioner picks one of a topic's partitions for a record, by its key
+so records sharing one stay in order
+*/
+type Partitioner interface {
+	Partition(record *proto.Record, partitions uint32) uint32
+}
+
+/*
+GroupCoordinator assigns the members of consumer groups partitions to
+read and keeps the offsets the groups commit
+*/
+type GroupCoordinator interface {
+	JoinGroup(
+		group, member string,
+		topics []string,
+		session time.Duration,
+	) (*proto.Assignment, error)
+	Heartbeat(group, member string) (*proto.Assignment, error)
+	LeaveGroup(group, member string) error
+	CommitOffset(*proto.CommitOffsetRequest) error
+	FetchCommittedOffset(group, topic string, partition uint32) (uint64, bool)
+}
+
+/*
+TransactionCoordinator keeps transactions, whose appends to any
+partitions become visible to read-committed readers together
+*/
+type TransactionCoordinator interface {
+	BeginTransaction() (string, error)
+	Append(id, topic string, partition uint32, record *proto.Record) (uint64, error)
+	CommitTransaction(id string) error
+	AbortTransaction(id string) error
 }
 
 type Authorizer interface {
@@ -47,6 +153,19 @@ const (
 	objWildCard  = "*"
 	appendAction = "append"
 	readAction   = "read"
+	//replicateAction is held by the peer certificates replicas dial with
+	replicateAction = "replicate"
+	//adminAction is needed to create and delete topics
+	adminAction = "admin"
+)
+
+//snapshotChunkBytes is the most file data sent in one SnapshotChunk
+const snapshotChunkBytes = 64 << 10
+
+//Page limits used when a ReadRange request leaves them unset
+const (
+	defaultRangeRecords = 1000
+	defaultRangeBytes   = 1 << 20
 )
 
 func NewGRPCServer(config *Config, opts ...grpc.ServerOption) (
@@ -134,25 +253,177 @@ func (s *grpcServer) Append(
 	); err != nil {
 		return nil, err
 	}
-	off, err := s.CommitLog.Append(req.Record)
+	res, err := s.append(ctx, req)
+	if res == nil && err == nil {
+		res = &proto.AppendResponse{}
+	}
+	return res, err
+}
+
+/*
+append appends req's record, then waits as long as its acks level asks
+or ctx allows. With acks=none nothing is acknowledged: it returns no
+response and no error, and only logs a failure.
+*/
+func (s *grpcServer) append(
+	ctx context.Context,
+	req *proto.AppendRequest,
+) (*proto.AppendResponse, error) {
+	if req.Acks == proto.AppendRequest_ALL && s.Acknowledger == nil {
+		return nil, status.Error(
+			codes.FailedPrecondition,
+			"server can't confirm replicas",
+		)
+	}
+	if req.Acks == proto.AppendRequest_ALL && req.Topic != "" {
+		return nil, status.Error(
+			codes.FailedPrecondition,
+			"topics aren't replicated, only the default topic is",
+		)
+	}
+	partition, err := s.partition(req)
+	if err != nil {
+		return nil, err
+	}
+	log, err := s.commitLog(req.Topic, partition)
+	if err != nil {
+		return nil, err
+	}
+	if req.TransactionId != "" && s.TransactionCoordinator == nil {
+		return nil, errNoTransactions
+	}
+	if req.Record != nil {
+		req.Record.Topic, req.Record.Partition = req.Topic, partition
+		if req.ProducerId != "" {
+			req.Record.ProducerId, req.Record.Sequence = req.ProducerId, req.Sequence
+		}
+		//Only the coordinator tags records with transactions and markers
+		req.Record.TransactionId, req.Record.Marker = "", proto.Record_NONE
+	}
+	var off uint64
+	if req.TransactionId != "" {
+		off, err = s.TransactionCoordinator.Append(
+			req.TransactionId,
+			req.Topic,
+			partition,
+			req.Record,
+		)
+	} else {
+		off, err = log.Append(req.Record)
+	}
+	if req.Acks == proto.AppendRequest_NONE {
+		if err != nil {
+			zap.L().Named("server").Error("failed to append", zap.Error(err))
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if req.Acks == proto.AppendRequest_ALL {
+		replicas := req.Replicas
+		if replicas == 0 {
+			replicas = 1
+		}
+		err = s.Acknowledger.WaitForReplicas(ctx, off, replicas)
+		if err != nil && ctx.Err() != nil {
+			return nil, status.FromContextError(ctx.Err()).Err()
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return &proto.AppendResponse{Offset: off, Partition: partition}, nil
+}
+
+/*
+partition returns the partition req appends to, picking one of its
+topic's when it's left unset.
+*/
+func (s *grpcServer) partition(req *proto.AppendRequest) (uint32, error) {
+	if req.Partition != nil || req.Topic == "" {
+		return req.GetPartition(), nil
+	}
+	//Sequences count a producer's appends to one partition
+	if req.ProducerId != "" {
+		return 0, status.Error(
+			codes.InvalidArgument,
+			"idempotent appends to a topic must name the partition",
+		)
+	}
+	if s.TopicManager == nil {
+		return 0, proto.ErrTopicNotFound{Topic: req.Topic}
+	}
+	if s.Partitioner == nil {
+		return 0, status.Error(
+			codes.InvalidArgument,
+			"server can't pick a partition, the append must name one",
+		)
+	}
+	partitions, err := s.TopicManager.Partitions(req.Topic)
+	if err != nil {
+		return 0, err
+	}
+	return s.Partitioner.Partition(req.Record, partitions), nil
+}
+
+func (s *grpcServer) ProduceBatch(
+	ctx context.Context,
+	req *proto.ProduceBatchRequest,
+) (*proto.ProduceBatchResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objWildCard,
+		appendAction,
+	); err != nil {
+		return nil, err
+	}
+	log, err := s.commitLog(req.Topic, req.Partition)
 	if err != nil {
 		return nil, err
 	}
-	return &proto.AppendResponse{Offset: off}, nil
+	for _, record := range req.Records {
+		if record.ProducerId != "" {
+			return nil, status.Error(
+				codes.InvalidArgument,
+				"idempotent producers append one record at a time",
+			)
+		}
+		record.Topic, record.Partition = req.Topic, req.Partition
+		record.TransactionId, record.Marker = "", proto.Record_NONE
+	}
+	base, err := log.AppendBatch(req.Records)
+	if err != nil {
+		return nil, err
+	}
+	return &proto.ProduceBatchResponse{
+		BaseOffset: base,
+		Count:      uint64(len(req.Records)),
+	}, nil
 }
 
 func (s *grpcServer) AppendStream(
 	stream proto.Log_AppendStreamServer, //interface, not pointer to interface
 ) error {
+	//The subject can't change mid-stream, so authorize it once
+	if err := s.Authorizer.Authorize(
+		subject(stream.Context()),
+		objWildCard,
+		appendAction,
+	); err != nil {
+		return err
+	}
 	for {
 		req, err := stream.Recv()
 		if err != nil {
 			return err
 		}
-		res, err := s.Append(stream.Context(), req)
+		res, err := s.append(stream.Context(), req)
 		if err != nil {
 			return err
 		}
+		if res == nil {
+			continue
+		}
 		if err = stream.Send(res); err != nil {
 			return err
 		}
@@ -168,36 +439,489 @@ func (s *grpcServer) Read(ctx context.Context, req *proto.ReadRequest) (
 	); err != nil {
 		return nil, err
 	}
-	record, err := s.CommitLog.Read(req.Offset)
+	log, err := s.commitLog(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	read := log.Read
+	if req.Isolation == proto.Isolation_READ_COMMITTED {
+		read = func(off uint64) (*proto.Record, error) {
+			return readCommitted(log, off)
+		}
+	}
+	record, err := read(req.Offset)
 	if err != nil {
 		return nil, err
 	}
 	return &proto.ReadResponse{Record: record}, nil
 }
 
+/*
+readCommitted reads the record at off for a read-committed reader. Past
+the log's stable offset is out of range, as the end of the log is for
+other readers, and a marker or aborted record isn't present.
+*/
+func readCommitted(log CommitLog, off uint64) (*proto.Record, error) {
+	records, next, err := log.ReadCommitted(off, 1, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) > 0 && records[0].Offset == off {
+		return records[0], nil
+	}
+	if len(records) == 0 && next == off {
+		return nil, proto.ErrOffOutOfRange{Offset: off}
+	}
+	return nil, proto.ErrOffNotPresent{Offset: off}
+}
+
+func (s *grpcServer) ReadRange(
+	ctx context.Context,
+	req *proto.ReadRangeRequest,
+) (*proto.ReadRangeResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objWildCard,
+		readAction,
+	); err != nil {
+		return nil, err
+	}
+	log, err := s.commitLog(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	return readRange(log, req)
+}
+
+func readRange(log CommitLog, req *proto.ReadRangeRequest) (
+	*proto.ReadRangeResponse, error) {
+	maxRecords, maxBytes := req.MaxRecords, req.MaxBytes
+	if maxRecords == 0 {
+		maxRecords = defaultRangeRecords
+	}
+	if maxBytes == 0 {
+		maxBytes = defaultRangeBytes
+	}
+	read := log.ReadRange
+	if req.Isolation == proto.Isolation_READ_COMMITTED {
+		read = log.ReadCommitted
+	}
+	records, next, err := read(req.Offset, maxRecords, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	return &proto.ReadRangeResponse{Records: records, NextOffset: next}, nil
+}
+
 func (s *grpcServer) ReadStream(
 	req *proto.ReadRequest,
 	stream proto.Log_ReadStreamServer,
 ) error {
+	if err := s.Authorizer.Authorize(
+		subject(stream.Context()),
+		objWildCard,
+		readAction,
+	); err != nil {
+		return err
+	}
+	log, err := s.commitLog(req.Topic, req.Partition)
+	if err != nil {
+		return err
+	}
+	ctx := stream.Context()
+	page := &proto.ReadRangeRequest{Offset: req.Offset, Isolation: req.Isolation}
+	wait := log.WaitForOffset
+	if req.Isolation == proto.Isolation_READ_COMMITTED {
+		wait = log.WaitForCommitted
+	}
 	for {
-		select {
-		case <-stream.Context().Done():
-			return nil
+		res, err := readRange(log, page)
+		switch err.(type) {
+		case nil:
+		case proto.ErrOffOutOfRange:
+			//Past the end, wait for the log to grow into range. Still out
+			//of range after that means the offset is behind the log's start
+			if err = wait(ctx, page.Offset); err != nil {
+				return waitEnded(ctx, err)
+			}
+			if res, err = readRange(log, page); err != nil {
+				return err
+			}
 		default:
-			res, err := s.Read(stream.Context(), req)
-			switch err.(type) {
-			case nil:
-			case proto.ErrOffOutOfRange:
-				continue
-			default:
+			return err
+		}
+		for _, record := range res.Records {
+			if err = stream.Send(&proto.ReadResponse{Record: record}); err != nil {
+				return err
+			}
+		}
+		page.Offset = res.NextOffset
+		//Caught up, block until something new is appended
+		if len(res.Records) == 0 {
+			if err = wait(ctx, page.Offset); err != nil {
+				return waitEnded(ctx, err)
+			}
+		}
+	}
+}
+
+/*
+waitEnded ends a stream quietly once its client has gone, otherwise
+with why the log stopped, as when its topic was deleted.
+*/
+func waitEnded(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+func (s *grpcServer) OffsetsForTimes(
+	ctx context.Context,
+	req *proto.OffsetsForTimesRequest,
+) (*proto.OffsetsForTimesResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objWildCard,
+		readAction,
+	); err != nil {
+		return nil, err
+	}
+	log, err := s.commitLog(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	offsets := make([]uint64, len(req.Timestamps))
+	for i, ts := range req.Timestamps {
+		off, err := log.OffsetForTime(time.Unix(0, ts))
+		if err != nil {
+			return nil, err
+		}
+		offsets[i] = off
+	}
+	return &proto.OffsetsForTimesResponse{Offsets: offsets}, nil
+}
+
+func (s *grpcServer) GetServers(
+	ctx context.Context,
+	req *proto.GetServersRequest,
+) (*proto.GetServersResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objWildCard,
+		readAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.GetServerer == nil {
+		return nil, status.Error(
+			codes.Unimplemented,
+			"server doesn't know its cluster",
+		)
+	}
+	servers, err := s.GetServerer.GetServers()
+	if err != nil {
+		return nil, err
+	}
+	return &proto.GetServersResponse{Servers: servers}, nil
+}
+
+func (s *grpcServer) ReportProgress(
+	ctx context.Context,
+	req *proto.ReportProgressRequest,
+) (*proto.ReportProgressResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objWildCard,
+		replicateAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.Acknowledger == nil {
+		return nil, status.Error(
+			codes.Unimplemented,
+			"server doesn't track replicas",
+		)
+	}
+	s.Acknowledger.ReportProgress(req.Node, req.NextOffset)
+	return &proto.ReportProgressResponse{}, nil
+}
+
+func (s *grpcServer) GetReplication(
+	ctx context.Context,
+	req *proto.GetReplicationRequest,
+) (*proto.GetReplicationResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objWildCard,
+		readAction,
+	); err != nil {
+		return nil, err
+	}
+	res := &proto.GetReplicationResponse{}
+	if s.ReplicationReporter != nil {
+		res.Peers = s.ReplicationReporter.Replication()
+	}
+	return res, nil
+}
+
+func (s *grpcServer) GetSnapshot(
+	req *proto.GetSnapshotRequest,
+	stream proto.Log_GetSnapshotServer,
+) error {
+	if err := s.Authorizer.Authorize(
+		subject(stream.Context()),
+		objWildCard,
+		readAction,
+	); err != nil {
+		return err
+	}
+	if s.Snapshotter == nil {
+		return status.Error(
+			codes.Unimplemented,
+			"server doesn't serve snapshots",
+		)
+	}
+	files, sizes, err := s.Snapshotter.SnapshotFiles()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	b := make([]byte, snapshotChunkBytes)
+	for i, f := range files {
+		name := filepath.Base(f.Name())
+		hash := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+		r := io.LimitReader(f, sizes[i])
+		for {
+			n, err := io.ReadFull(r, b)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = nil
+			} else if err != nil {
 				return err
 			}
-			if err = stream.Send(res); err != nil {
+			hash.Write(b[:n])
+			chunk := &proto.SnapshotChunk{File: name, Data: b[:n]}
+			if n < len(b) {
+				chunk.End = true
+				chunk.Checksum = hash.Sum32()
+			}
+			if err = stream.Send(chunk); err != nil {
 				return err
 			}
-			req.Offset++
+			if chunk.End {
+				break
+			}
 		}
 	}
+	return nil
+}
+
+/*
+commitLog finds the log a request is for: CommitLog for the default
+topic, otherwise one of the TopicManager's partitions.
+*/
+func (s *grpcServer) commitLog(topic string, partition uint32) (CommitLog, error) {
+	if topic == "" {
+		if partition != 0 {
+			return nil, proto.ErrPartitionNotFound{Partition: partition}
+		}
+		return s.CommitLog, nil
+	}
+	if s.TopicManager == nil {
+		return nil, proto.ErrTopicNotFound{Topic: topic}
+	}
+	return s.TopicManager.Partition(topic, partition)
+}
+
+func (s *grpcServer) CreateTopic(
+	ctx context.Context,
+	req *proto.CreateTopicRequest,
+) (*proto.CreateTopicResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objWildCard,
+		adminAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.TopicManager == nil {
+		return nil, errNoTopics
+	}
+	if err := s.TopicManager.CreateTopic(req.Name, req.Partitions); err != nil {
+		return nil, err
+	}
+	return &proto.CreateTopicResponse{
+		Topic: &proto.Topic{Name: req.Name, Partitions: req.Partitions},
+	}, nil
+}
+
+func (s *grpcServer) ListTopics(
+	ctx context.Context,
+	req *proto.ListTopicsRequest,
+) (*proto.ListTopicsResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objWildCard,
+		readAction,
+	); err != nil {
+		return nil, err
+	}
+	res := &proto.ListTopicsResponse{}
+	if s.TopicManager != nil {
+		res.Topics = s.TopicManager.ListTopics()
+	}
+	return res, nil
+}
+
+func (s *grpcServer) DescribeTopic(
+	ctx context.Context,
+	req *proto.DescribeTopicRequest,
+) (*proto.DescribeTopicResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objWildCard,
+		readAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.TopicManager == nil {
+		return nil, proto.ErrTopicNotFound{Topic: req.Name}
+	}
+	topic, partitions, err := s.TopicManager.DescribeTopic(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	return &proto.DescribeTopicResponse{
+		Topic:      topic,
+		Partitions: partitions,
+	}, nil
+}
+
+func (s *grpcServer) DeleteTopic(
+	ctx context.Context,
+	req *proto.DeleteTopicRequest,
+) (*proto.DeleteTopicResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objWildCard,
+		adminAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.TopicManager == nil {
+		return nil, proto.ErrTopicNotFound{Topic: req.Name}
+	}
+	if err := s.TopicManager.DeleteTopic(req.Name); err != nil {
+		return nil, err
+	}
+	return &proto.DeleteTopicResponse{}, nil
+}
+
+var errNoTopics = status.Error(codes.Unimplemented, "server doesn't keep topics")
+
+func (s *grpcServer) JoinGroup(
+	ctx context.Context,
+	req *proto.JoinGroupRequest,
+) (*proto.JoinGroupResponse, error) {
+	if err := s.authorizeGroup(ctx, req.Group); err != nil {
+		return nil, err
+	}
+	assignment, err := s.GroupCoordinator.JoinGroup(
+		req.Group,
+		req.Member,
+		req.Topics,
+		time.Duration(req.SessionTimeoutMs)*time.Millisecond,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &proto.JoinGroupResponse{Assignment: assignment}, nil
+}
+
+func (s *grpcServer) Heartbeat(
+	ctx context.Context,
+	req *proto.HeartbeatRequest,
+) (*proto.HeartbeatResponse, error) {
+	if err := s.authorizeGroup(ctx, req.Group); err != nil {
+		return nil, err
+	}
+	assignment, err := s.GroupCoordinator.Heartbeat(req.Group, req.Member)
+	if err != nil {
+		return nil, err
+	}
+	return &proto.HeartbeatResponse{Assignment: assignment}, nil
+}
+
+func (s *grpcServer) LeaveGroup(
+	ctx context.Context,
+	req *proto.LeaveGroupRequest,
+) (*proto.LeaveGroupResponse, error) {
+	if err := s.authorizeGroup(ctx, req.Group); err != nil {
+		return nil, err
+	}
+	if err := s.GroupCoordinator.LeaveGroup(req.Group, req.Member); err != nil {
+		return nil, err
+	}
+	return &proto.LeaveGroupResponse{}, nil
+}
+
+func (s *grpcServer) CommitOffset(
+	ctx context.Context,
+	req *proto.CommitOffsetRequest,
+) (*proto.CommitOffsetResponse, error) {
+	if err := s.authorizeGroup(ctx, req.Group); err != nil {
+		return nil, err
+	}
+	if err := s.GroupCoordinator.CommitOffset(req); err != nil {
+		return nil, err
+	}
+	return &proto.CommitOffsetResponse{}, nil
+}
+
+func (s *grpcServer) FetchCommittedOffset(
+	ctx context.Context,
+	req *proto.FetchCommittedOffsetRequest,
+) (*proto.FetchCommittedOffsetResponse, error) {
+	if err := s.authorizeGroup(ctx, req.Group); err != nil {
+		return nil, err
+	}
+	offset, found := s.GroupCoordinator.FetchCommittedOffset(
+		req.Group,
+		req.Topic,
+		req.Partition,
+	)
+	return &proto.FetchCommittedOffsetResponse{
+		Offset: offset,
+		Found:  found,
+	}, nil
+}
+
+/*
+authorizeGroup checks a consumer group request: reading is what groups
+are for, so any subject that reads may take part in one.
+*/
+func (s *grpcServer) authorizeGroup(ctx context.Context, group string) error {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objWildCard,
+		readAction,
+	); err != nil {
+		return err
+	}
+	if s.GroupCoordinator == nil {
+		return status.Error(
+			codes.Unimplemented,
+			"server doesn't coordinate consumer groups",
+		)
+	}
+	if group == "" {
+		return status.Error(codes.InvalidArgument, "group must be named")
+	}
+	return nil
 }
 
 func authenticate(ctx context.Context) (context.Context, error) {
@@ -226,3 +950,71 @@ subject checks
 func subject(ctx context.Context) string {
 	return ctx.Value(subjectContextKey{}).(string)
 }
+
+func (s *grpcServer) BeginTransaction(
+	ctx context.Context,
+	req *proto.BeginTransactionRequest,
+) (*proto.BeginTransactionResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objWildCard,
+		appendAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.TransactionCoordinator == nil {
+		return nil, errNoTransactions
+	}
+	id, err := s.TransactionCoordinator.BeginTransaction()
+	if err != nil {
+		return nil, err
+	}
+	return &proto.BeginTransactionResponse{TransactionId: id}, nil
+}
+
+func (s *grpcServer) CommitTransaction(
+	ctx context.Context,
+	req *proto.CommitTransactionRequest,
+) (*proto.CommitTransactionResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objWildCard,
+		appendAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.TransactionCoordinator == nil {
+		return nil, errNoTransactions
+	}
+	err := s.TransactionCoordinator.CommitTransaction(req.TransactionId)
+	if err != nil {
+		return nil, err
+	}
+	return &proto.CommitTransactionResponse{}, nil
+}
+
+func (s *grpcServer) AbortTransaction(
+	ctx context.Context,
+	req *proto.AbortTransactionRequest,
+) (*proto.AbortTransactionResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objWildCard,
+		appendAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.TransactionCoordinator == nil {
+		return nil, errNoTransactions
+	}
+	err := s.TransactionCoordinator.AbortTransaction(req.TransactionId)
+	if err != nil {
+		return nil, err
+	}
+	return &proto.AbortTransactionResponse{}, nil
+}
+
+var errNoTransactions = status.Error(
+	codes.Unimplemented,
+	"server doesn't keep transactions",
+)
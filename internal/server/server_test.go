@@ -3,12 +3,17 @@ package server
 import (
 	"context"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"logstore/internal/authz"
+	logclient "logstore/internal/client"
 	tlscf "logstore/internal/config"
+	"logstore/internal/group"
 	"logstore/internal/log/proto"
 	log "logstore/internal/logcomponents"
+	"logstore/internal/transaction"
 	"os"
+	"sync/atomic"
 	"time"
 
 	"net"
@@ -163,6 +168,15 @@ func TestServer(t *testing.T) {
 		"stream success":     testStreamAppendRead,
 		"read out of bounds": testOOBRead,
 		"unauthz failure":    testNoAuthZ,
+		"offsets for times":  testOffsetsForTimes,
+		"produce batch":      testProduceBatch,
+		"read range":         testReadRange,
+		"get servers":        testGetServers,
+		"acks":               testAcks,
+		"topics":             testTopics,
+		"groups":             testGroups,
+		"idempotent appends": testIdempotentProducer,
+		"transactions":       testTransactions,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			rootClient, nobodyClient, config, teardown := setupTest(t, nil)
@@ -172,6 +186,48 @@ func TestServer(t *testing.T) {
 	}
 }
 
+//countingLog counts the ranged reads a server makes against its log
+type countingLog struct {
+	CommitLog
+	reads int64
+}
+
+func (c *countingLog) ReadRange(from, maxRecords, maxBytes uint64) (
+	[]*proto.Record,
+	uint64,
+	error,
+) {
+	atomic.AddInt64(&c.reads, 1)
+	return c.CommitLog.ReadRange(from, maxRecords, maxBytes)
+}
+
+func TestReadStreamIdle(t *testing.T) {
+	counting := &countingLog{}
+	client, _, config, teardown := setupTest(t, func(c *Config) {
+		counting.CommitLog = c.CommitLog
+		c.CommitLog = counting
+	})
+	defer teardown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.ReadStream(ctx, &proto.ReadRequest{Offset: 0})
+	assert.NoError(t, err)
+
+	//An idle subscriber reads once, then blocks until there's data
+	time.Sleep(200 * time.Millisecond)
+	assert.True(t, atomic.LoadInt64(&counting.reads) <= 2)
+
+	_, err = config.CommitLog.Append(&proto.Record{Value: []byte("record")})
+	assert.NoError(t, err)
+	res, err := stream.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("record"), res.Record.Value)
+
+	time.Sleep(200 * time.Millisecond)
+	assert.True(t, atomic.LoadInt64(&counting.reads) <= 4)
+}
+
 func testUnaryAppendRead(
 	t *testing.T,
 	client, _ proto.LogClient,
@@ -250,7 +306,9 @@ func testStreamAppendRead(
 				Value:  record.Value,
 				Offset: uint64(i),
 			}
-			assert.Equal(t, res.Record, expected)
+			assert.Equal(t, expected.Value, res.Record.Value)
+			assert.Equal(t, expected.Offset, res.Record.Offset)
+			assert.NotZero(t, res.Record.Timestamp)
 		}
 	}
 }
@@ -309,6 +367,26 @@ func testNoAuthZ(
 		t.Fatalf("actual: %d, expected: %d", actualCode, expectedCode)
 	}
 
+	batch, err := client.ProduceBatch(ctx, &proto.ProduceBatchRequest{
+		Records: []*proto.Record{record},
+	})
+	assert.Nil(t, batch)
+
+	actualCode, expectedCode = status.Code(err), codes.PermissionDenied
+	if actualCode != expectedCode {
+		t.Fatalf("actual: %d, expected: %d", actualCode, expectedCode)
+	}
+
+	stream, err := client.AppendStream(ctx)
+	assert.NoError(t, err)
+	assert.NoError(t, stream.Send(appReq))
+	_, err = stream.Recv()
+
+	actualCode, expectedCode = status.Code(err), codes.PermissionDenied
+	if actualCode != expectedCode {
+		t.Fatalf("actual: %d, expected: %d", actualCode, expectedCode)
+	}
+
 	readReq := &proto.ReadRequest{
 		Offset: 0,
 	}
@@ -319,4 +397,628 @@ func testNoAuthZ(
 	if actualCode != expectedCode {
 		t.Fatalf("actual: %d, expected: %d", actualCode, expectedCode)
 	}
+
+	servers, err := client.GetServers(ctx, &proto.GetServersRequest{})
+	assert.Nil(t, servers)
+
+	actualCode, expectedCode = status.Code(err), codes.PermissionDenied
+	if actualCode != expectedCode {
+		t.Fatalf("actual: %d, expected: %d", actualCode, expectedCode)
+	}
+
+	topic, err := client.CreateTopic(ctx, &proto.CreateTopicRequest{
+		Name:       "orders",
+		Partitions: 1,
+	})
+	assert.Nil(t, topic)
+
+	actualCode, expectedCode = status.Code(err), codes.PermissionDenied
+	if actualCode != expectedCode {
+		t.Fatalf("actual: %d, expected: %d", actualCode, expectedCode)
+	}
+
+	deleted, err := client.DeleteTopic(ctx, &proto.DeleteTopicRequest{Name: "orders"})
+	assert.Nil(t, deleted)
+
+	actualCode, expectedCode = status.Code(err), codes.PermissionDenied
+	if actualCode != expectedCode {
+		t.Fatalf("actual: %d, expected: %d", actualCode, expectedCode)
+	}
+
+	txn, err := client.BeginTransaction(ctx, &proto.BeginTransactionRequest{})
+	assert.Nil(t, txn)
+
+	actualCode, expectedCode = status.Code(err), codes.PermissionDenied
+	if actualCode != expectedCode {
+		t.Fatalf("actual: %d, expected: %d", actualCode, expectedCode)
+	}
+
+	progress, err := client.ReportProgress(ctx, &proto.ReportProgressRequest{
+		Node:       "replica",
+		NextOffset: 1,
+	})
+	assert.Nil(t, progress)
+
+	actualCode, expectedCode = status.Code(err), codes.PermissionDenied
+	if actualCode != expectedCode {
+		t.Fatalf("actual: %d, expected: %d", actualCode, expectedCode)
+	}
+}
+
+func testOffsetsForTimes(
+	t *testing.T,
+	client, _ proto.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+
+	before := time.Now().UnixNano()
+	var stamps []int64
+	for i := 0; i < 3; i++ {
+		res, err := client.Append(ctx, &proto.AppendRequest{
+			Record: &proto.Record{Value: []byte("record")},
+		})
+		assert.NoError(t, err)
+		read, err := client.Read(ctx, &proto.ReadRequest{Offset: res.Offset})
+		assert.NoError(t, err)
+		stamps = append(stamps, read.Record.Timestamp)
+		time.Sleep(time.Millisecond)
+	}
+
+	res, err := client.OffsetsForTimes(ctx, &proto.OffsetsForTimesRequest{
+		Timestamps: []int64{before, stamps[1], stamps[2] + 1},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{0, 1, 3}, res.Offsets)
+}
+
+func testProduceBatch(
+	t *testing.T,
+	client, _ proto.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+
+	_, err := client.Append(ctx, &proto.AppendRequest{
+		Record: &proto.Record{Value: []byte("first")},
+	})
+	assert.NoError(t, err)
+
+	values := [][]byte{[]byte("uno"), []byte("dos"), []byte("tres")}
+	var records []*proto.Record
+	for _, value := range values {
+		records = append(records, &proto.Record{Value: value})
+	}
+	res, err := client.ProduceBatch(ctx, &proto.ProduceBatchRequest{
+		Records: records,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), res.BaseOffset)
+	assert.Equal(t, uint64(len(values)), res.Count)
+
+	for i, value := range values {
+		read, err := client.Read(ctx, &proto.ReadRequest{
+			Offset: res.BaseOffset + uint64(i),
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, value, read.Record.Value)
+	}
+}
+
+func testReadRange(
+	t *testing.T,
+	client, _ proto.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+
+	values := [][]byte{[]byte("uno"), []byte("dos"), []byte("tres")}
+	for _, value := range values {
+		_, err := client.Append(ctx, &proto.AppendRequest{
+			Record: &proto.Record{Value: value},
+		})
+		assert.NoError(t, err)
+	}
+
+	res, err := client.ReadRange(ctx, &proto.ReadRangeRequest{
+		Offset:     0,
+		MaxRecords: 2,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(res.Records))
+	assert.Equal(t, uint64(2), res.NextOffset)
+
+	res, err = client.ReadRange(ctx, &proto.ReadRangeRequest{
+		Offset: res.NextOffset,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(res.Records))
+	assert.Equal(t, values[2], res.Records[0].Value)
+	assert.Equal(t, uint64(3), res.NextOffset)
+}
+
+//getServers is a fixed cluster
+type getServers []*proto.Server
+
+func (g getServers) GetServers() ([]*proto.Server, error) {
+	return g, nil
+}
+
+func testGetServers(
+	t *testing.T,
+	client, _ proto.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+
+	//A server on its own has no cluster to list
+	_, err := client.GetServers(ctx, &proto.GetServersRequest{})
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+
+	servers := getServers{
+		{Id: "0", RpcAddr: "127.0.0.1:9001", Role: proto.Server_LEADER},
+		{Id: "1", RpcAddr: "127.0.0.1:9002", Role: proto.Server_FOLLOWER},
+	}
+	config.GetServerer = servers
+	res, err := client.GetServers(ctx, &proto.GetServersRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(res.Servers))
+	assert.Equal(t, "127.0.0.1:9001", res.Servers[0].RpcAddr)
+	assert.Equal(t, proto.Server_LEADER, res.Servers[0].Role)
+	assert.Equal(t, proto.Server_FOLLOWER, res.Servers[1].Role)
+}
+
+func testAcks(
+	t *testing.T,
+	client, _ proto.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+	record := &proto.Record{Value: []byte("hello world")}
+
+	//acks=0 gets nothing back, the record is still appended
+	res, err := client.Append(ctx, &proto.AppendRequest{
+		Record: record,
+		Acks:   proto.AppendRequest_NONE,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), res.Offset)
+	read, err := client.Read(ctx, &proto.ReadRequest{Offset: 0})
+	assert.NoError(t, err)
+	assert.Equal(t, record.Value, read.Record.Value)
+
+	//acks=all needs a server that hears from its replicas, or appends nothing
+	_, err = client.Append(ctx, &proto.AppendRequest{
+		Record: record,
+		Acks:   proto.AppendRequest_ALL,
+	})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	acks := log.NewAcks()
+	config.Acknowledger = acks
+	short, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	_, err = client.Append(short, &proto.AppendRequest{
+		Record: record,
+		Acks:   proto.AppendRequest_ALL,
+	})
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+	//Timing out still leaves the record appended. Replicas report holding it
+	_, err = client.ReportProgress(ctx, &proto.ReportProgressRequest{
+		Node:       "replica",
+		NextOffset: 2,
+	})
+	assert.NoError(t, err)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		acks.ReportProgress("replica", 3)
+	}()
+	res, err = client.Append(ctx, &proto.AppendRequest{
+		Record:   record,
+		Acks:     proto.AppendRequest_ALL,
+		Replicas: 1,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), res.Offset)
+
+	//A stream skips the responses to acks=0
+	stream, err := client.AppendStream(ctx)
+	assert.NoError(t, err)
+	assert.NoError(t, stream.Send(&proto.AppendRequest{
+		Record: record,
+		Acks:   proto.AppendRequest_NONE,
+	}))
+	assert.NoError(t, stream.Send(&proto.AppendRequest{Record: record}))
+	streamRes, err := stream.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4), streamRes.Offset)
+}
+
+//topics serves a Topics' partitions as CommitLogs
+type topics struct {
+	*log.Topics
+}
+
+func (t topics) Partition(topic string, partition uint32) (CommitLog, error) {
+	l, err := t.Topics.Partition(topic, partition)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func testTopics(
+	t *testing.T,
+	client, _ proto.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+	create := &proto.CreateTopicRequest{Name: "orders", Partitions: 2}
+
+	//A server without topics only serves the default one
+	_, err := client.CreateTopic(ctx, create)
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+	_, err = client.Read(ctx, &proto.ReadRequest{Topic: "orders"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	dir, err := ioutil.TempDir("", "topics-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	manager, err := log.NewTopics(dir, log.Config{})
+	assert.NoError(t, err)
+	defer manager.Close()
+	config.TopicManager = topics{manager}
+
+	created, err := client.CreateTopic(ctx, create)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2), created.Topic.Partitions)
+	_, err = client.CreateTopic(ctx, create)
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+	_, err = client.CreateTopic(ctx, &proto.CreateTopicRequest{
+		Name:       "../orders",
+		Partitions: 1,
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	//Partitions keep offsets of their own, apart from the default topic
+	record := &proto.Record{Value: []byte("order")}
+	partition := uint32(1)
+	for i := 0; i < 2; i++ {
+		res, err := client.Append(ctx, &proto.AppendRequest{
+			Record:    record,
+			Topic:     "orders",
+			Partition: &partition,
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(i), res.Offset)
+	}
+	read, err := client.Read(ctx, &proto.ReadRequest{
+		Offset:    1,
+		Topic:     "orders",
+		Partition: 1,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, record.Value, read.Record.Value)
+	assert.Equal(t, "orders", read.Record.Topic)
+	assert.Equal(t, uint32(1), read.Record.Partition)
+	_, err = client.Read(ctx, &proto.ReadRequest{Topic: "orders"})
+	assert.Error(t, err)
+	_, err = client.Read(ctx, &proto.ReadRequest{})
+	assert.Error(t, err)
+	_, err = client.Read(ctx, &proto.ReadRequest{Topic: "orders", Partition: 2})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	//Only the default topic is replicated, so only it takes acks=all
+	config.Acknowledger = log.NewAcks()
+	_, err = client.Append(ctx, &proto.AppendRequest{
+		Record: record,
+		Acks:   proto.AppendRequest_ALL,
+		Topic:  "orders",
+	})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	list, err := client.ListTopics(ctx, &proto.ListTopicsRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(list.Topics))
+	assert.Equal(t, "orders", list.Topics[0].Name)
+
+	described, err := client.DescribeTopic(ctx, &proto.DescribeTopicRequest{
+		Name: "orders",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(described.Partitions))
+	assert.Equal(t, uint64(0), described.Partitions[0].NextOffset)
+	assert.Equal(t, uint64(2), described.Partitions[1].NextOffset)
+
+	//Appends leaving the partition unset need the server to pick one
+	keyed := &proto.Record{Key: []byte("customer-1"), Value: []byte("order")}
+	_, err = client.Append(ctx, &proto.AppendRequest{
+		Record: keyed,
+		Topic:  "orders",
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	config.Partitioner = &logclient.HashPartitioner{}
+	expected := (&logclient.HashPartitioner{}).Partition(keyed, 2)
+	for i := 0; i < 2; i++ {
+		res, err := client.Append(ctx, &proto.AppendRequest{
+			Record: keyed,
+			Topic:  "orders",
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, expected, res.Partition)
+	}
+
+	//Deleting the topic ends streams reading it
+	stream, err := client.ReadStream(ctx, &proto.ReadRequest{
+		Offset:    4,
+		Topic:     "orders",
+		Partition: 1,
+	})
+	assert.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	_, err = client.DeleteTopic(ctx, &proto.DeleteTopicRequest{Name: "orders"})
+	assert.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Error(t, err)
+
+	_, err = client.DescribeTopic(ctx, &proto.DescribeTopicRequest{
+		Name: "orders",
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.DeleteTopic(ctx, &proto.DeleteTopicRequest{Name: "orders"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func testGroups(
+	t *testing.T,
+	client, _ proto.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+	join := &proto.JoinGroupRequest{Group: "readers", Topics: []string{""}}
+
+	_, err := client.JoinGroup(ctx, join)
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+
+	dir, err := ioutil.TempDir("", "groups-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	offsets, err := group.NewOffsets(dir, log.Config{})
+	assert.NoError(t, err)
+	defer offsets.Close()
+	config.GroupCoordinator = group.NewCoordinator(nil, offsets)
+
+	_, err = client.JoinGroup(ctx, &proto.JoinGroupRequest{Topics: []string{""}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.JoinGroup(ctx, &proto.JoinGroupRequest{
+		Group:  "readers",
+		Topics: []string{"orders"},
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	joined, err := client.JoinGroup(ctx, join)
+	assert.NoError(t, err)
+	assignment := joined.Assignment
+	assert.Equal(t, 1, len(assignment.Partitions))
+
+	fetch := &proto.FetchCommittedOffsetRequest{Group: "readers"}
+	fetched, err := client.FetchCommittedOffset(ctx, fetch)
+	assert.NoError(t, err)
+	assert.False(t, fetched.Found)
+	commit := &proto.CommitOffsetRequest{
+		Group:      "readers",
+		Offset:     4,
+		Member:     assignment.Member,
+		Generation: assignment.Generation,
+	}
+	_, err = client.CommitOffset(ctx, commit)
+	assert.NoError(t, err)
+	fetched, err = client.FetchCommittedOffset(ctx, fetch)
+	assert.NoError(t, err)
+	assert.True(t, fetched.Found)
+	assert.Equal(t, uint64(4), fetched.Offset)
+
+	//Once the group rebalances, commits under the old generation are refused
+	_, err = client.JoinGroup(ctx, join)
+	assert.NoError(t, err)
+	_, err = client.CommitOffset(ctx, commit)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	heartbeat, err := client.Heartbeat(ctx, &proto.HeartbeatRequest{
+		Group:  "readers",
+		Member: assignment.Member,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, assignment.Generation+1, heartbeat.Assignment.Generation)
+
+	_, err = client.LeaveGroup(ctx, &proto.LeaveGroupRequest{
+		Group:  "readers",
+		Member: assignment.Member,
+	})
+	assert.NoError(t, err)
+	_, err = client.Heartbeat(ctx, &proto.HeartbeatRequest{
+		Group:  "readers",
+		Member: assignment.Member,
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func testIdempotentProducer(
+	t *testing.T,
+	client, _ proto.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+	append := func(seq uint64) (*proto.AppendResponse, error) {
+		return client.Append(ctx, &proto.AppendRequest{
+			Record:     &proto.Record{Value: []byte(fmt.Sprintf("record-%d", seq))},
+			ProducerId: "producer",
+			Sequence:   seq,
+		})
+	}
+	for seq := uint64(0); seq < 2; seq++ {
+		res, err := append(seq)
+		assert.NoError(t, err)
+		assert.Equal(t, seq, res.Offset)
+	}
+
+	//A retry after a lost response gets the first append's offset
+	res, err := append(1)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), res.Offset)
+	_, err = client.Read(ctx, &proto.ReadRequest{Offset: 2})
+	assert.Error(t, err)
+	read, err := client.Read(ctx, &proto.ReadRequest{Offset: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, "producer", read.Record.ProducerId)
+	assert.Equal(t, uint64(1), read.Record.Sequence)
+
+	_, err = append(5)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	//Sequences are per partition, so the server can't pick one
+	_, err = client.Append(ctx, &proto.AppendRequest{
+		Record:     &proto.Record{Value: []byte("record")},
+		Topic:      "orders",
+		ProducerId: "producer",
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.ProduceBatch(ctx, &proto.ProduceBatchRequest{
+		Records: []*proto.Record{{Value: []byte("record"), ProducerId: "producer"}},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func testTransactions(
+	t *testing.T,
+	client, _ proto.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+	_, err := client.BeginTransaction(ctx, &proto.BeginTransactionRequest{})
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+
+	dir, err := ioutil.TempDir("", "transactions-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	manager, err := log.NewTopics(dir, log.Config{})
+	assert.NoError(t, err)
+	defer manager.Close()
+	assert.NoError(t, manager.CreateTopic("orders", 2))
+	config.TopicManager = topics{manager}
+	decisions, err := transaction.NewDecisions(dir+"/transactions", log.Config{})
+	assert.NoError(t, err)
+	defer decisions.Close()
+	config.TransactionCoordinator = transaction.NewCoordinator(
+		func(topic string, partition uint32) (transaction.Log, error) {
+			if topic == "" {
+				return config.CommitLog, nil
+			}
+			return manager.Partition(topic, partition)
+		},
+		decisions,
+	)
+
+	committed := func(offset uint64) (*proto.ReadRangeResponse, error) {
+		return client.ReadRange(ctx, &proto.ReadRangeRequest{
+			Offset:    offset,
+			Isolation: proto.Isolation_READ_COMMITTED,
+		})
+	}
+	_, err = client.Append(ctx, &proto.AppendRequest{
+		Record: &proto.Record{Value: []byte("plain")},
+	})
+	assert.NoError(t, err)
+
+	//A transaction's records are hidden from read-committed readers until it commits
+	begun, err := client.BeginTransaction(ctx, &proto.BeginTransactionRequest{})
+	assert.NoError(t, err)
+	id := begun.TransactionId
+	_, err = client.Append(ctx, &proto.AppendRequest{
+		Record:        &proto.Record{Value: []byte("committed")},
+		TransactionId: id,
+	})
+	assert.NoError(t, err)
+	partition := uint32(1)
+	_, err = client.Append(ctx, &proto.AppendRequest{
+		Record:        &proto.Record{Value: []byte("committed")},
+		Topic:         "orders",
+		Partition:     &partition,
+		TransactionId: id,
+	})
+	assert.NoError(t, err)
+	stream, err := client.ReadStream(ctx, &proto.ReadRequest{
+		Isolation: proto.Isolation_READ_COMMITTED,
+	})
+	assert.NoError(t, err)
+	res, err := stream.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("plain"), res.Record.Value)
+	page, err := committed(0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(page.Records))
+	assert.Equal(t, uint64(1), page.NextOffset)
+	_, err = client.Read(ctx, &proto.ReadRequest{
+		Offset:    1,
+		Isolation: proto.Isolation_READ_COMMITTED,
+	})
+	assert.Equal(t, status.Code(proto.ErrOffOutOfRange{}), status.Code(err))
+	uncommitted, err := client.Read(ctx, &proto.ReadRequest{Offset: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, id, uncommitted.Record.TransactionId)
+
+	_, err = client.CommitTransaction(ctx, &proto.CommitTransactionRequest{
+		TransactionId: id,
+	})
+	assert.NoError(t, err)
+	res, err = stream.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("committed"), res.Record.Value)
+	orders, err := client.ReadRange(ctx, &proto.ReadRangeRequest{
+		Topic:     "orders",
+		Partition: 1,
+		Isolation: proto.Isolation_READ_COMMITTED,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(orders.Records))
+	assert.Equal(t, uint64(2), orders.NextOffset) //past the marker
+
+	//An aborted transaction's records and every marker are skipped
+	begun, err = client.BeginTransaction(ctx, &proto.BeginTransactionRequest{})
+	assert.NoError(t, err)
+	_, err = client.Append(ctx, &proto.AppendRequest{
+		Record:        &proto.Record{Value: []byte("aborted")},
+		TransactionId: begun.TransactionId,
+	})
+	assert.NoError(t, err)
+	_, err = client.AbortTransaction(ctx, &proto.AbortTransactionRequest{
+		TransactionId: begun.TransactionId,
+	})
+	assert.NoError(t, err)
+	_, err = client.Append(ctx, &proto.AppendRequest{
+		Record: &proto.Record{Value: []byte("after")},
+	})
+	assert.NoError(t, err)
+	res, err = stream.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("after"), res.Record.Value)
+	assert.Equal(t, uint64(5), res.Record.Offset)
+	_, err = client.Read(ctx, &proto.ReadRequest{
+		Offset:    3,
+		Isolation: proto.Isolation_READ_COMMITTED,
+	})
+	assert.Equal(t, status.Code(proto.ErrOffNotPresent{}), status.Code(err))
+
+	//Records can't claim transactions or markers of their own
+	_, err = client.Append(ctx, &proto.AppendRequest{
+		Record: &proto.Record{Value: []byte("forged"), Marker: proto.Record_COMMIT},
+	})
+	assert.NoError(t, err)
+	forged, err := client.Read(ctx, &proto.ReadRequest{Offset: 6})
+	assert.NoError(t, err)
+	assert.Equal(t, proto.Record_NONE, forged.Record.Marker)
+	_, err = client.CommitTransaction(ctx, &proto.CommitTransactionRequest{
+		TransactionId: begun.TransactionId,
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err))
 }
@@ -0,0 +1,304 @@
+/*
+Package transaction coordinates transactions: records appended to any
+number of partitions that read-committed readers see all of, once the
+transaction commits, or none of.
+*/
+package transaction
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"logstore/internal/log/proto"
+	"sync"
+	"time"
+)
+
+//defaultTimeout is how long a transaction stays open without appends by default
+const defaultTimeout = time.Minute
+
+//Log is a partition transactions append their records and markers to
+type Log interface {
+	Append(*proto.Record) (uint64, error)
+}
+
+/*
+Resolver finds the log of a topic's partition, the default topic being
+named "". It returns ErrTopicNotFound or ErrPartitionNotFound for one
+that doesn't exist, as after it was deleted.
+*/
+type Resolver func(topic string, partition uint32) (Log, error)
+
+/*
+Coordinator keeps the transactions open on this server. A transaction's
+records are appended to their partitions straight away, tagged with its
+ID, and readers in read-committed mode stop at them. Ending it first
+records the decision in Decisions, then appends a COMMIT or ABORT
+marker to every partition it appended to, after which readers move on,
+skipping its records if it aborted. A decision whose markers couldn't
+all be written is finished by retrying the commit or abort, by Expire,
+or by Restore after a restart.
+*/
+type Coordinator struct {
+	Resolve   Resolver
+	Decisions *Decisions
+	//Timeout aborts transactions left this long without appends, a minute by default
+	Timeout time.Duration
+
+	mu   sync.Mutex
+	open map[string]*transaction
+}
+
+type transaction struct {
+	mu           sync.Mutex //serializes appends against ending the transaction
+	participants []*proto.TopicPartition
+	seen         time.Time           //begun or last appended to
+	decision     proto.Record_Marker //NONE while the transaction is open
+}
+
+func NewCoordinator(resolve Resolver, decisions *Decisions) *Coordinator {
+	return &Coordinator{
+		Resolve:   resolve,
+		Decisions: decisions,
+		open:      make(map[string]*transaction),
+	}
+}
+
+//BeginTransaction opens a transaction and returns its ID
+func (c *Coordinator) BeginTransaction() (string, error) {
+	id, err := newTransactionID()
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.open[id] = &transaction{seen: time.Now()}
+	return id, nil
+}
+
+//Append appends record to the partition as part of the open transaction id
+func (c *Coordinator) Append(
+	id, topic string,
+	partition uint32,
+	record *proto.Record,
+) (uint64, error) {
+	txn, err := c.transaction(id)
+	if err != nil {
+		return 0, err
+	}
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.decision != proto.Record_NONE {
+		return 0, proto.ErrTransactionNotFound{TransactionId: id}
+	}
+	log, err := c.Resolve(topic, partition)
+	if err != nil {
+		return 0, err
+	}
+	//Joined first, a failed append may still have reached the log
+	txn.join(topic, partition)
+	txn.seen = time.Now()
+	record.TransactionId, record.Marker = id, proto.Record_NONE
+	return log.Append(record)
+}
+
+//CommitTransaction makes the transaction's records visible to read-committed readers
+func (c *Coordinator) CommitTransaction(id string) error {
+	return c.end(id, proto.Record_COMMIT)
+}
+
+//AbortTransaction has read-committed readers skip the transaction's records
+func (c *Coordinator) AbortTransaction(id string) error {
+	return c.end(id, proto.Record_ABORT)
+}
+
+/*
+end decides the transaction with marker and marks its partitions. A
+transaction decided the other way already isn't open to end.
+*/
+func (c *Coordinator) end(id string, marker proto.Record_Marker) error {
+	txn, err := c.transaction(id)
+	if err != nil {
+		return err
+	}
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.decision != proto.Record_NONE && txn.decision != marker {
+		return proto.ErrTransactionNotFound{TransactionId: id}
+	}
+	return c.decide(id, txn, marker)
+}
+
+/*
+decide records the decision unless it already was, then appends the
+marker to the partitions still missing it. The transaction is
+forgotten once they all have it. Callers must hold txn's lock.
+*/
+func (c *Coordinator) decide(id string, txn *transaction, marker proto.Record_Marker) error {
+	if txn.decision == proto.Record_NONE {
+		err := c.Decisions.Decide(id, Decision{
+			Marker:       marker,
+			Participants: txn.participants,
+		})
+		if err != nil {
+			return err
+		}
+		txn.decision = marker
+	}
+	for len(txn.participants) > 0 {
+		tp := txn.participants[0]
+		log, err := c.Resolve(tp.Topic, tp.Partition)
+		switch err.(type) {
+		case nil:
+			_, err = log.Append(&proto.Record{
+				TransactionId: id,
+				Marker:        marker,
+			})
+			if err != nil {
+				return err
+			}
+		case proto.ErrTopicNotFound, proto.ErrPartitionNotFound:
+			//Deleted along with the transaction's records
+		default:
+			return err
+		}
+		txn.participants = txn.participants[1:]
+	}
+	if err := c.Decisions.Forget(id); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.open, id)
+	return nil
+}
+
+/*
+Expire aborts the open transactions left longer than the timeout as of
+now, and retries marking those decided. Returns the number aborted,
+and the first error marking any.
+*/
+func (c *Coordinator) Expire(now time.Time) (int, error) {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	c.mu.Lock()
+	open := make(map[string]*transaction, len(c.open))
+	for id, txn := range c.open {
+		open[id] = txn
+	}
+	c.mu.Unlock()
+
+	var first error
+	aborted := 0
+	for id, txn := range open {
+		txn.mu.Lock()
+		marker := txn.decision
+		if marker == proto.Record_NONE && now.Sub(txn.seen) > timeout {
+			marker = proto.Record_ABORT
+			aborted++
+		}
+		if marker != proto.Record_NONE {
+			if err := c.decide(id, txn, marker); err != nil && first == nil {
+				first = err
+			}
+		}
+		txn.mu.Unlock()
+	}
+	return aborted, first
+}
+
+/*
+Restore takes back the transactions a previous coordinator left, on
+starting: the decisions it recorded are finished, and the transactions
+open in the partitions, by ID, that it never decided are open again
+for their producers to go on with or to expire. Returns the first
+error finishing a decision, Expire retries it.
+*/
+func (c *Coordinator) Restore(open map[string][]*proto.TopicPartition) error {
+	pending, err := c.Decisions.Pending()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	for id, participants := range open {
+		if _, ok := pending[id]; !ok {
+			c.open[id] = &transaction{
+				participants: participants,
+				seen:         time.Now(),
+			}
+		}
+	}
+	for id, decision := range pending {
+		c.open[id] = &transaction{
+			participants: decision.Participants,
+			seen:         time.Now(),
+			decision:     decision.Marker,
+		}
+	}
+	c.mu.Unlock()
+
+	var first error
+	for id, decision := range pending {
+		txn, err := c.transaction(id)
+		if err != nil {
+			continue
+		}
+		txn.mu.Lock()
+		err = c.decide(id, txn, decision.Marker)
+		txn.mu.Unlock()
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+/*
+TakeOver opens again the transactions open in the partitions, by ID,
+that the coordinator doesn't know of, for their producers to go on with
+or to expire: as a new Raft leader does with those its predecessor began.
+*/
+func (c *Coordinator) TakeOver(open map[string][]*proto.TopicPartition) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, participants := range open {
+		if _, ok := c.open[id]; !ok {
+			c.open[id] = &transaction{
+				participants: participants,
+				seen:         time.Now(),
+			}
+		}
+	}
+}
+
+func (c *Coordinator) transaction(id string) (*transaction, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	txn, ok := c.open[id]
+	if !ok {
+		return nil, proto.ErrTransactionNotFound{TransactionId: id}
+	}
+	return txn, nil
+}
+
+//join adds a partition to those the transaction appended to
+func (t *transaction) join(topic string, partition uint32) {
+	for _, tp := range t.participants {
+		if tp.Topic == topic && tp.Partition == partition {
+			return
+		}
+	}
+	t.participants = append(t.participants, &proto.TopicPartition{
+		Topic:     topic,
+		Partition: partition,
+	})
+}
+
+func newTransactionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,175 @@
+package transaction
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"logstore/internal/log/proto"
+	"logstore/internal/logcomponents"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//log keeps what's appended to it, failing appends while broken
+type log struct {
+	records []*proto.Record
+	broken  bool
+}
+
+func (l *log) Append(record *proto.Record) (uint64, error) {
+	if l.broken {
+		return 0, errors.New("broken")
+	}
+	l.records = append(l.records, record)
+	return uint64(len(l.records) - 1), nil
+}
+
+//markers returns the markers appended to the log
+func (l *log) markers() []proto.Record_Marker {
+	var markers []proto.Record_Marker
+	for _, record := range l.records {
+		if record.Marker != proto.Record_NONE {
+			markers = append(markers, record.Marker)
+		}
+	}
+	return markers
+}
+
+//logs is a fixed set of partitions, by topic and partition
+type logs map[string]*log
+
+func (l logs) resolve(topic string, partition uint32) (Log, error) {
+	log, ok := l[fmt.Sprintf("%s/%d", topic, partition)]
+	if !ok {
+		return nil, proto.ErrTopicNotFound{Topic: topic}
+	}
+	return log, nil
+}
+
+func newTestCoordinator(t *testing.T, partitions logs) (*Coordinator, func()) {
+	dir, err := ioutil.TempDir("", "coordinator-test")
+	assert.NoError(t, err)
+	decisions, err := NewDecisions(dir, logcomponents.Config{})
+	assert.NoError(t, err)
+	return NewCoordinator(partitions.resolve, decisions), func() {
+		decisions.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCoordinator(t *testing.T) {
+	partitions := logs{"orders/0": &log{}, "orders/1": &log{}, "/0": &log{}}
+	c, teardown := newTestCoordinator(t, partitions)
+	defer teardown()
+
+	//Commits mark every partition appended to, once each
+	id, err := c.BeginTransaction()
+	assert.NoError(t, err)
+	for _, topic := range []string{"orders", "", "orders"} {
+		_, err = c.Append(id, topic, 0, &proto.Record{Value: []byte("record")})
+		assert.NoError(t, err)
+	}
+	_, err = c.Append(id, "clicks", 0, &proto.Record{})
+	assert.Equal(t, proto.ErrTopicNotFound{Topic: "clicks"}, err)
+	assert.Equal(t, id, partitions["orders/0"].records[0].TransactionId)
+	assert.NoError(t, c.CommitTransaction(id))
+	assert.Equal(t, []proto.Record_Marker{proto.Record_COMMIT}, partitions["orders/0"].markers())
+	assert.Equal(t, []proto.Record_Marker{proto.Record_COMMIT}, partitions["/0"].markers())
+	assert.Empty(t, partitions["orders/1"].records)
+
+	//Ended transactions aren't open to append to or end again
+	_, err = c.Append(id, "orders", 1, &proto.Record{})
+	assert.Equal(t, proto.ErrTransactionNotFound{TransactionId: id}, err)
+	assert.Equal(t, proto.ErrTransactionNotFound{TransactionId: id}, c.AbortTransaction(id))
+
+	//A decision whose markers fail is finished by retrying it
+	id, err = c.BeginTransaction()
+	assert.NoError(t, err)
+	_, err = c.Append(id, "orders", 1, &proto.Record{})
+	assert.NoError(t, err)
+	partitions["orders/1"].broken = true
+	assert.Error(t, c.AbortTransaction(id))
+	assert.Equal(t, proto.ErrTransactionNotFound{TransactionId: id}, c.CommitTransaction(id))
+	partitions["orders/1"].broken = false
+	assert.NoError(t, c.AbortTransaction(id))
+	assert.Equal(t, []proto.Record_Marker{proto.Record_ABORT}, partitions["orders/1"].markers())
+	pending, err := c.Decisions.Pending()
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+}
+
+func TestCoordinatorExpire(t *testing.T) {
+	partitions := logs{"/0": &log{}}
+	c, teardown := newTestCoordinator(t, partitions)
+	defer teardown()
+	c.Timeout = time.Minute
+
+	idle, err := c.BeginTransaction()
+	assert.NoError(t, err)
+	_, err = c.Append(idle, "", 0, &proto.Record{})
+	assert.NoError(t, err)
+	aborted, err := c.Expire(time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, aborted)
+
+	aborted, err = c.Expire(time.Now().Add(2 * time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, aborted)
+	assert.Equal(t, []proto.Record_Marker{proto.Record_ABORT}, partitions["/0"].markers())
+	assert.Equal(t, proto.ErrTransactionNotFound{TransactionId: idle}, c.CommitTransaction(idle))
+}
+
+func TestCoordinatorRestore(t *testing.T) {
+	partitions := logs{"orders/0": &log{}, "/0": &log{}}
+	c, teardown := newTestCoordinator(t, partitions)
+	defer teardown()
+
+	//A commit decided before the restart is finished on restoring
+	both := []*proto.TopicPartition{{Topic: "orders"}, {Topic: ""}}
+	assert.NoError(t, c.Decisions.Decide("decided", Decision{
+		Marker:       proto.Record_COMMIT,
+		Participants: both,
+	}))
+	assert.NoError(t, c.Restore(map[string][]*proto.TopicPartition{
+		"decided":   both,
+		"undecided": {{Topic: "orders"}},
+	}))
+	assert.Equal(t, []proto.Record_Marker{proto.Record_COMMIT}, partitions["orders/0"].markers())
+	assert.Equal(t, []proto.Record_Marker{proto.Record_COMMIT}, partitions["/0"].markers())
+
+	//One never decided is open again for its producer
+	_, err := c.Append("undecided", "", 0, &proto.Record{})
+	assert.NoError(t, err)
+	assert.NoError(t, c.CommitTransaction("undecided"))
+	assert.Equal(t, 2, len(partitions["orders/0"].markers()))
+	assert.Equal(t, 2, len(partitions["/0"].markers()))
+}
+
+func TestCoordinatorTakeOver(t *testing.T) {
+	partitions := logs{"/0": &log{}}
+	c, teardown := newTestCoordinator(t, partitions)
+	defer teardown()
+	c.Timeout = time.Minute
+
+	//Transactions another coordinator began are taken over, known ones kept
+	known, err := c.BeginTransaction()
+	assert.NoError(t, err)
+	_, err = c.Append(known, "", 0, &proto.Record{})
+	assert.NoError(t, err)
+	c.TakeOver(map[string][]*proto.TopicPartition{
+		"predecessor": {{Topic: ""}},
+		known:         {{Topic: ""}},
+	})
+
+	//and abort once they expire
+	aborted, err := c.Expire(time.Now().Add(2 * time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, aborted)
+	assert.Equal(t, []proto.Record_Marker{
+		proto.Record_ABORT,
+		proto.Record_ABORT,
+	}, partitions["/0"].markers())
+}
@@ -0,0 +1,148 @@
+package transaction
+
+import (
+	"encoding/binary"
+	"errors"
+	"logstore/internal/log/proto"
+	"logstore/internal/logcomponents"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	enc                = binary.BigEndian
+	errCorruptDecision = errors.New("transaction: corrupt decision")
+)
+
+//Decision is a transaction committed or aborted and the partitions it appended to
+type Decision struct {
+	Marker       proto.Record_Marker
+	Participants []*proto.TopicPartition
+}
+
+/*
+Decisions keeps the transactions decided but not yet marked in every
+partition they appended to, for a restarted coordinator to finish.
+Each decision is appended to a compacted Log keyed by transaction ID,
+and deleted with a tombstone once its markers are all written.
+*/
+type Decisions struct {
+	mu  sync.Mutex
+	log *logcomponents.Log
+}
+
+/*
+NewDecisions opens the decisions kept in the log in dir. The log is
+compacted and synced on every append whatever c says, as a decision
+must be on disk before any of its markers are written.
+*/
+func NewDecisions(dir string, c logcomponents.Config) (*Decisions, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c.Compaction.Enabled = true
+	c.Durability = logcomponents.Durability{Mode: logcomponents.DurabilitySync}
+	if c.Segment.MaxStoreBytes == 0 {
+		c.Segment.MaxStoreBytes = 1 << 20
+	}
+	if c.Segment.MaxIndexBytes == 0 {
+		c.Segment.MaxIndexBytes = 1 << 20
+	}
+	log, err := logcomponents.NewLog(dir, c)
+	if err != nil {
+		return nil, err
+	}
+	return &Decisions{log: log}, nil
+}
+
+//Decide records that the transaction ends with marker in each participant
+func (d *Decisions) Decide(id string, decision Decision) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, err := d.log.Append(&proto.Record{
+		Key:   []byte(id),
+		Value: encodeDecision(decision),
+	})
+	return err
+}
+
+//Forget records that every participant of the transaction has its marker
+func (d *Decisions) Forget(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, err := d.log.Append(&proto.Record{Key: []byte(id)})
+	return err
+}
+
+//Pending returns the decisions not yet forgotten, by transaction ID
+func (d *Decisions) Pending() (map[string]Decision, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	lowest, err := d.log.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+	records, _, err := d.log.ReadRange(lowest, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	pending := make(map[string]Decision)
+	for _, record := range records {
+		if len(record.Value) == 0 {
+			delete(pending, string(record.Key))
+			continue
+		}
+		decision, err := decodeDecision(record.Value)
+		if err != nil {
+			return nil, err
+		}
+		pending[string(record.Key)] = decision
+	}
+	return pending, nil
+}
+
+//Compact drops forgotten decisions from the log, returning how many records
+func (d *Decisions) Compact(now time.Time) (int, error) {
+	return d.log.Compact(now)
+}
+
+func (d *Decisions) Close() error {
+	return d.log.Close()
+}
+
+/*
+encodeDecision lays a decision out as its marker byte, then each
+participant's topic, length prefixed, and partition.
+*/
+func encodeDecision(decision Decision) []byte {
+	b := []byte{byte(decision.Marker)}
+	n := make([]byte, binary.MaxVarintLen64)
+	for _, tp := range decision.Participants {
+		b = append(b, n[:binary.PutUvarint(n, uint64(len(tp.Topic)))]...)
+		b = append(b, tp.Topic...)
+		enc.PutUint32(n, tp.Partition)
+		b = append(b, n[:4]...)
+	}
+	return b
+}
+
+func decodeDecision(b []byte) (Decision, error) {
+	decision := Decision{Marker: proto.Record_Marker(b[0])}
+	if decision.Marker != proto.Record_COMMIT && decision.Marker != proto.Record_ABORT {
+		return Decision{}, errCorruptDecision
+	}
+	for b = b[1:]; len(b) > 0; {
+		size, n := binary.Uvarint(b)
+		if n <= 0 || uint64(len(b)-n) < size+4 {
+			return Decision{}, errCorruptDecision
+		}
+		b = b[n:]
+		decision.Participants = append(decision.Participants, &proto.TopicPartition{
+			Topic:     string(b[:size]),
+			Partition: enc.Uint32(b[size:]),
+		})
+		b = b[size+4:]
+	}
+	return decision, nil
+}
@@ -0,0 +1,49 @@
+package transaction
+
+import (
+	"io/ioutil"
+	"logstore/internal/log/proto"
+	"logstore/internal/logcomponents"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecisions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "decisions-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	decisions, err := NewDecisions(dir, logcomponents.Config{})
+	assert.NoError(t, err)
+
+	committed := Decision{
+		Marker: proto.Record_COMMIT,
+		Participants: []*proto.TopicPartition{
+			{Topic: "orders", Partition: 3},
+			{Topic: "", Partition: 0},
+		},
+	}
+	assert.NoError(t, decisions.Decide("committed", committed))
+	assert.NoError(t, decisions.Decide("aborted", Decision{Marker: proto.Record_ABORT}))
+	assert.NoError(t, decisions.Decide("finished", committed))
+	assert.NoError(t, decisions.Forget("finished"))
+
+	//Decisions not yet forgotten survive reopening
+	assert.NoError(t, decisions.Close())
+	decisions, err = NewDecisions(dir, logcomponents.Config{})
+	assert.NoError(t, err)
+	defer decisions.Close()
+	pending, err := decisions.Pending()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(pending))
+	assert.Equal(t, proto.Record_COMMIT, pending["committed"].Marker)
+	assert.Equal(t, 2, len(pending["committed"].Participants))
+	assert.Equal(t, "orders", pending["committed"].Participants[0].Topic)
+	assert.Equal(t, uint32(3), pending["committed"].Participants[0].Partition)
+	assert.Equal(t, proto.Record_ABORT, pending["aborted"].Marker)
+	assert.Empty(t, pending["aborted"].Participants)
+
+	_, err = decodeDecision([]byte{byte(proto.Record_COMMIT), 9, 'x'})
+	assert.Equal(t, errCorruptDecision, err)
+}